@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"libvnc-go/pkg/vnc"
 	"log"
+	"os"
+	"os/signal"
 	"time"
 )
 
 func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
 	client := vnc.NewClient(8, 3, 4)
 	if client == nil {
 		log.Fatal("Failed to create VNC client")
@@ -50,8 +56,11 @@ func main() {
 		}
 	})
 
-	if !client.Init() {
-		log.Fatal("Failed to initialize VNC client")
+	connectCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	err := client.Connect(connectCtx)
+	cancel()
+	if err != nil {
+		log.Fatal("Failed to initialize VNC client: ", err)
 	}
 
 	fmt.Println("VNC client initialized successfully")
@@ -77,8 +86,8 @@ func main() {
 	}()
 
 	fmt.Println("Running event loop...")
-	err := client.RunEventLoop(10 * 1000 * 1000)
-	if err != nil {
+	err = client.Run(ctx)
+	if err != nil && ctx.Err() == nil {
 		log.Printf("Event loop error: %v", err)
 	}
 
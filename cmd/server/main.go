@@ -1,16 +1,22 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"libvnc-go/pkg/vnc"
 	"log"
 	"math"
 	"net"
+	"os"
+	"os/signal"
 	"time"
 	"unsafe"
 )
 
 func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
 	server := vnc.NewServer(800, 600, 8, 3, 4)
 	if server == nil {
 		log.Fatal("Failed to create VNC server")
@@ -82,8 +88,8 @@ func main() {
 
 	fmt.Println("Server is running. Press Ctrl+C to stop.")
 
-	for server.IsActive() {
-		server.ProcessEvents(100)
+	if err := server.Serve(ctx); err != nil && ctx.Err() == nil {
+		log.Printf("Server error: %v", err)
 	}
 
 	fmt.Println("VNC server stopped")
@@ -1,3 +1,9 @@
 module libvnc-go
 
 go 1.22.2
+
+require (
+	golang.org/x/image v0.18.0
+	golang.org/x/net v0.35.0
+	gopkg.in/yaml.v3 v3.0.1
+)
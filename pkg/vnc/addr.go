@@ -0,0 +1,37 @@
+package vnc
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultListenPort is the port VNC viewers conventionally listen on for
+	// reverse connections.
+	DefaultListenPort = 5500
+)
+
+// splitHostPortDefault splits addr into host and port. A bare host, IPv6
+// address included (or an empty string), yields defaultPort.
+func splitHostPortDefault(addr string, defaultPort int) (string, int, error) {
+	if net.ParseIP(addr) != nil {
+		return addr, defaultPort, nil
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		if addrErr, ok := err.(*net.AddrError); ok && addrErr.Err == "missing port in address" {
+			return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]"), defaultPort, nil
+		}
+		return "", 0, err
+	}
+	if portStr == "" {
+		return host, defaultPort, nil
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return "", 0, fmt.Errorf("invalid port in address %q", addr)
+	}
+	return host, port, nil
+}
@@ -0,0 +1,37 @@
+package vnc
+
+import "testing"
+
+func TestSplitHostPortDefault(t *testing.T) {
+	tests := []struct {
+		addr    string
+		host    string
+		port    int
+		wantErr bool
+	}{
+		{addr: "", host: "", port: 5500},
+		{addr: "viewer.example", host: "viewer.example", port: 5500},
+		{addr: "viewer.example:5501", host: "viewer.example", port: 5501},
+		{addr: "viewer.example:", host: "viewer.example", port: 5500},
+		{addr: "10.0.0.1", host: "10.0.0.1", port: 5500},
+		{addr: "10.0.0.1:6000", host: "10.0.0.1", port: 6000},
+		{addr: "::1", host: "::1", port: 5500},
+		{addr: "fe80::1", host: "fe80::1", port: 5500},
+		{addr: "[::1]", host: "::1", port: 5500},
+		{addr: "[::1]:5901", host: "::1", port: 5901},
+		{addr: "viewer.example:99999", wantErr: true},
+		{addr: "viewer.example:port", wantErr: true},
+	}
+	for _, tt := range tests {
+		host, port, err := splitHostPortDefault(tt.addr, DefaultListenPort)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("splitHostPortDefault(%q) = %q, %d; want error", tt.addr, host, port)
+			}
+			continue
+		}
+		if err != nil || host != tt.host || port != tt.port {
+			t.Errorf("splitHostPortDefault(%q) = %q, %d, %v; want %q, %d", tt.addr, host, port, err, tt.host, tt.port)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package vnc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultAuditMaxBackups is how many rotated audit files are kept.
+const DefaultAuditMaxBackups = 5
+
+// DefaultAuditFlushInterval is how long viewer input is coalesced before it
+// is written to the audit log.
+const DefaultAuditFlushInterval = 5 * time.Second
+
+// KeystrokeMode decides how much of what viewers type ends up in the audit
+// log.
+type KeystrokeMode string
+
+const (
+	// KeystrokesText records typed text, with special keys and shortcuts
+	// as <Name> tokens.
+	KeystrokesText KeystrokeMode = "text"
+	// KeystrokesMasked records every key as "*", keeping only the rhythm.
+	KeystrokesMasked KeystrokeMode = "masked"
+	// KeystrokesCount only records how many keys were pressed.
+	KeystrokesCount KeystrokeMode = "count"
+)
+
+// AuditConfig configures an AuditLog.
+type AuditConfig struct {
+	// Path of the JSON Lines file; Writer, if set, is used instead and is
+	// never rotated.
+	Path   string    `json:"path,omitempty" yaml:"path,omitempty"`
+	Writer io.Writer `json:"-" yaml:"-"`
+	// MaxSize rotates the file once it exceeds that many bytes, keeping
+	// MaxBackups (default DefaultAuditMaxBackups) old files as Path.1,
+	// Path.2 and so on. 0 never rotates.
+	MaxSize    int64 `json:"maxSize,omitempty" yaml:"maxSize,omitempty"`
+	MaxBackups int   `json:"maxBackups,omitempty" yaml:"maxBackups,omitempty"`
+
+	// Keystrokes defaults to KeystrokesText.
+	Keystrokes KeystrokeMode `json:"keystrokes,omitempty" yaml:"keystrokes,omitempty"`
+	// ClipboardText records clipboard contents, not just their length.
+	ClipboardText bool `json:"clipboardText,omitempty" yaml:"clipboardText,omitempty"`
+	// FlushInterval is how long key and pointer activity is coalesced into
+	// one record (default DefaultAuditFlushInterval).
+	FlushInterval Duration `json:"flushInterval,omitempty" yaml:"flushInterval,omitempty"`
+}
+
+func (cfg AuditConfig) validate() error {
+	if cfg.Path == "" && cfg.Writer == nil {
+		return fmt.Errorf("audit log needs a path or writer")
+	}
+	if cfg.MaxSize < 0 || cfg.MaxBackups < 0 {
+		return fmt.Errorf("audit log rotation settings cannot be negative")
+	}
+	switch cfg.Keystrokes {
+	case "", KeystrokesText, KeystrokesMasked, KeystrokesCount:
+		return nil
+	default:
+		return fmt.Errorf("unknown keystroke mode %q", cfg.Keystrokes)
+	}
+}
+
+// AuditEvent is one line of the audit log. Type is "connect", "refused",
+// "authFailed", "disconnect", "kick", "role", "control", "clipboard",
+// "blocked" or "input"; only the fields relevant to it are set.
+type AuditEvent struct {
+	Time   time.Time `json:"time"`
+	Type   string    `json:"type"`
+	Target string    `json:"target,omitempty"`
+
+	Viewer     string     `json:"viewer,omitempty"`
+	Address    string     `json:"address,omitempty"`
+	Role       ViewerRole `json:"role,omitempty"`
+	Credential string     `json:"credential,omitempty"`
+	// DurationSeconds is how long a disconnecting viewer was connected.
+	DurationSeconds float64 `json:"durationSeconds,omitempty"`
+	Reason          string  `json:"reason,omitempty"`
+
+	// control changes
+	Previous   string `json:"previous,omitempty"`
+	Controller string `json:"controller,omitempty"`
+
+	// clipboard transfers; Direction is "toTarget" or "toViewers" and
+	// Length counts characters
+	Direction string `json:"direction,omitempty"`
+	Length    int    `json:"length,omitempty"`
+	Text      string `json:"text,omitempty"`
+
+	// coalesced input activity
+	Keys     string `json:"keys,omitempty"`
+	KeyCount int    `json:"keyCount,omitempty"`
+	Clicks   int    `json:"clicks,omitempty"`
+	Moves    int    `json:"moves,omitempty"`
+	Masked   bool   `json:"masked,omitempty"`
+}
+
+// AuditLog writes AuditEvents as JSON Lines. It is safe for concurrent use.
+type AuditLog struct {
+	cfg AuditConfig
+
+	mu   sync.Mutex
+	w    io.Writer
+	file *os.File
+	size int64
+}
+
+// NewAuditLog opens the audit log described by cfg, appending to an
+// existing file.
+func NewAuditLog(cfg AuditConfig) (*AuditLog, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.MaxBackups == 0 {
+		cfg.MaxBackups = DefaultAuditMaxBackups
+	}
+	if cfg.Keystrokes == "" {
+		cfg.Keystrokes = KeystrokesText
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = Duration(DefaultAuditFlushInterval)
+	}
+
+	l := &AuditLog{cfg: cfg, w: cfg.Writer}
+	if l.w == nil {
+		if err := l.open(); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (l *AuditLog) open() error {
+	f, err := os.OpenFile(l.cfg.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	l.file, l.w, l.size = f, f, info.Size()
+	return nil
+}
+
+// Write appends event to the log, setting its time if unset.
+func (l *AuditLog) Write(event AuditEvent) error {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.w == nil {
+		return os.ErrClosed
+	}
+	var rotateErr error
+	if l.file != nil && l.cfg.MaxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.cfg.MaxSize {
+		if rotateErr = l.rotate(); rotateErr != nil {
+			// keep appending to the current file and try again once it
+			// has grown by another MaxSize
+			l.size = 0
+		}
+	}
+	n, err := l.w.Write(line)
+	l.size += int64(n)
+	if err == nil {
+		err = rotateErr
+	}
+	return err
+}
+
+// rotate shifts Path.n to Path.n+1, dropping the oldest, and starts a new
+// file. The current file stays open until the new one is.
+func (l *AuditLog) rotate() error {
+	for i := l.cfg.MaxBackups; i > 0; i-- {
+		from := l.cfg.Path
+		if i > 1 {
+			from = fmt.Sprintf("%s.%d", l.cfg.Path, i-1)
+		}
+		if err := os.Rename(from, fmt.Sprintf("%s.%d", l.cfg.Path, i)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rotate audit log: %w", err)
+		}
+	}
+
+	previous := l.file
+	if err := l.open(); err != nil {
+		return err
+	}
+	previous.Close()
+	return nil
+}
+
+// Close closes the file. Writers passed in the config are left open.
+func (l *AuditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.w = nil
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,216 @@
+package vnc
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readAuditEvents(t *testing.T, path string) []AuditEvent {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var events []AuditEvent
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var event AuditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("%s: invalid line %q: %v", filepath.Base(path), scanner.Text(), err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestAuditLogWrite(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := NewAuditLog(AuditConfig{Writer: &buf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	l.Write(AuditEvent{Time: at, Type: "connect", Viewer: "viewer-1", Role: RoleFull})
+	l.Write(AuditEvent{Type: "clipboard", Direction: "toTarget", Length: 5})
+	l.Close()
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("wrote %d lines, want 2: %q", len(lines), buf.String())
+	}
+	if want := `{"time":"2026-10-18T12:00:00Z","type":"connect","viewer":"viewer-1","role":"full"}`; lines[0] != want {
+		t.Errorf("line 1 = %s, want %s", lines[0], want)
+	}
+	var event AuditEvent
+	if err := json.Unmarshal([]byte(lines[1]), &event); err != nil || event.Time.IsZero() {
+		t.Errorf("line 2 = %s, want a timestamp", lines[1])
+	}
+	if err := l.Write(AuditEvent{Type: "kick"}); err != os.ErrClosed {
+		t.Errorf("Write after Close = %v, want os.ErrClosed", err)
+	}
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	event := AuditEvent{Time: time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC), Type: "connect", Viewer: "viewer-1"}
+	line, _ := json.Marshal(event)
+
+	// room for two lines per file
+	l, err := NewAuditLog(AuditConfig{Path: path, MaxSize: int64(2*len(line) + 2), MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		event.Viewer = fmt.Sprintf("viewer-%d", i)
+		if err := l.Write(event); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+	l.Close()
+
+	tests := []struct {
+		file    string
+		viewers []string
+	}{
+		{file: "audit.jsonl", viewers: []string{"viewer-6"}},
+		{file: "audit.jsonl.1", viewers: []string{"viewer-4", "viewer-5"}},
+		{file: "audit.jsonl.2", viewers: []string{"viewer-2", "viewer-3"}},
+	}
+	for _, tt := range tests {
+		events := readAuditEvents(t, filepath.Join(filepath.Dir(path), tt.file))
+		var viewers []string
+		for _, event := range events {
+			viewers = append(viewers, event.Viewer)
+		}
+		if strings.Join(viewers, ",") != strings.Join(tt.viewers, ",") {
+			t.Errorf("%s holds %v, want %v", tt.file, viewers, tt.viewers)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("backup beyond MaxBackups kept: %v", err)
+	}
+}
+
+func TestAuditLogRotationFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	// a non-empty directory in the way of the backup
+	if err := os.MkdirAll(filepath.Join(path+".1", "keep"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := NewAuditLog(AuditConfig{Path: path, MaxSize: 10, MaxBackups: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := l.Write(AuditEvent{Type: "connect"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Write(AuditEvent{Type: "kick"}); err == nil {
+		t.Error("Write succeeded though the log could not be rotated")
+	}
+	if err := l.Write(AuditEvent{Type: "disconnect"}); err == nil {
+		t.Error("Write did not retry the rotation")
+	}
+
+	if events := readAuditEvents(t, path); len(events) != 3 {
+		t.Errorf("log holds %d events after failed rotations, want 3", len(events))
+	}
+}
+
+func TestMultiplexerAuditsClipboardLength(t *testing.T) {
+	var buf syncBuffer
+	_, ports, srv := runFakeMultiplexer(t, MultiplexerConfig{Audit: &AuditConfig{Writer: &buf}})
+	viewer := srv.connect("10.0.0.1:5000")
+	srv.sendCutText(viewer, "Grüße")
+
+	if sent := ports.client().sentCutText(); len(sent) != 1 || sent[0] != "Grüße" {
+		t.Fatalf("clipboard sent to the target = %q", sent)
+	}
+	var clipboard []AuditEvent
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var event AuditEvent
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("invalid audit line %q: %v", line, err)
+		}
+		if event.Type == "clipboard" {
+			clipboard = append(clipboard, event)
+		}
+	}
+	if len(clipboard) != 1 || clipboard[0].Length != 5 || clipboard[0].Text != "" {
+		t.Errorf("clipboard audit events = %+v, want one of 5 characters without text", clipboard)
+	}
+}
+
+func TestAuditLogAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	for i := 0; i < 2; i++ {
+		l, err := NewAuditLog(AuditConfig{Path: path})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Write(AuditEvent{Type: "connect"})
+		l.Close()
+	}
+	if events := readAuditEvents(t, path); len(events) != 2 {
+		t.Errorf("reopened log holds %d events, want 2", len(events))
+	}
+}
+
+func TestAuditConfigValidate(t *testing.T) {
+	tests := []struct {
+		cfg     AuditConfig
+		wantErr bool
+	}{
+		{cfg: AuditConfig{Path: "audit.jsonl", Keystrokes: KeystrokesMasked}},
+		{cfg: AuditConfig{}, wantErr: true},
+		{cfg: AuditConfig{Path: "audit.jsonl", MaxSize: -1}, wantErr: true},
+		{cfg: AuditConfig{Path: "audit.jsonl", Keystrokes: "all"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := tt.cfg.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("validate(%+v) = %v, want error %v", tt.cfg, err, tt.wantErr)
+		}
+	}
+}
+
+func TestAuditKeyText(t *testing.T) {
+	const (
+		ctrlL  = 0xffe3
+		altR   = 0xffea
+		shiftL = 0xffe1
+		superL = 0xffeb
+	)
+	tests := []struct {
+		key  uint32
+		held []uint32
+		want string
+	}{
+		{key: 'a', want: "a"},
+		{key: 'A', held: []uint32{shiftL}, want: "A"},
+		{key: ' ', want: " "},
+		{key: 0xe9, want: "é"},
+		{key: 0xff0d, want: "<Return>"},
+		{key: 0xffbe, want: "<F1>"},
+		{key: 'c', held: []uint32{ctrlL}, want: "<Ctrl+c>"},
+		{key: 0xffff, held: []uint32{ctrlL, altR}, want: "<Ctrl+Alt+Delete>"},
+		{key: 'l', held: []uint32{superL}, want: "<Super+l>"},
+		{key: 0x1234, want: "<0x1234>"},
+	}
+	for _, tt := range tests {
+		held := make(map[uint32]bool)
+		for _, key := range tt.held {
+			held[key] = true
+		}
+		if got := auditKeyText(tt.key, held); got != tt.want {
+			t.Errorf("auditKeyText(0x%x, %v) = %q, want %q", tt.key, tt.held, got, tt.want)
+		}
+	}
+}
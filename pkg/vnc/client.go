@@ -9,6 +9,7 @@ package vnc
 
 extern void goGotFrameBufferUpdateCallback(rfbClient* cl, int x, int y, int w, int h);
 extern void goFinishedFrameBufferUpdateCallback(rfbClient* cl);
+extern void goGotXCutTextCallback(rfbClient* cl, char* text, int textlen);
 
 static inline void setGotFrameBufferUpdateCallback(rfbClient* cl) {
     cl->GotFrameBufferUpdate = goGotFrameBufferUpdateCallback;
@@ -18,59 +19,45 @@ static inline void setFinishedFrameBufferUpdateCallback(rfbClient* cl) {
     cl->FinishedFrameBufferUpdate = goFinishedFrameBufferUpdateCallback;
 }
 
-static char* stored_password = NULL;
+static inline void setGotXCutTextCallback(rfbClient* cl) {
+    cl->GotXCutText = (GotXCutTextProc)goGotXCutTextCallback;
+}
+
+extern char* goGetPasswordCallback(rfbClient* cl);
+
+static inline void setGetPasswordCallback(rfbClient* cl) {
+    cl->GetPassword = goGetPasswordCallback;
+}
 
-static char* passwordCallback(rfbClient* cl) {
-    return stored_password;
+static inline rfbBool initClientWithSocket(rfbClient* cl, int sock) {
+    cl->sock = sock;
+    cl->listenSpecified = TRUE;
+    return rfbInitClient(cl, NULL, NULL);
 }
 
-static inline void setPassword(rfbClient* cl, char* password) {
-    if (stored_password != NULL) {
-        free(stored_password);
-    }
-    stored_password = strdup(password);
-    cl->GetPassword = passwordCallback;
+static inline void setListenAddress(rfbClient* cl, char* address, int port) {
+    cl->listenSpecified = TRUE;
+    cl->listenPort = port;
+    cl->listen6Port = port;
+    cl->listenAddress = address;
 }
 */
 import "C"
 import (
+	"context"
 	"fmt"
 	"net"
+	"strconv"
 	"sync"
+	"time"
 	"unsafe"
 )
 
-type PixelFormat struct {
-	BitsPerPixel int
-	Depth        int
-	BigEndian    bool
-	TrueColour   bool
-	RedMax       int
-	GreenMax     int
-	BlueMax      int
-	RedShift     int
-	GreenShift   int
-	BlueShift    int
-}
-
-type AppDataConfig struct {
-	CompressLevel   int
-	QualityLevel    int
-	Encodings       string
-	UseRemoteCursor bool
-}
-
-var (
-	PixelFormatStandard = PixelFormat{
-		BitsPerPixel: 32, Depth: 24, BigEndian: false, TrueColour: true,
-		RedMax: 255, GreenMax: 255, BlueMax: 255,
-		RedShift: 0, GreenShift: 8, BlueShift: 16,
-	}
-)
-
 var (
 	clientHandlers         = make(map[*C.rfbClient]GotFrameBufferUpdateHandler)
 	clientFinishedHandlers = make(map[*C.rfbClient]FinishedFrameBufferUpdateHandler)
+	clientCutTextHandlers  = make(map[*C.rfbClient]GotCutTextHandler)
+	clientPasswords        = make(map[*C.rfbClient]string)
 	clientMutex            sync.RWMutex
 )
 
@@ -96,8 +83,38 @@ func goFinishedFrameBufferUpdateCallback(cl *C.rfbClient) {
 	}
 }
 
+//export goGotXCutTextCallback
+func goGotXCutTextCallback(cl *C.rfbClient, text *C.char, textlen C.int) {
+	clientMutex.RLock()
+	handler, exists := clientCutTextHandlers[cl]
+	clientMutex.RUnlock()
+
+	if exists && handler != nil {
+		handler(latin1ToString(C.GoBytes(unsafe.Pointer(text), textlen)))
+	}
+}
+
+// goGetPasswordCallback hands libvncclient the password of this client.
+// libvncclient frees the returned string once it has used it.
+//
+//export goGetPasswordCallback
+func goGetPasswordCallback(cl *C.rfbClient) *C.char {
+	clientMutex.RLock()
+	password := clientPasswords[cl]
+	clientMutex.RUnlock()
+
+	return C.CString(password)
+}
+
+// runPollIntervalMs bounds how long Run waits for a server message before
+// checking its context again.
+const runPollIntervalMs = 100
+
 type Client struct {
 	rfbClient                        *C.rfbClient
+	host                             string
+	port                             int
+	keepAlive                        time.Duration
 	gotFrameBufferUpdateHandler      GotFrameBufferUpdateHandler
 	finishedFrameBufferUpdateHandler FinishedFrameBufferUpdateHandler
 }
@@ -165,6 +182,16 @@ func (c *Client) SetGotFrameBufferUpdateHandler(handler GotFrameBufferUpdateHand
 	C.setGotFrameBufferUpdateCallback(c.rfbClient)
 }
 
+// SetGotCutTextHandler sets a handler called with clipboard text the
+// server sends.
+func (c *Client) SetGotCutTextHandler(handler GotCutTextHandler) {
+	clientMutex.Lock()
+	clientCutTextHandlers[c.rfbClient] = handler
+	clientMutex.Unlock()
+
+	C.setGotXCutTextCallback(c.rfbClient)
+}
+
 func (c *Client) SetFinishedFrameBufferUpdateHandler(handler FinishedFrameBufferUpdateHandler) {
 	c.finishedFrameBufferUpdateHandler = handler
 
@@ -176,15 +203,21 @@ func (c *Client) SetFinishedFrameBufferUpdateHandler(handler FinishedFrameBuffer
 }
 
 func (c *Client) SetHost(host string) {
+	c.host = host
 	c.rfbClient.serverHost = C.CString(host)
 }
 
 func (c *Client) SetPort(port int) {
+	c.port = port
 	c.rfbClient.serverPort = C.int(port)
 }
 
 func (c *Client) SetPassword(password string) {
-	C.setPassword(c.rfbClient, C.CString(password))
+	clientMutex.Lock()
+	clientPasswords[c.rfbClient] = password
+	clientMutex.Unlock()
+
+	C.setGetPasswordCallback(c.rfbClient)
 }
 
 func (c *Client) SetPixelFormat(format PixelFormat) {
@@ -234,10 +267,145 @@ func (c *Client) SetCanHandleNewFBSize(canHandle bool) {
 }
 
 func (c *Client) Init() bool {
-	return C.rfbInitClient(c.rfbClient, nil, nil) != 0
+	if C.rfbInitClient(c.rfbClient, nil, nil) == 0 {
+		c.forgetClient()
+		return false
+	}
+	return true
+}
+
+// forgetClient drops the rfbClient after a failed rfbInitClient, which has
+// already freed it, so later calls do not touch freed memory.
+func (c *Client) forgetClient() {
+	clientMutex.Lock()
+	delete(clientHandlers, c.rfbClient)
+	delete(clientFinishedHandlers, c.rfbClient)
+	delete(clientCutTextHandlers, c.rfbClient)
+	delete(clientPasswords, c.rfbClient)
+	clientMutex.Unlock()
+
+	c.rfbClient = nil
+}
+
+// SetKeepAlive sets the TCP keepalive period of the target connection. Zero
+// keeps Go's default and a negative period disables keepalives.
+func (c *Client) SetKeepAlive(period time.Duration) {
+	c.keepAlive = period
+}
+
+// Connect dials the configured host and port and performs the RFB handshake.
+// Cancelling ctx aborts both the dial and a handshake in progress, in which
+// case ctx.Err() is returned.
+func (c *Client) Connect(ctx context.Context) error {
+	dialer := net.Dialer{KeepAlive: c.keepAlive}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(c.host, strconv.Itoa(c.port)))
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("%w: %v", ErrInitClient, err)
+	}
+	return c.ConnectWithConn(ctx, conn)
+}
+
+// ConnectWithConn performs the RFB handshake over an already established
+// connection, such as a target that dialed in, instead of connecting to the
+// configured host and port. conn is closed once its socket has been handed
+// over to libvncclient.
+func (c *Client) ConnectWithConn(ctx context.Context, conn net.Conn) error {
+	if tcpConn, ok := conn.(*net.TCPConn); ok && c.keepAlive != 0 {
+		tcpConn.SetKeepAlive(c.keepAlive > 0)
+		if c.keepAlive > 0 {
+			tcpConn.SetKeepAlivePeriod(c.keepAlive)
+		}
+	}
+	fd, err := dupConnFD(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	// Shutting down the shared socket makes libvncclient's blocking reads
+	// fail, which is the only way to interrupt rfbInitClient.
+	stop := context.AfterFunc(ctx, func() {
+		shutdownConn(conn)
+	})
+	ok := C.initClientWithSocket(c.rfbClient, C.int(fd)) != 0
+	interrupted := !stop()
+	conn.Close()
+	if !ok {
+		c.forgetClient()
+	}
+
+	if interrupted {
+		return ctx.Err()
+	}
+	if !ok {
+		return ErrInitClient
+	}
+	return nil
+}
+
+// Listen puts the client in listen mode: it waits on addr for a VNC server
+// to connect in (a reverse connection, see Server.ConnectToViewer) and then
+// performs the RFB handshake on that connection. A bare host listens on
+// DefaultListenPort. Listen blocks until a server connects, an error occurs
+// or ctx is cancelled.
+func (c *Client) Listen(ctx context.Context, addr string) error {
+	host, port, err := splitHostPortDefault(addr, DefaultListenPort)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrListen, err)
+	}
+
+	var cHost *C.char
+	if host != "" {
+		cHost = C.CString(host)
+		defer C.free(unsafe.Pointer(cHost))
+	}
+	C.setListenAddress(c.rfbClient, cHost, C.int(port))
+	// libvncclient only reads the address while opening the listening
+	// socket, so drop its pointer before cHost is freed
+	defer func() {
+		if c.rfbClient != nil {
+			c.rfbClient.listenAddress = nil
+		}
+	}()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		result := C.listenForIncomingConnectionsNoFork(c.rfbClient, C.int(100*1000))
+		if result < 0 {
+			return fmt.Errorf("%w on %s", ErrListen, addr)
+		}
+		if result > 0 && c.rfbClient.sock >= 0 {
+			break
+		}
+	}
+
+	if C.rfbInitClient(c.rfbClient, nil, nil) == 0 {
+		c.forgetClient()
+		return ErrInitClient
+	}
+	return nil
+}
+
+// ConnectViaRepeater connects to the VNC server through an UltraVNC repeater
+// and performs the RFB handshake. Retries apply to reaching the repeater;
+// once the handshake with the server has started a failure is final.
+func (c *Client) ConnectViaRepeater(ctx context.Context, cfg RepeaterConfig) error {
+	conn, err := dialRepeater(ctx, cfg, false)
+	if err != nil {
+		return err
+	}
+	return c.ConnectWithConn(ctx, conn)
 }
 
 func (c *Client) WaitForMessage(timeoutMs int) int {
+	if c.rfbClient == nil {
+		return -1
+	}
 	return int(C.WaitForMessage(c.rfbClient, C.uint(timeoutMs*1000)))
 }
 
@@ -264,6 +432,28 @@ func (c *Client) RunEventLoop(timeoutMs int) error {
 	}
 }
 
+// Run processes server messages until the connection fails or ctx is
+// cancelled, in which case ctx.Err() is returned.
+func (c *Client) Run(ctx context.Context) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		result := c.WaitForMessage(runPollIntervalMs)
+		if result < 0 {
+			return fmt.Errorf("connection lost or server disconnected (WaitForMessage returned %d)", result)
+		}
+
+		if result > 0 {
+			if !c.HandleRFBServerMessage() {
+				return fmt.Errorf("error handling server message - connection may have been lost")
+			}
+		}
+	}
+}
+
+// Deprecated: use Run.
 func (c *Client) RunEventLoopWithContext(done <-chan struct{}, timeoutMs int) error {
 	for {
 		select {
@@ -286,15 +476,21 @@ func (c *Client) RunEventLoopWithContext(done <-chan struct{}, timeoutMs int) er
 }
 
 func (c *Client) GetFrameBufferWidth() int {
+	if c.rfbClient == nil {
+		return 0
+	}
 	return int(c.rfbClient.width)
 }
 
 func (c *Client) GetFrameBufferHeight() int {
+	if c.rfbClient == nil {
+		return 0
+	}
 	return int(c.rfbClient.height)
 }
 
 func (c *Client) GetFrameBuffer() []byte {
-	if c.rfbClient.frameBuffer == nil {
+	if c.rfbClient == nil || c.rfbClient.frameBuffer == nil {
 		return nil
 	}
 	bufferSize := int(c.rfbClient.width) * int(c.rfbClient.height) * int(c.rfbClient.format.bitsPerPixel/8)
@@ -302,6 +498,9 @@ func (c *Client) GetFrameBuffer() []byte {
 }
 
 func (c *Client) SendFrameBufferUpdateRequest(x, y, w, h int, incremental bool) {
+	if c.rfbClient == nil {
+		return
+	}
 	var inc C.rfbBool
 	if incremental {
 		inc = 1
@@ -312,10 +511,16 @@ func (c *Client) SendFrameBufferUpdateRequest(x, y, w, h int, incremental bool)
 }
 
 func (c *Client) SendPointerEvent(x, y int, buttonMask uint8) {
+	if c.rfbClient == nil {
+		return
+	}
 	C.SendPointerEvent(c.rfbClient, C.int(x), C.int(y), C.int(buttonMask))
 }
 
 func (c *Client) SendKeyEvent(key uint32, down bool) {
+	if c.rfbClient == nil {
+		return
+	}
 	var d C.rfbBool
 	if down {
 		d = 1
@@ -325,6 +530,18 @@ func (c *Client) SendKeyEvent(key uint32, down bool) {
 	C.SendKeyEvent(c.rfbClient, C.uint(key), d)
 }
 
+// SendCutText sends clipboard text to the server. RFB clipboard text is
+// Latin-1, so characters outside it are sent as '?'.
+func (c *Client) SendCutText(text string) {
+	if c.rfbClient == nil || text == "" {
+		return
+	}
+	latin1 := stringToLatin1(text)
+	cText := (*C.char)(C.CBytes(latin1))
+	defer C.free(unsafe.Pointer(cText))
+	C.SendClientCutText(c.rfbClient, cText, C.int(len(latin1)))
+}
+
 func (c *Client) IsConnected() bool {
 	return c.rfbClient != nil && c.rfbClient.sock >= 0
 }
@@ -333,6 +550,8 @@ func (c *Client) Close() {
 	clientMutex.Lock()
 	delete(clientHandlers, c.rfbClient)
 	delete(clientFinishedHandlers, c.rfbClient)
+	delete(clientCutTextHandlers, c.rfbClient)
+	delete(clientPasswords, c.rfbClient)
 	clientMutex.Unlock()
 
 	if c.rfbClient != nil {
@@ -0,0 +1,125 @@
+package vnc
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// idPreambleSize is the length of the UltraVNC repeater style handshake
+// ("ID:xxxx" or "host:port", NUL padded) sent ahead of the RFB protocol.
+const idPreambleSize = 250
+
+// dupConnFD returns a duplicate of the socket descriptor behind conn so it can
+// be handed over to libvncserver/libvncclient, which take ownership of it.
+// The caller remains responsible for closing conn itself.
+func dupConnFD(conn net.Conn) (int, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return -1, fmt.Errorf("unsupported connection type: %T", conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return -1, fmt.Errorf("failed to get raw socket: %v", err)
+	}
+
+	fd := -1
+	var dupErr error
+	if err := raw.Control(func(s uintptr) {
+		fd, dupErr = syscall.Dup(int(s))
+	}); err != nil {
+		return -1, err
+	}
+	if dupErr != nil {
+		return -1, fmt.Errorf("failed to duplicate socket: %v", dupErr)
+	}
+	return fd, nil
+}
+
+// shutdownConn shuts the socket behind conn down in both directions. Unlike
+// Close this also affects descriptors duplicated with dupConnFD.
+func shutdownConn(conn net.Conn) {
+	type halfCloser interface {
+		CloseRead() error
+		CloseWrite() error
+	}
+	if hc, ok := conn.(halfCloser); ok {
+		hc.CloseRead()
+		hc.CloseWrite()
+	}
+}
+
+// peekConn fills buf with the first bytes waiting on conn without consuming
+// them. It honours the read deadline set on conn.
+func peekConn(conn net.Conn, buf []byte) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("unsupported connection type: %T", conn)
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return fmt.Errorf("failed to get raw socket: %v", err)
+	}
+
+	for {
+		var n int
+		var peekErr error
+		err := raw.Read(func(fd uintptr) bool {
+			n, _, peekErr = syscall.Recvfrom(int(fd), buf, syscall.MSG_PEEK)
+			return peekErr != syscall.EAGAIN
+		})
+		if err != nil {
+			return err
+		}
+		if peekErr != nil {
+			return peekErr
+		}
+		if n == 0 {
+			return io.EOF
+		}
+		if n >= len(buf) {
+			return nil
+		}
+		// Only part of the data has arrived; the socket stays readable so
+		// wait a little instead of spinning on the poller.
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// readIDPreamble reads an optional "ID:xxxx" preamble from a connection that
+// is about to speak RFB. It returns the ID, or "" when the peer went straight
+// to the RFB handshake, leaving that untouched.
+func readIDPreamble(conn net.Conn) (string, error) {
+	head := make([]byte, 3)
+	if err := peekConn(conn, head); err != nil {
+		return "", err
+	}
+	if string(head) != "ID:" {
+		return "", nil
+	}
+
+	preamble := make([]byte, idPreambleSize)
+	if _, err := io.ReadFull(conn, preamble); err != nil {
+		return "", err
+	}
+	if i := bytes.IndexByte(preamble, 0); i >= 0 {
+		preamble = preamble[:i]
+	}
+	return strings.TrimSpace(strings.TrimPrefix(string(preamble), "ID:")), nil
+}
+
+// writePreamble sends a NUL padded repeater style preamble such as
+// "ID:1234" or "host:5900".
+func writePreamble(conn net.Conn, preamble string) error {
+	if len(preamble) >= idPreambleSize {
+		return fmt.Errorf("preamble %q too long", preamble)
+	}
+	buf := make([]byte, idPreambleSize)
+	copy(buf, preamble)
+	_, err := conn.Write(buf)
+	return err
+}
@@ -0,0 +1,86 @@
+package vnc
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tcpPair returns the accepted server side of a loopback TCP connection and
+// its client side.
+func tcpPair(t *testing.T) (server, client net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err = l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return server, client
+}
+
+func TestWritePreamble(t *testing.T) {
+	server, client := tcpPair(t)
+
+	if err := writePreamble(client, "ID:1234"); err != nil {
+		t.Fatalf("writePreamble: %v", err)
+	}
+	buf := make([]byte, idPreambleSize)
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(server, buf); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if want := append([]byte("ID:1234"), make([]byte, idPreambleSize-7)...); !bytes.Equal(buf, want) {
+		t.Errorf("preamble is not NUL padded to %d bytes: %q", idPreambleSize, buf)
+	}
+
+	if err := writePreamble(client, strings.Repeat("x", idPreambleSize)); err == nil {
+		t.Error("writePreamble accepted a preamble that leaves no room for padding")
+	}
+}
+
+func TestReadIDPreamble(t *testing.T) {
+	t.Run("with ID", func(t *testing.T) {
+		server, client := tcpPair(t)
+		writePreamble(client, "ID: 1234 ")
+		io.WriteString(client, "RFB 003.008\n")
+
+		id, err := readIDPreamble(server)
+		if err != nil || id != "1234" {
+			t.Fatalf("readIDPreamble = %q, %v; want 1234", id, err)
+		}
+		rest := make([]byte, 12)
+		if _, err := io.ReadFull(server, rest); err != nil || string(rest) != "RFB 003.008\n" {
+			t.Errorf("after the preamble read %q, %v; want the RFB version", rest, err)
+		}
+	})
+
+	t.Run("without ID", func(t *testing.T) {
+		server, client := tcpPair(t)
+		io.WriteString(client, "RFB 003.008\n")
+
+		id, err := readIDPreamble(server)
+		if err != nil || id != "" {
+			t.Fatalf("readIDPreamble = %q, %v; want no ID", id, err)
+		}
+		rest := make([]byte, 12)
+		if _, err := io.ReadFull(server, rest); err != nil || string(rest) != "RFB 003.008\n" {
+			t.Errorf("the RFB version was consumed: read %q, %v", rest, err)
+		}
+	})
+}
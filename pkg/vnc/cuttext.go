@@ -0,0 +1,27 @@
+package vnc
+
+import "unicode/utf8"
+
+// RFB clipboard text is Latin-1; the API uses UTF-8 strings.
+
+// latin1ToString decodes Latin-1 clipboard text.
+func latin1ToString(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+// stringToLatin1 encodes text as Latin-1 for the wire, replacing characters
+// Latin-1 lacks with '?'.
+func stringToLatin1(text string) []byte {
+	b := make([]byte, 0, utf8.RuneCountInString(text))
+	for _, r := range text {
+		if r > 0xff {
+			r = '?'
+		}
+		b = append(b, byte(r))
+	}
+	return b
+}
@@ -0,0 +1,34 @@
+package vnc
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLatin1CutText(t *testing.T) {
+	tests := []struct {
+		text   string
+		latin1 []byte
+		back   string // decoded again, if not text
+	}{
+		{text: "", latin1: []byte{}},
+		{text: "plain ASCII", latin1: []byte("plain ASCII")},
+		{text: "café £5", latin1: []byte{'c', 'a', 'f', 0xe9, ' ', 0xa3, '5'}},
+		{text: "ÿ", latin1: []byte{0xff}},
+		{text: "€ and 日本", latin1: []byte("? and ??"), back: "? and ??"},
+		{text: "bad \xff byte", latin1: []byte("bad ? byte"), back: "bad ? byte"},
+	}
+	for _, tt := range tests {
+		got := stringToLatin1(tt.text)
+		if !bytes.Equal(got, tt.latin1) {
+			t.Errorf("stringToLatin1(%q) = %q, want %q", tt.text, got, tt.latin1)
+		}
+		want := tt.text
+		if tt.back != "" {
+			want = tt.back
+		}
+		if back := latin1ToString(got); back != want {
+			t.Errorf("latin1ToString(%q) = %q, want %q", got, back, want)
+		}
+	}
+}
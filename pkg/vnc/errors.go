@@ -3,6 +3,18 @@ package vnc
 import "errors"
 
 var (
-	ErrCreateClient = errors.New("failed to create VNC client")
-	ErrCreateServer = errors.New("failed to create VNC server")
+	ErrCreateClient         = errors.New("failed to create VNC client")
+	ErrCreateServer         = errors.New("failed to create VNC server")
+	ErrInitClient           = errors.New("failed to initialize VNC client connection")
+	ErrMultiplexerClosed    = errors.New("multiplexer closed")
+	ErrListen               = errors.New("failed to listen for incoming VNC server")
+	ErrReverseConnection    = errors.New("failed to establish reverse connection")
+	ErrTargetListenerClosed = errors.New("target listener closed")
+	ErrInvalidConfig        = errors.New("invalid configuration")
+	ErrReconnectGaveUp      = errors.New("gave up reconnecting to target")
+	ErrTargetDisconnected   = errors.New("target disconnected")
+	ErrFailBack             = errors.New("failing back to primary target")
+	ErrNoViewers            = errors.New("no viewers connected")
+	ErrTargetSwitched       = errors.New("target switched")
+	ErrTargetStalled        = errors.New("target stopped responding")
 )
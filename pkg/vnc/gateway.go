@@ -0,0 +1,703 @@
+package vnc
+
+import (
+	"bytes"
+	"context"
+	"crypto/des"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// GatewaySelector chooses how plain RFB viewers pick their target on a
+// Gateway. WebSocket viewers are always routed by URL path.
+type GatewaySelector int
+
+const (
+	// SelectByPassword routes a viewer to the target whose route password
+	// it authenticates with.
+	SelectByPassword GatewaySelector = iota
+	// SelectByID routes a viewer by the ID it sends after the gateway's
+	// UltraVNC repeater banner, as repeater-aware viewers do.
+	SelectByID
+)
+
+// GatewayRoute describes one target reachable through a Gateway and how
+// viewers select it. Routes are matched on whichever selectors are set.
+type GatewayRoute struct {
+	Name string
+
+	TargetHost     string
+	TargetPort     int
+	TargetPassword string
+
+	// Password selects the route for SelectByPassword viewers; it is also
+	// the password every viewer of the route authenticates with, whichever
+	// way it selected the route.
+	Password string
+	// ID selects the route for SelectByID viewers ("ID:" prefix optional).
+	ID string
+	// Path selects the route for WebSocket viewers, e.g. "/desk-12". The
+	// WebSocket handshake itself is left to libvncserver, which must be
+	// built with WebSocket support.
+	Path string
+	// AllowUnauthenticated lets a route without a password be selected by
+	// ID or path. Anyone who knows the ID or path then gets the target.
+	AllowUnauthenticated bool
+}
+
+type gatewayRoute struct {
+	GatewayRoute
+
+	mu  sync.Mutex
+	mux *Multiplexer
+}
+
+// Gateway serves many targets behind a single listening port. Each viewer is
+// routed to a target by its password, repeater ID or WebSocket path. Route
+// multiplexers run on demand: a target is connected when its first viewer
+// arrives and disconnected once its viewers have been gone for
+// DefaultOnDemandGrace.
+type Gateway struct {
+	listener net.Listener
+	selector GatewaySelector
+	routes   []*gatewayRoute
+	// webSockets is set when a route has a path, so viewers may open with
+	// a WebSocket upgrade request
+	webSockets bool
+
+	clientFactory ClientFactory
+	serverFactory ServerFactory
+	logger        *log.Logger
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewGateway(listenAddr string, selector GatewaySelector, routes []GatewayRoute) (*Gateway, error) {
+	return NewGatewayWithFactories(listenAddr, selector, routes, defaultClientFactory, defaultServerFactory)
+}
+
+func NewGatewayWithFactories(listenAddr string, selector GatewaySelector, routes []GatewayRoute, clientFactory ClientFactory, serverFactory ServerFactory) (*Gateway, error) {
+	if len(routes) == 0 {
+		return nil, fmt.Errorf("gateway needs at least one route")
+	}
+
+	g := &Gateway{
+		selector:      selector,
+		clientFactory: clientFactory,
+		serverFactory: serverFactory,
+		logger:        log.Default(),
+		closed:        make(chan struct{}),
+	}
+
+	seen := make(map[string]bool)
+	for i, route := range routes {
+		route.ID = strings.TrimPrefix(route.ID, "ID:")
+		if route.Path != "" && !strings.HasPrefix(route.Path, "/") {
+			route.Path = "/" + route.Path
+		}
+		if route.Name == "" {
+			route.Name = fmt.Sprintf("%s:%d", route.TargetHost, route.TargetPort)
+		}
+		if route.Password == "" && route.ID == "" && route.Path == "" {
+			return nil, fmt.Errorf("gateway route %d (%s) has no password, ID or path", i, route.Name)
+		}
+		if route.Password == "" && !route.AllowUnauthenticated {
+			return nil, fmt.Errorf("gateway route %d (%s) has no password; set AllowUnauthenticated to serve it without one", i, route.Name)
+		}
+		// VNC authentication only uses the first 8 bytes of a password, so
+		// passwords that share them select the same route
+		password := route.Password
+		if len(password) > 8 {
+			password = password[:8]
+		}
+		for _, key := range []string{"password:" + password, "id:" + route.ID, "path:" + route.Path} {
+			if strings.HasSuffix(key, ":") {
+				continue
+			}
+			if seen[key] {
+				return nil, fmt.Errorf("gateway route %d (%s) reuses a selector of another route", i, route.Name)
+			}
+			seen[key] = true
+		}
+		g.routes = append(g.routes, &gatewayRoute{GatewayRoute: route})
+		g.webSockets = g.webSockets || route.Path != ""
+	}
+
+	listener, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return nil, err
+	}
+	g.listener = listener
+	return g, nil
+}
+
+func (g *Gateway) Addr() net.Addr {
+	return g.listener.Addr()
+}
+
+// SetLogger sets where the gateway and the route multiplexers it starts
+// log; nil restores log.Default(). It must be called before Run.
+func (g *Gateway) SetLogger(logger *log.Logger) {
+	if logger == nil {
+		logger = log.Default()
+	}
+	g.logger = logger
+}
+
+// Run accepts viewers until the gateway is closed or ctx is cancelled. The
+// route multiplexers it starts run until ctx is cancelled as well.
+func (g *Gateway) Run(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() {
+		g.listener.Close()
+	})
+	defer stop()
+
+	g.logger.Printf("Gateway listening on %s with %d routes.", g.listener.Addr(), len(g.routes))
+	for {
+		conn, err := g.listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			select {
+			case <-g.closed:
+				return nil
+			default:
+			}
+			g.logger.Printf("Gateway accept error: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go g.handleViewer(ctx, conn)
+	}
+}
+
+// Multiplexer returns the multiplexer of the named route, or nil if no viewer
+// has selected it yet.
+func (g *Gateway) Multiplexer(name string) *Multiplexer {
+	for _, route := range g.routes {
+		if route.Name == name {
+			route.mu.Lock()
+			defer route.mu.Unlock()
+			return route.mux
+		}
+	}
+	return nil
+}
+
+func (g *Gateway) Close() {
+	g.closeOnce.Do(func() {
+		close(g.closed)
+		g.listener.Close()
+
+		for _, route := range g.routes {
+			route.mu.Lock()
+			if route.mux != nil {
+				route.mux.Close()
+				route.mux = nil
+			}
+			route.mu.Unlock()
+		}
+	})
+}
+
+func (g *Gateway) handleViewer(ctx context.Context, conn net.Conn) {
+	remote := conn.RemoteAddr()
+
+	// only gateways with WebSocket routes need to look for an upgrade
+	// request; plain viewers are greeted right away otherwise
+	if g.webSockets {
+		if path, ok := peekWebSocketPath(conn); ok {
+			route := g.findRoute(func(r *gatewayRoute) bool { return r.Path != "" && r.Path == path })
+			if route == nil {
+				g.logger.Printf("Gateway: no route for WebSocket path %q from %s", path, remote)
+				conn.Close()
+				return
+			}
+			g.attach(ctx, route, conn, remote)
+			return
+		}
+	}
+
+	switch g.selector {
+	case SelectByID:
+		id, err := readViewerID(conn)
+		if err != nil {
+			g.logger.Printf("Gateway: repeater handshake with %s failed: %v", remote, err)
+			conn.Close()
+			return
+		}
+		route := g.findRoute(func(r *gatewayRoute) bool { return r.ID != "" && r.ID == id })
+		if route == nil {
+			g.logger.Printf("Gateway: no route for ID %q from %s", id, remote)
+			conn.Close()
+			return
+		}
+		g.attach(ctx, route, conn, remote)
+
+	default:
+		g.handlePasswordViewer(ctx, conn, remote)
+	}
+}
+
+func (g *Gateway) findRoute(match func(*gatewayRoute) bool) *gatewayRoute {
+	for _, route := range g.routes {
+		if match(route) {
+			return route
+		}
+	}
+	return nil
+}
+
+func (g *Gateway) attach(ctx context.Context, route *gatewayRoute, conn net.Conn, remote net.Addr) {
+	mux, err := g.multiplexer(ctx, route)
+	if err != nil {
+		g.logger.Printf("Gateway: target %s unavailable for %s: %v", route.Name, remote, err)
+		conn.Close()
+		return
+	}
+	if err := mux.AttachViewer(conn); err != nil {
+		g.logger.Printf("Gateway: failed to attach %s to %s: %v", remote, route.Name, err)
+		return
+	}
+	g.logger.Printf("Gateway: viewer %s routed to %s.", remote, route.Name)
+}
+
+// multiplexer returns the route's multiplexer, creating it on first use.
+// It runs on demand, so the target connection only stays up while viewers
+// are connected, plus the on-demand grace period.
+func (g *Gateway) multiplexer(ctx context.Context, route *gatewayRoute) (*Multiplexer, error) {
+	route.mu.Lock()
+	defer route.mu.Unlock()
+
+	select {
+	case <-g.closed:
+		return nil, fmt.Errorf("gateway closed")
+	default:
+	}
+
+	if route.mux != nil {
+		return route.mux, nil
+	}
+
+	g.logger.Printf("Gateway: starting multiplexer for target %s.", route.Name)
+	cfg := MultiplexerConfig{
+		TargetHost:     route.TargetHost,
+		TargetPort:     route.TargetPort,
+		TargetPassword: route.TargetPassword,
+		OnDemand:       true,
+		ClientFactory:  g.clientFactory,
+		ServerFactory:  g.serverFactory,
+		Logger:         g.logger,
+	}
+	// ID and WebSocket viewers are handed to the proxy server as they are,
+	// so it has to authenticate them itself
+	if route.Password != "" {
+		cfg.Credentials = []ViewerCredential{{Name: route.Name, Password: route.Password}}
+	}
+	mux, err := NewMultiplexerFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		err := mux.Run(ctx)
+		if err != nil && ctx.Err() == nil {
+			g.logger.Printf("Gateway: multiplexer for target %s stopped: %v", route.Name, err)
+		}
+
+		// the next viewer of the route starts a new multiplexer
+		route.mu.Lock()
+		if route.mux == mux {
+			route.mux = nil
+		}
+		route.mu.Unlock()
+		mux.Close()
+	}()
+
+	route.mux = mux
+	return mux, nil
+}
+
+// handlePasswordViewer authenticates the viewer against every route's
+// password and, on a match, bridges it to the route's proxy server. The
+// gateway completes the security handshake on both sides, answering the
+// proxy server's challenge with the route password, and then copies bytes
+// verbatim.
+func (g *Gateway) handlePasswordViewer(ctx context.Context, conn net.Conn, remote net.Addr) {
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	minor, route, err := g.authenticateViewer(conn)
+	if err != nil {
+		g.logger.Printf("Gateway: authentication of %s failed: %v", remote, err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	mux, err := g.multiplexer(ctx, route)
+	if err != nil {
+		g.logger.Printf("Gateway: target %s unavailable for %s: %v", route.Name, remote, err)
+		writeSecurityFailure(conn, minor, "target unavailable")
+		conn.Close()
+		return
+	}
+
+	local, proxied, err := connPair()
+	if err != nil {
+		g.logger.Printf("Gateway: %v", err)
+		conn.Close()
+		return
+	}
+	if err := mux.AttachViewer(proxied); err != nil {
+		g.logger.Printf("Gateway: failed to attach %s to %s: %v", remote, route.Name, err)
+		local.Close()
+		conn.Close()
+		return
+	}
+
+	local.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := proxyServerHandshake(local, minor, route.Password); err != nil {
+		g.logger.Printf("Gateway: handshake with proxy server %s failed: %v", route.Name, err)
+		writeSecurityFailure(conn, minor, "target unavailable")
+		local.Close()
+		conn.Close()
+		return
+	}
+	local.SetDeadline(time.Time{})
+
+	// SecurityResult OK on behalf of the proxy server.
+	if err := binary.Write(conn, binary.BigEndian, uint32(0)); err != nil {
+		local.Close()
+		conn.Close()
+		return
+	}
+
+	g.logger.Printf("Gateway: viewer %s routed to %s.", remote, route.Name)
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+	splice(conn, local)
+}
+
+// authenticateViewer runs the server side of the RFB version and VNC
+// authentication handshake, stopping short of the SecurityResult. It returns
+// the negotiated minor protocol version and the route whose password matched.
+func (g *Gateway) authenticateViewer(conn net.Conn) (int, *gatewayRoute, error) {
+	if _, err := io.WriteString(conn, "RFB 003.008\n"); err != nil {
+		return 0, nil, err
+	}
+	minor, err := readProtocolVersion(conn)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if minor >= 7 {
+		if _, err := conn.Write([]byte{1, rfbSecTypeVncAuth}); err != nil {
+			return 0, nil, err
+		}
+		chosen := make([]byte, 1)
+		if _, err := io.ReadFull(conn, chosen); err != nil {
+			return 0, nil, err
+		}
+		if chosen[0] != rfbSecTypeVncAuth {
+			return 0, nil, fmt.Errorf("unsupported security type %d", chosen[0])
+		}
+	} else if err := binary.Write(conn, binary.BigEndian, uint32(rfbSecTypeVncAuth)); err != nil {
+		return 0, nil, err
+	}
+
+	challenge := make([]byte, 16)
+	if _, err := rand.Read(challenge); err != nil {
+		return 0, nil, err
+	}
+	if _, err := conn.Write(challenge); err != nil {
+		return 0, nil, err
+	}
+	response := make([]byte, 16)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return 0, nil, err
+	}
+
+	for _, route := range g.routes {
+		if route.Password == "" {
+			continue
+		}
+		expected, err := vncAuthResponse(challenge, route.Password)
+		if err != nil {
+			return 0, nil, err
+		}
+		if subtle.ConstantTimeCompare(expected, response) == 1 {
+			return minor, route, nil
+		}
+	}
+
+	writeSecurityFailure(conn, minor, "authentication failed")
+	return 0, nil, fmt.Errorf("password matches no route")
+}
+
+const (
+	rfbSecTypeNone    = 1
+	rfbSecTypeVncAuth = 2
+)
+
+// readProtocolVersion reads the peer's "RFB xxx.yyy\n" and maps it to one of
+// the minor versions 3, 7 or 8 as the RFB specification asks.
+func readProtocolVersion(conn net.Conn) (int, error) {
+	version := make([]byte, 12)
+	if _, err := io.ReadFull(conn, version); err != nil {
+		return 0, err
+	}
+	var major, minor int
+	if _, err := fmt.Sscanf(string(version), "RFB %03d.%03d\n", &major, &minor); err != nil {
+		return 0, fmt.Errorf("invalid protocol version %q", version)
+	}
+	switch {
+	case major > 3 || minor >= 8:
+		return 8, nil
+	case minor == 7:
+		return 7, nil
+	default:
+		return 3, nil
+	}
+}
+
+// proxyServerHandshake runs the client side of the handshake against a
+// route's proxy server, using the version negotiated with the viewer. The
+// proxy server asks for a password when the route has one.
+func proxyServerHandshake(conn net.Conn, minor int, password string) error {
+	if _, err := readProtocolVersion(conn); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(conn, "RFB 003.%03d\n", minor); err != nil {
+		return err
+	}
+
+	var secType byte
+	if minor < 7 {
+		var offered uint32
+		if err := binary.Read(conn, binary.BigEndian, &offered); err != nil {
+			return err
+		}
+		if offered == 0 {
+			return fmt.Errorf("proxy server refused the connection")
+		}
+		secType = byte(offered)
+	} else {
+		count := make([]byte, 1)
+		if _, err := io.ReadFull(conn, count); err != nil {
+			return err
+		}
+		if count[0] == 0 {
+			return fmt.Errorf("proxy server refused the connection")
+		}
+		types := make([]byte, count[0])
+		if _, err := io.ReadFull(conn, types); err != nil {
+			return err
+		}
+		switch {
+		case password != "" && bytes.IndexByte(types, rfbSecTypeVncAuth) >= 0:
+			secType = rfbSecTypeVncAuth
+		case bytes.IndexByte(types, rfbSecTypeNone) >= 0:
+			secType = rfbSecTypeNone
+		default:
+			return fmt.Errorf("proxy server offers no usable security type")
+		}
+		if _, err := conn.Write([]byte{secType}); err != nil {
+			return err
+		}
+	}
+
+	switch secType {
+	case rfbSecTypeNone:
+		// RFB 3.3 and 3.7 send no SecurityResult for security type None
+		if minor < 8 {
+			return nil
+		}
+	case rfbSecTypeVncAuth:
+		if password == "" {
+			return fmt.Errorf("proxy server requested a password")
+		}
+		challenge := make([]byte, 16)
+		if _, err := io.ReadFull(conn, challenge); err != nil {
+			return err
+		}
+		response, err := vncAuthResponse(challenge, password)
+		if err != nil {
+			return err
+		}
+		if _, err := conn.Write(response); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("proxy server requested security type %d", secType)
+	}
+
+	var result uint32
+	if err := binary.Read(conn, binary.BigEndian, &result); err != nil {
+		return err
+	}
+	if result != 0 {
+		return fmt.Errorf("proxy server rejected the connection")
+	}
+	return nil
+}
+
+func writeSecurityFailure(conn net.Conn, minor int, reason string) {
+	binary.Write(conn, binary.BigEndian, uint32(1))
+	if minor >= 8 {
+		binary.Write(conn, binary.BigEndian, uint32(len(reason)))
+		io.WriteString(conn, reason)
+	}
+}
+
+// vncAuthResponse computes the VNC authentication response for challenge:
+// DES with the password (truncated/padded to 8 bytes, bits of each byte
+// mirrored) as key.
+func vncAuthResponse(challenge []byte, password string) ([]byte, error) {
+	key := make([]byte, 8)
+	copy(key, password)
+	for i, b := range key {
+		var mirrored byte
+		for bit := 0; bit < 8; bit++ {
+			if b&(1<<bit) != 0 {
+				mirrored |= 0x80 >> bit
+			}
+		}
+		key[i] = mirrored
+	}
+
+	block, err := des.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	response := make([]byte, len(challenge))
+	for i := 0; i+des.BlockSize <= len(challenge); i += des.BlockSize {
+		block.Encrypt(response[i:], challenge[i:])
+	}
+	return response, nil
+}
+
+// readViewerID greets a repeater-aware viewer with the UltraVNC repeater
+// banner and reads the "ID:xxxx" it answers with.
+func readViewerID(conn net.Conn) (string, error) {
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := io.WriteString(conn, "RFB 000.000\n"); err != nil {
+		return "", err
+	}
+	id, err := readIDPreamble(conn)
+	if err != nil {
+		return "", err
+	}
+	if id == "" {
+		return "", fmt.Errorf("viewer sent no repeater ID")
+	}
+	return id, nil
+}
+
+// peekWebSocketPath reports whether the viewer opened with an HTTP upgrade
+// request and returns the requested path, leaving the request unread for
+// libvncserver's WebSocket support. It decides on the first byte: plain RFB
+// viewers send nothing until the server greets them, which the short
+// timeout detects, and anything but the "G" of "GET" is not HTTP.
+func peekWebSocketPath(conn net.Conn) (string, bool) {
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	defer conn.SetReadDeadline(time.Time{})
+
+	first := make([]byte, 1)
+	if err := peekConn(conn, first); err != nil || first[0] != 'G' {
+		return "", false
+	}
+
+	// wait for the request line, however short the whole request is
+	buf := make([]byte, 4096)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		n := peekAvailable(conn, buf)
+		if i := bytes.Index(buf[:n], []byte("\r\n")); i >= 0 {
+			fields := strings.Fields(string(buf[:i]))
+			if len(fields) < 2 || fields[0] != "GET" {
+				return "", false
+			}
+			path, _, _ := strings.Cut(fields[1], "?")
+			return path, true
+		}
+		if n == len(buf) {
+			break
+		}
+	}
+	return "", false
+}
+
+// peekAvailable returns how many bytes of buf a non-blocking peek fills.
+func peekAvailable(conn net.Conn, buf []byte) int {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return 0
+	}
+	n := 0
+	raw.Control(func(fd uintptr) {
+		n, _, _ = syscall.Recvfrom(int(fd), buf, syscall.MSG_PEEK|syscall.MSG_DONTWAIT)
+	})
+	if n < 0 {
+		return 0
+	}
+	return n
+}
+
+// connPair returns the two ends of a connected socket pair.
+func connPair() (net.Conn, net.Conn, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create socket pair: %v", err)
+	}
+
+	conns := make([]net.Conn, 2)
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "vnc-gateway")
+		conn, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			if i == 1 {
+				conns[0].Close()
+			} else {
+				syscall.Close(fds[1])
+			}
+			return nil, nil, fmt.Errorf("failed to wrap socket pair: %v", err)
+		}
+		conns[i] = conn
+	}
+	return conns[0], conns[1], nil
+}
+
+// splice copies data between a and b until either side closes.
+func splice(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(a, b)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(b, a)
+		done <- struct{}{}
+	}()
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+}
@@ -0,0 +1,317 @@
+package vnc
+
+import (
+	"bytes"
+	"context"
+	"crypto/des"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"math/bits"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestVNCAuthResponse(t *testing.T) {
+	challenge := []byte("0123456789abcdef")
+
+	// reference: DES keyed with the password, each key byte bit-reversed
+	reference := func(password string) []byte {
+		key := make([]byte, 8)
+		copy(key, password)
+		for i := range key {
+			key[i] = bits.Reverse8(key[i])
+		}
+		block, err := des.NewCipher(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := make([]byte, 16)
+		block.Encrypt(out[:8], challenge[:8])
+		block.Encrypt(out[8:], challenge[8:])
+		return out
+	}
+
+	tests := []struct {
+		password string
+		same     string // a password that must give the same response
+	}{
+		{password: "secret"},
+		{password: ""},
+		{password: "password", same: "password-too-long"},
+	}
+	for _, tt := range tests {
+		got, err := vncAuthResponse(challenge, tt.password)
+		if err != nil {
+			t.Fatalf("vncAuthResponse(%q): %v", tt.password, err)
+		}
+		if want := reference(tt.password); !bytes.Equal(got, want) {
+			t.Errorf("vncAuthResponse(%q) = %x, want %x", tt.password, got, want)
+		}
+		if tt.same != "" {
+			other, _ := vncAuthResponse(challenge, tt.same)
+			if !bytes.Equal(got, other) {
+				t.Errorf("passwords are not truncated to 8 bytes: %q and %q differ", tt.password, tt.same)
+			}
+		}
+	}
+
+	a, _ := vncAuthResponse(challenge, "secret")
+	b, _ := vncAuthResponse(challenge, "Secret")
+	if bytes.Equal(a, b) {
+		t.Error("different passwords give the same response")
+	}
+}
+
+func TestReadProtocolVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		minor   int
+		wantErr bool
+	}{
+		{version: "RFB 003.003\n", minor: 3},
+		{version: "RFB 003.005\n", minor: 3},
+		{version: "RFB 003.007\n", minor: 7},
+		{version: "RFB 003.008\n", minor: 8},
+		{version: "RFB 003.889\n", minor: 8},
+		{version: "RFB 004.001\n", minor: 8},
+		{version: "HTTP/1.1 200", wantErr: true},
+	}
+	for _, tt := range tests {
+		client, server := net.Pipe()
+		go func() {
+			io.WriteString(client, tt.version)
+			client.Close()
+		}()
+		minor, err := readProtocolVersion(server)
+		server.Close()
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("readProtocolVersion(%q) = %d, want error", tt.version, minor)
+			}
+			continue
+		}
+		if err != nil || minor != tt.minor {
+			t.Errorf("readProtocolVersion(%q) = %d, %v; want %d", tt.version, minor, err, tt.minor)
+		}
+	}
+}
+
+func TestPeekWebSocketPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		opening string
+		path    string
+		ok      bool
+	}{
+		{name: "upgrade", opening: "GET /desk-12?token=x HTTP/1.1\r\nHost: gw\r\nUpgrade: websocket\r\n\r\n", path: "/desk-12", ok: true},
+		{name: "short request", opening: "GET / HTTP/1.1\r\n\r\n", path: "/", ok: true},
+		{name: "other method", opening: "GIVE / HTTP/1.1\r\n\r\n"},
+		{name: "repeater id", opening: "ID:1234"},
+		{name: "silent RFB viewer"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := tcpPair(t)
+			if tt.opening != "" {
+				io.WriteString(client, tt.opening)
+			}
+
+			path, ok := peekWebSocketPath(server)
+			if ok != tt.ok || path != tt.path {
+				t.Fatalf("peekWebSocketPath = %q, %v; want %q, %v", path, ok, tt.path, tt.ok)
+			}
+
+			// the opening must be left for whoever handles the connection
+			if tt.opening != "" {
+				buf := make([]byte, len(tt.opening))
+				server.SetReadDeadline(time.Now().Add(time.Second))
+				if _, err := io.ReadFull(server, buf); err != nil || string(buf) != tt.opening {
+					t.Errorf("opening consumed: read %q, %v", buf, err)
+				}
+			}
+		})
+	}
+}
+
+func TestPeekWebSocketPathDecidesOnFirstByte(t *testing.T) {
+	server, client := tcpPair(t)
+	io.WriteString(client, "X")
+
+	start := time.Now()
+	if _, ok := peekWebSocketPath(server); ok {
+		t.Fatal("non-HTTP opening taken for a WebSocket request")
+	}
+	if elapsed := time.Since(start); elapsed >= 100*time.Millisecond {
+		t.Errorf("took %s to reject a non-HTTP opening", elapsed)
+	}
+}
+
+func TestNewGatewayRequiresPasswords(t *testing.T) {
+	tests := []struct {
+		name    string
+		route   GatewayRoute
+		wantErr bool
+	}{
+		{name: "password", route: GatewayRoute{Password: "secret"}},
+		{name: "id with password", route: GatewayRoute{ID: "1234", Password: "secret"}},
+		{name: "id without password", route: GatewayRoute{ID: "1234"}, wantErr: true},
+		{name: "path without password", route: GatewayRoute{Path: "/desk"}, wantErr: true},
+		{name: "path opted in", route: GatewayRoute{Path: "/desk", AllowUnauthenticated: true}},
+		{name: "no selector", route: GatewayRoute{AllowUnauthenticated: true}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, err := NewGatewayWithFactories("127.0.0.1:0", SelectByID, []GatewayRoute{tt.route}, nil, nil)
+			if g != nil {
+				g.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewGateway error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewGatewayRejectsSharedSelectors(t *testing.T) {
+	tests := []struct {
+		name    string
+		routes  []GatewayRoute
+		wantErr bool
+	}{
+		{name: "distinct", routes: []GatewayRoute{{Password: "alpha"}, {Password: "bravo"}}},
+		{name: "same password", routes: []GatewayRoute{{Password: "alpha"}, {Password: "alpha"}}, wantErr: true},
+		{name: "same first 8 bytes", routes: []GatewayRoute{{Password: "password1"}, {Password: "password2"}}, wantErr: true},
+		{name: "same id", routes: []GatewayRoute{{ID: "1234", Password: "alpha"}, {ID: "ID:1234", Password: "bravo"}}, wantErr: true},
+		{name: "same path", routes: []GatewayRoute{{Path: "desk", Password: "alpha"}, {Path: "/desk", Password: "bravo"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g, err := NewGatewayWithFactories("127.0.0.1:0", SelectByPassword, tt.routes, nil, nil)
+			if g != nil {
+				g.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewGateway error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// fakeProxyServer runs the server side of the handshake a proxy server with
+// the given password ("" for none) would, reporting the outcome on the
+// returned channel.
+func fakeProxyServer(conn net.Conn, password string) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		defer conn.Close()
+		done <- func() error {
+			io.WriteString(conn, "RFB 003.008\n")
+			minor, err := readProtocolVersion(conn)
+			if err != nil {
+				return err
+			}
+			secType := byte(rfbSecTypeNone)
+			if password != "" {
+				secType = rfbSecTypeVncAuth
+			}
+			if minor < 7 {
+				binary.Write(conn, binary.BigEndian, uint32(secType))
+			} else {
+				conn.Write([]byte{1, secType})
+				chosen := make([]byte, 1)
+				if _, err := io.ReadFull(conn, chosen); err != nil {
+					return err
+				}
+			}
+			if password == "" {
+				if minor >= 8 {
+					binary.Write(conn, binary.BigEndian, uint32(0))
+				}
+				return nil
+			}
+
+			challenge := []byte("0123456789abcdef")
+			conn.Write(challenge)
+			response := make([]byte, 16)
+			if _, err := io.ReadFull(conn, response); err != nil {
+				return err
+			}
+			expected, _ := vncAuthResponse(challenge, password)
+			if !bytes.Equal(response, expected) {
+				binary.Write(conn, binary.BigEndian, uint32(1))
+				return errors.New("wrong password")
+			}
+			binary.Write(conn, binary.BigEndian, uint32(0))
+			return nil
+		}()
+	}()
+	return done
+}
+
+func TestProxyServerHandshake(t *testing.T) {
+	tests := []struct {
+		name           string
+		minor          int
+		serverPassword string
+		password       string
+		wantErr        bool
+	}{
+		{name: "none 3.3", minor: 3},
+		{name: "none 3.7", minor: 7},
+		{name: "none 3.8", minor: 8},
+		{name: "password 3.3", minor: 3, serverPassword: "secret", password: "secret"},
+		{name: "password 3.8", minor: 8, serverPassword: "secret", password: "secret"},
+		{name: "wrong password", minor: 8, serverPassword: "secret", password: "guess", wantErr: true},
+		{name: "missing password", minor: 8, serverPassword: "secret", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			done := fakeProxyServer(server, tt.serverPassword)
+
+			err := proxyServerHandshake(client, tt.minor, tt.password)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("proxyServerHandshake error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr {
+				if err := <-done; err != nil {
+					t.Errorf("proxy server: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestGatewayRestartsStoppedMultiplexer(t *testing.T) {
+	ports := newFakePorts(64, 48)
+	g, err := NewGatewayWithFactories("127.0.0.1:0", SelectByPassword, []GatewayRoute{{Name: "desk", TargetHost: "desk.example", Password: "secret"}}, ports.clientFactory, ports.serverFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Close()
+	g.SetLogger(log.New(io.Discard, "", 0))
+	route := g.routes[0]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first, err := g.multiplexer(ctx, route)
+	if err != nil {
+		t.Fatalf("multiplexer: %v", err)
+	}
+	cancel()
+	waitFor(t, "the stopped multiplexer to be cleared", func() bool { return g.Multiplexer("desk") == nil })
+
+	second, err := g.multiplexer(context.Background(), route)
+	if err != nil {
+		t.Fatalf("multiplexer after stop: %v", err)
+	}
+	if second == first {
+		t.Error("next viewer got the stopped multiplexer")
+	}
+	if first.State() != StateClosed {
+		t.Errorf("stopped multiplexer is %s, want closed", first.State())
+	}
+}
@@ -0,0 +1,169 @@
+package vnc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// keysymNames maps X keysym names, and a few common aliases, to the keysyms
+// they stand for. Aliases of modifiers cover both the left and right key;
+// Delete also covers the keypad Delete key and SysRq the Print key it shares
+// on PC keyboards.
+var keysymNames = map[string][]uint32{
+	"BackSpace": {0xff08},
+	"Tab":       {0xff09},
+	"Return":    {0xff0d},
+	"Enter":     {0xff0d},
+	"Pause":     {0xff13},
+	"Sys_Req":   {0xff15},
+	"SysRq":     {0xff15, 0xff61},
+	"Escape":    {0xff1b},
+	"Esc":       {0xff1b},
+	"Delete":    {0xffff, 0xff9f},
+	"Del":       {0xffff, 0xff9f},
+	"KP_Delete": {0xff9f},
+	"Home":      {0xff50},
+	"Left":      {0xff51},
+	"Up":        {0xff52},
+	"Right":     {0xff53},
+	"Down":      {0xff54},
+	"Page_Up":   {0xff55},
+	"Page_Down": {0xff56},
+	"End":       {0xff57},
+	"Print":     {0xff61},
+	"Insert":    {0xff63},
+	"Menu":      {0xff67},
+	"Break":     {0xff6b},
+	"space":     {0x0020},
+	"Space":     {0x0020},
+
+	"Shift_L":   {0xffe1},
+	"Shift_R":   {0xffe2},
+	"Control_L": {0xffe3},
+	"Control_R": {0xffe4},
+	"Meta_L":    {0xffe7},
+	"Meta_R":    {0xffe8},
+	"Alt_L":     {0xffe9},
+	"Alt_R":     {0xffea},
+	"Super_L":   {0xffeb},
+	"Super_R":   {0xffec},
+	"Hyper_L":   {0xffed},
+	"Hyper_R":   {0xffee},
+
+	"Shift":   {0xffe1, 0xffe2},
+	"Control": {0xffe3, 0xffe4},
+	"Ctrl":    {0xffe3, 0xffe4},
+	"Meta":    {0xffe7, 0xffe8},
+	"Alt":     {0xffe9, 0xffea},
+	"Super":   {0xffeb, 0xffec},
+	"Win":     {0xffeb, 0xffec},
+	"Hyper":   {0xffed, 0xffee},
+}
+
+// keysymNamesByValue holds the canonical name of each named keysym.
+var keysymNamesByValue = make(map[uint32]string)
+
+func init() {
+	for i := 0; i < 35; i++ {
+		keysymNames["F"+strconv.Itoa(i+1)] = []uint32{0xffbe + uint32(i)}
+	}
+
+	canonical := []string{
+		"BackSpace", "Tab", "Return", "Pause", "Sys_Req", "Escape", "Delete",
+		"Home", "Left", "Up", "Right", "Down", "Page_Up", "Page_Down", "End",
+		"Print", "Insert", "Menu", "Break", "space", "KP_Delete",
+		"Shift_L", "Shift_R", "Control_L", "Control_R", "Meta_L", "Meta_R",
+		"Alt_L", "Alt_R", "Super_L", "Super_R", "Hyper_L", "Hyper_R",
+	}
+	for i := 0; i < 35; i++ {
+		canonical = append(canonical, "F"+strconv.Itoa(i+1))
+	}
+	for _, name := range canonical {
+		keysymNamesByValue[keysymNames[name][0]] = name
+	}
+}
+
+// keysymName returns the name of a keysym, or its hexadecimal value.
+func keysymName(key uint32) string {
+	if name, ok := keysymNamesByValue[key]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%x", key)
+}
+
+// parseKeysym resolves a keysym name, a single character or a hexadecimal
+// keysym such as 0xffff. Letters match either case.
+func parseKeysym(name string) ([]uint32, error) {
+	if keysyms, ok := keysymNames[name]; ok {
+		return keysyms, nil
+	}
+	if strings.HasPrefix(name, "0x") {
+		keysym, err := strconv.ParseUint(name[2:], 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keysym %q", name)
+		}
+		return []uint32{uint32(keysym)}, nil
+	}
+	if runes := []rune(name); len(runes) == 1 && runes[0] >= 0x20 && runes[0] <= 0x7e {
+		lower, upper := strings.ToLower(name), strings.ToUpper(name)
+		if lower != upper {
+			return []uint32{uint32(lower[0]), uint32(upper[0])}, nil
+		}
+		return []uint32{uint32(runes[0])}, nil
+	}
+	return nil, fmt.Errorf("unknown keysym %q", name)
+}
+
+// keyChord is a key combination; each element lists the keysyms that can
+// stand for one of its keys.
+type keyChord [][]uint32
+
+// parseKeyChord parses a combination such as "Ctrl+Alt+Delete".
+func parseKeyChord(chord string) (keyChord, error) {
+	var parsed keyChord
+	for _, name := range strings.Split(chord, "+") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return nil, fmt.Errorf("invalid key chord %q", chord)
+		}
+		keysyms, err := parseKeysym(name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key chord %q: %w", chord, err)
+		}
+		parsed = append(parsed, keysyms)
+	}
+	return parsed, nil
+}
+
+// completedBy reports whether pressing key while holding held completes
+// the chord.
+func (c keyChord) completedBy(key uint32, held map[uint32]bool) bool {
+	completes := false
+	for _, keysyms := range c {
+		if containsKeysym(keysyms, key) && !completes {
+			completes = true
+			continue
+		}
+		pressed := false
+		for _, keysym := range keysyms {
+			if held[keysym] {
+				pressed = true
+				break
+			}
+		}
+		if !pressed {
+			return false
+		}
+	}
+	return completes
+}
+
+func containsKeysym(keysyms []uint32, key uint32) bool {
+	for _, keysym := range keysyms {
+		if keysym == key {
+			return true
+		}
+	}
+	return false
+}
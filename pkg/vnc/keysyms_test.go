@@ -0,0 +1,93 @@
+package vnc
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseKeyChord(t *testing.T) {
+	tests := []struct {
+		chord   string
+		want    keyChord
+		wantErr bool
+	}{
+		{chord: "Ctrl+Alt+Delete", want: keyChord{{0xffe3, 0xffe4}, {0xffe9, 0xffea}, {0xffff, 0xff9f}}},
+		{chord: "Ctrl+Alt+KP_Delete", want: keyChord{{0xffe3, 0xffe4}, {0xffe9, 0xffea}, {0xff9f}}},
+		{chord: "Super", want: keyChord{{0xffeb, 0xffec}}},
+		{chord: " Alt + SysRq ", want: keyChord{{0xffe9, 0xffea}, {0xff15, 0xff61}}},
+		{chord: "Alt+Sys_Req", want: keyChord{{0xffe9, 0xffea}, {0xff15}}},
+		{chord: "Ctrl+q", want: keyChord{{0xffe3, 0xffe4}, {'q', 'Q'}}},
+		{chord: "Alt+F4", want: keyChord{{0xffe9, 0xffea}, {0xffc1}}},
+		{chord: "Ctrl+0xff1b", want: keyChord{{0xffe3, 0xffe4}, {0xff1b}}},
+		{chord: "Ctrl+1", want: keyChord{{0xffe3, 0xffe4}, {'1'}}},
+		{chord: "Ctrl++", wantErr: true},
+		{chord: "", wantErr: true},
+		{chord: "Ctrl+Hyperspace", wantErr: true},
+		{chord: "Ctrl+0xzz", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseKeyChord(tt.chord)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseKeyChord(%q) = %v, want error", tt.chord, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseKeyChord(%q) = %v, %v; want %v", tt.chord, got, err, tt.want)
+		}
+	}
+}
+
+func TestKeyChordCompletedBy(t *testing.T) {
+	ctrlAltDel, err := parseKeyChord("Ctrl+Alt+Delete")
+	if err != nil {
+		t.Fatal(err)
+	}
+	held := func(keys ...uint32) map[uint32]bool {
+		m := make(map[uint32]bool)
+		for _, key := range keys {
+			m[key] = true
+		}
+		return m
+	}
+
+	tests := []struct {
+		name string
+		key  uint32
+		held map[uint32]bool
+		want bool
+	}{
+		{name: "delete last", key: 0xffff, held: held(0xffe3, 0xffe9), want: true},
+		{name: "right-hand modifiers", key: 0xffff, held: held(0xffe4, 0xffea), want: true},
+		{name: "keypad delete", key: 0xff9f, held: held(0xffe3, 0xffe9), want: true},
+		{name: "modifier last", key: 0xffe9, held: held(0xffe3, 0xffff), want: true},
+		{name: "missing modifier", key: 0xffff, held: held(0xffe3)},
+		{name: "nothing held", key: 0xffff, held: held()},
+		{name: "unrelated key", key: 'a', held: held(0xffe3, 0xffe9)},
+	}
+	for _, tt := range tests {
+		if got := ctrlAltDel.completedBy(tt.key, tt.held); got != tt.want {
+			t.Errorf("%s: completedBy = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestKeysymName(t *testing.T) {
+	tests := []struct {
+		key  uint32
+		want string
+	}{
+		{0xffff, "Delete"},
+		{0xffe3, "Control_L"},
+		{0xff9f, "KP_Delete"},
+		{0xffbe, "F1"},
+		{0x20, "space"},
+		{0x1234, "0x1234"},
+	}
+	for _, tt := range tests {
+		if got := keysymName(tt.key); got != tt.want {
+			t.Errorf("keysymName(0x%x) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,511 @@
+package vnc
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// MDNSServiceType is the DNS-SD service type VNC servers are announced as.
+	MDNSServiceType = "_rfb._tcp"
+
+	mdnsDomain     = "local."
+	mdnsServices   = "_services._dns-sd._udp.local."
+	mdnsTTL        = 120
+	mdnsCacheFlush = 0x8000
+)
+
+// DefaultMDNSGroup is the standard IPv4 mDNS multicast group. Advertisers and
+// browsers can be pointed at another group/port, e.g. to run isolated from
+// the real network.
+var DefaultMDNSGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// MDNSService describes an announced or discovered VNC service.
+type MDNSService struct {
+	// Instance is the human readable service name, usually the desktop name.
+	Instance string
+	// Host is the advertising machine's .local host name.
+	Host  string
+	Port  int
+	Addrs []net.IP
+
+	Width        int
+	Height       int
+	AuthRequired bool
+}
+
+// MDNSOptions tunes where advertisers and browsers send and listen.
+type MDNSOptions struct {
+	// Group is the multicast group to use (default DefaultMDNSGroup).
+	Group *net.UDPAddr
+	// Interface restricts multicast to one interface (default: system choice).
+	Interface *net.Interface
+}
+
+func (o MDNSOptions) group() *net.UDPAddr {
+	if o.Group != nil {
+		return o.Group
+	}
+	return DefaultMDNSGroup
+}
+
+// MDNSAdvertiser answers mDNS queries for one VNC service until closed.
+type MDNSAdvertiser struct {
+	conn  *net.UDPConn
+	group *net.UDPAddr
+
+	mu      sync.RWMutex
+	service MDNSService
+
+	done      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// AdvertiseMDNS announces service as _rfb._tcp on the local network and keeps
+// answering queries for it. Host and Addrs are filled in from the machine
+// when left empty.
+func AdvertiseMDNS(service MDNSService, opts MDNSOptions) (*MDNSAdvertiser, error) {
+	if service.Port <= 0 {
+		return nil, fmt.Errorf("mdns: invalid service port %d", service.Port)
+	}
+	service = completeMDNSService(service)
+
+	group := opts.group()
+	conn, err := net.ListenMulticastUDP("udp4", opts.Interface, group)
+	if err != nil {
+		return nil, fmt.Errorf("mdns: %w", err)
+	}
+
+	a := newMDNSAdvertiser(conn, group, service)
+	log.Printf("Advertising %q as %s on port %d via mDNS.", service.Instance, MDNSServiceType, service.Port)
+	return a, nil
+}
+
+// newMDNSAdvertiser answers queries arriving on conn, sending responses to
+// group.
+func newMDNSAdvertiser(conn *net.UDPConn, group *net.UDPAddr, service MDNSService) *MDNSAdvertiser {
+	a := &MDNSAdvertiser{
+		conn:    conn,
+		group:   group,
+		service: service,
+		done:    make(chan struct{}),
+	}
+
+	a.wg.Add(1)
+	go a.serve()
+
+	a.announce(mdnsTTL)
+	return a
+}
+
+// Service returns the currently advertised service.
+func (a *MDNSAdvertiser) Service() MDNSService {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.service
+}
+
+// Update replaces the advertised details (e.g. after a resize) and announces
+// the change.
+func (a *MDNSAdvertiser) Update(service MDNSService) {
+	service = completeMDNSService(service)
+
+	a.mu.Lock()
+	old := a.service
+	a.service = service
+	a.mu.Unlock()
+
+	if !strings.EqualFold(old.Instance, service.Instance) {
+		a.sendRecords(old, 0)
+	}
+	a.announce(mdnsTTL)
+}
+
+// Close sends a goodbye for the service and stops answering queries. It is
+// safe to call more than once.
+func (a *MDNSAdvertiser) Close() error {
+	a.closeOnce.Do(func() {
+		a.announce(0)
+		close(a.done)
+		a.closeErr = a.conn.Close()
+		a.wg.Wait()
+	})
+	return a.closeErr
+}
+
+func (a *MDNSAdvertiser) announce(ttl uint32) {
+	a.sendRecords(a.Service(), ttl)
+}
+
+func (a *MDNSAdvertiser) sendRecords(service MDNSService, ttl uint32) {
+	msg, err := buildMDNSResponse(service, ttl)
+	if err != nil {
+		log.Printf("mdns: failed to build response: %v", err)
+		return
+	}
+	if _, err := a.conn.WriteToUDP(msg, a.group); err != nil {
+		log.Printf("mdns: failed to send response: %v", err)
+	}
+}
+
+func (a *MDNSAdvertiser) serve() {
+	defer a.wg.Done()
+
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := a.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-a.done:
+				return
+			default:
+			}
+			log.Printf("mdns: read error: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+
+		if a.answersQuery(buf[:n]) {
+			a.announce(mdnsTTL)
+		}
+	}
+}
+
+// answersQuery reports whether msg is a query for anything this advertiser
+// owns: the service type, the service enumeration, the instance or the host.
+func (a *MDNSAdvertiser) answersQuery(msg []byte) bool {
+	var p dnsmessage.Parser
+	header, err := p.Start(msg)
+	if err != nil || header.Response {
+		return false
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return false
+	}
+
+	service := a.Service()
+	names := []string{
+		mdnsServiceName(),
+		mdnsServices,
+		mdnsInstanceName(service),
+		service.Host,
+	}
+	for _, q := range questions {
+		for _, name := range names {
+			if strings.EqualFold(q.Name.String(), name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// BrowseMDNS queries the network for _rfb._tcp services and collects the
+// answers received until ctx is done, so ctx should carry a timeout.
+func BrowseMDNS(ctx context.Context, opts MDNSOptions) ([]MDNSService, error) {
+	group := opts.group()
+	conn, err := net.ListenMulticastUDP("udp4", opts.Interface, group)
+	if err != nil {
+		return nil, fmt.Errorf("mdns: %w", err)
+	}
+	defer conn.Close()
+	return browseMDNS(ctx, conn, group)
+}
+
+// browseMDNS sends a query to group and collects the answers arriving on
+// conn until ctx is done.
+func browseMDNS(ctx context.Context, conn *net.UDPConn, group *net.UDPAddr) ([]MDNSService, error) {
+	query, err := buildMDNSQuery()
+	if err != nil {
+		return nil, fmt.Errorf("mdns: %w", err)
+	}
+	if _, err := conn.WriteToUDP(query, group); err != nil {
+		return nil, fmt.Errorf("mdns: %w", err)
+	}
+
+	found := make(map[string]*MDNSService)
+	hosts := make(map[string][]net.IP)
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && ctx.Err() != nil {
+				break
+			}
+			return nil, fmt.Errorf("mdns: %w", err)
+		}
+		parseMDNSResponse(buf[:n], found, hosts)
+	}
+
+	services := make([]MDNSService, 0, len(found))
+	for _, service := range found {
+		if service.Port == 0 {
+			continue
+		}
+		if len(service.Addrs) == 0 {
+			service.Addrs = hosts[strings.ToLower(service.Host)]
+		}
+		services = append(services, *service)
+	}
+	sort.Slice(services, func(i, j int) bool {
+		return services[i].Instance < services[j].Instance
+	})
+	return services, nil
+}
+
+func mdnsServiceName() string {
+	return MDNSServiceType + "." + mdnsDomain
+}
+
+func mdnsInstanceName(service MDNSService) string {
+	return service.Instance + "." + mdnsServiceName()
+}
+
+func completeMDNSService(service MDNSService) MDNSService {
+	// Dots would split the instance into several DNS labels.
+	service.Instance = strings.ReplaceAll(service.Instance, ".", "-")
+	if service.Host == "" {
+		hostname, err := os.Hostname()
+		if err != nil || hostname == "" {
+			hostname = "libvnc-go"
+		}
+		service.Host = strings.SplitN(hostname, ".", 2)[0] + "." + mdnsDomain
+	}
+	if !strings.HasSuffix(service.Host, ".") {
+		service.Host += "."
+	}
+	if service.Instance == "" {
+		service.Instance = strings.TrimSuffix(strings.TrimSuffix(service.Host, "."+mdnsDomain), ".")
+	}
+	if len(service.Addrs) == 0 {
+		service.Addrs = localIPv4Addrs()
+	}
+	return service
+}
+
+// localIPv4Addrs lists the machine's IPv4 addresses, falling back to
+// loopback when there is nothing else.
+func localIPv4Addrs() []net.IP {
+	var addrs, loopback []net.IP
+	ifaceAddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range ifaceAddrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() == nil {
+			continue
+		}
+		if ipNet.IP.IsLoopback() {
+			loopback = append(loopback, ipNet.IP.To4())
+		} else {
+			addrs = append(addrs, ipNet.IP.To4())
+		}
+	}
+	if len(addrs) == 0 {
+		return loopback
+	}
+	return addrs
+}
+
+func mdnsTXT(service MDNSService) []string {
+	auth := "none"
+	if service.AuthRequired {
+		auth = "vnc"
+	}
+	return []string{
+		"name=" + service.Instance,
+		"width=" + strconv.Itoa(service.Width),
+		"height=" + strconv.Itoa(service.Height),
+		"auth=" + auth,
+	}
+}
+
+func buildMDNSQuery() ([]byte, error) {
+	name, err := dnsmessage.NewName(mdnsServiceName())
+	if err != nil {
+		return nil, err
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err := b.Question(dnsmessage.Question{Name: name, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// buildMDNSResponse builds an unsolicited response carrying the service
+// type enumeration PTR and the PTR, SRV, TXT and A records of service. A ttl
+// of 0 is a goodbye.
+func buildMDNSResponse(service MDNSService, ttl uint32) ([]byte, error) {
+	servicesName, err := dnsmessage.NewName(mdnsServices)
+	if err != nil {
+		return nil, err
+	}
+	serviceName, err := dnsmessage.NewName(mdnsServiceName())
+	if err != nil {
+		return nil, err
+	}
+	instanceName, err := dnsmessage.NewName(mdnsInstanceName(service))
+	if err != nil {
+		return nil, err
+	}
+	hostName, err := dnsmessage.NewName(service.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	shared := dnsmessage.ResourceHeader{Class: dnsmessage.ClassINET, TTL: ttl}
+	unique := dnsmessage.ResourceHeader{Class: dnsmessage.ClassINET | mdnsCacheFlush, TTL: ttl}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true, Authoritative: true})
+	b.EnableCompression()
+	if err := b.StartAnswers(); err != nil {
+		return nil, err
+	}
+
+	// the service type enumeration lets generic browsers find _rfb._tcp
+	shared.Name = servicesName
+	if err := b.PTRResource(shared, dnsmessage.PTRResource{PTR: serviceName}); err != nil {
+		return nil, err
+	}
+	shared.Name = serviceName
+	if err := b.PTRResource(shared, dnsmessage.PTRResource{PTR: instanceName}); err != nil {
+		return nil, err
+	}
+	unique.Name = instanceName
+	if err := b.SRVResource(unique, dnsmessage.SRVResource{Port: uint16(service.Port), Target: hostName}); err != nil {
+		return nil, err
+	}
+	if err := b.TXTResource(unique, dnsmessage.TXTResource{TXT: mdnsTXT(service)}); err != nil {
+		return nil, err
+	}
+	unique.Name = hostName
+	for _, ip := range service.Addrs {
+		ip4 := ip.To4()
+		if ip4 == nil {
+			continue
+		}
+		var a dnsmessage.AResource
+		copy(a.A[:], ip4)
+		if err := b.AResource(unique, a); err != nil {
+			return nil, err
+		}
+	}
+	return b.Finish()
+}
+
+// parseMDNSResponse merges the VNC related records of msg into found (by
+// instance name) and hosts (by lower-cased host name).
+func parseMDNSResponse(msg []byte, found map[string]*MDNSService, hosts map[string][]net.IP) {
+	var p dnsmessage.Parser
+	header, err := p.Start(msg)
+	if err != nil || !header.Response {
+		return
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		return
+	}
+	answers, err := p.AllAnswers()
+	if err != nil {
+		return
+	}
+	if err := p.SkipAllAuthorities(); err != nil {
+		return
+	}
+	additionals, _ := p.AllAdditionals()
+
+	suffix := "." + strings.ToLower(mdnsServiceName())
+	lookup := func(name string) *MDNSService {
+		lower := strings.ToLower(name)
+		if !strings.HasSuffix(lower, suffix) {
+			return nil
+		}
+		instance := name[:len(name)-len(suffix)]
+		service, ok := found[lower]
+		if !ok {
+			service = &MDNSService{Instance: instance}
+			found[lower] = service
+		}
+		return service
+	}
+
+	for _, r := range append(answers, additionals...) {
+		if r.Header.TTL == 0 {
+			// goodbye
+			if ptr, ok := r.Body.(*dnsmessage.PTRResource); ok {
+				delete(found, strings.ToLower(ptr.PTR.String()))
+			}
+			continue
+		}
+		switch body := r.Body.(type) {
+		case *dnsmessage.PTRResource:
+			if strings.EqualFold(r.Header.Name.String(), mdnsServiceName()) {
+				lookup(body.PTR.String())
+			}
+		case *dnsmessage.SRVResource:
+			if service := lookup(r.Header.Name.String()); service != nil {
+				service.Host = body.Target.String()
+				service.Port = int(body.Port)
+			}
+		case *dnsmessage.TXTResource:
+			if service := lookup(r.Header.Name.String()); service != nil {
+				applyMDNSTXT(service, body.TXT)
+			}
+		case *dnsmessage.AResource:
+			host := strings.ToLower(r.Header.Name.String())
+			hosts[host] = appendUniqueIP(hosts[host], net.IP(body.A[:]).To4())
+		}
+	}
+}
+
+func applyMDNSTXT(service *MDNSService, txt []string) {
+	for _, entry := range txt {
+		key, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(key) {
+		case "name":
+			service.Instance = value
+		case "width":
+			service.Width, _ = strconv.Atoi(value)
+		case "height":
+			service.Height, _ = strconv.Atoi(value)
+		case "auth":
+			service.AuthRequired = value != "none"
+		}
+	}
+}
+
+func appendUniqueIP(ips []net.IP, ip net.IP) []net.IP {
+	for _, existing := range ips {
+		if existing.Equal(ip) {
+			return ips
+		}
+	}
+	return append(ips, ip)
+}
@@ -0,0 +1,165 @@
+package vnc
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// listenLoopbackUDP stands in for the multicast group: the advertiser and
+// the browser talk to each other over unicast loopback sockets.
+func listenLoopbackUDP(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func testMDNSService() MDNSService {
+	return MDNSService{
+		Instance:     "Office desktop",
+		Host:         "office.local.",
+		Port:         5901,
+		Addrs:        []net.IP{net.IPv4(192, 168, 1, 20)},
+		Width:        1920,
+		Height:       1080,
+		AuthRequired: true,
+	}
+}
+
+func mdnsQuery(t *testing.T, name string) []byte {
+	t.Helper()
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{})
+	if err := b.StartQuestions(); err != nil {
+		t.Fatal(err)
+	}
+	q := dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}
+	if err := b.Question(q); err != nil {
+		t.Fatal(err)
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestMDNSAdvertiseAndBrowse(t *testing.T) {
+	advertiserConn := listenLoopbackUDP(t)
+	browserConn := listenLoopbackUDP(t)
+
+	a := newMDNSAdvertiser(advertiserConn, browserConn.LocalAddr().(*net.UDPAddr), completeMDNSService(testMDNSService()))
+	defer a.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	services, err := browseMDNS(ctx, browserConn, advertiserConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("browse: %v", err)
+	}
+	if len(services) != 1 {
+		t.Fatalf("found %d services, want 1: %+v", len(services), services)
+	}
+
+	got, want := services[0], testMDNSService()
+	if got.Instance != want.Instance || got.Host != want.Host || got.Port != want.Port ||
+		got.Width != want.Width || got.Height != want.Height || got.AuthRequired != want.AuthRequired {
+		t.Errorf("found %+v, want %+v", got, want)
+	}
+	if len(got.Addrs) != 1 || !got.Addrs[0].Equal(want.Addrs[0]) {
+		t.Errorf("addresses %v, want %v", got.Addrs, want.Addrs)
+	}
+}
+
+func TestMDNSAnswersQueries(t *testing.T) {
+	a := &MDNSAdvertiser{service: completeMDNSService(testMDNSService())}
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "_rfb._tcp.local.", want: true},
+		{name: "_services._dns-sd._udp.local.", want: true},
+		{name: "Office desktop._rfb._tcp.local.", want: true},
+		{name: "office.local.", want: true},
+		{name: "_ipp._tcp.local.", want: false},
+	}
+	for _, tt := range tests {
+		if got := a.answersQuery(mdnsQuery(t, tt.name)); got != tt.want {
+			t.Errorf("answersQuery(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMDNSResponseEnumeratesServiceType(t *testing.T) {
+	msg, err := buildMDNSResponse(completeMDNSService(testMDNSService()), mdnsTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var p dnsmessage.Parser
+	if _, err := p.Start(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.SkipAllQuestions(); err != nil {
+		t.Fatal(err)
+	}
+	answers, err := p.AllAnswers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range answers {
+		ptr, ok := r.Body.(*dnsmessage.PTRResource)
+		if ok && strings.EqualFold(r.Header.Name.String(), mdnsServices) && strings.EqualFold(ptr.PTR.String(), mdnsServiceName()) {
+			return
+		}
+	}
+	t.Errorf("response has no %s PTR %s record", mdnsServices, mdnsServiceName())
+}
+
+func TestMDNSGoodbyeRemovesService(t *testing.T) {
+	service := completeMDNSService(testMDNSService())
+	found := make(map[string]*MDNSService)
+	hosts := make(map[string][]net.IP)
+
+	hello, err := buildMDNSResponse(service, mdnsTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parseMDNSResponse(hello, found, hosts)
+	if len(found) != 1 {
+		t.Fatalf("found %d services after announcement, want 1", len(found))
+	}
+
+	goodbye, err := buildMDNSResponse(service, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parseMDNSResponse(goodbye, found, hosts)
+	if len(found) != 0 {
+		t.Errorf("found %d services after goodbye, want 0", len(found))
+	}
+}
+
+func TestMDNSAdvertiserConcurrentClose(t *testing.T) {
+	advertiserConn := listenLoopbackUDP(t)
+	browserConn := listenLoopbackUDP(t)
+	a := newMDNSAdvertiser(advertiserConn, browserConn.LocalAddr().(*net.UDPAddr), completeMDNSService(testMDNSService()))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.Close()
+		}()
+	}
+	wg.Wait()
+}
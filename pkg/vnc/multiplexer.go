@@ -1,12 +1,15 @@
 package vnc
 
 import (
+	"context"
 	"fmt"
 	"image"
 	"image/color"
-	"image/draw"
 	"log"
+	"net"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 )
@@ -15,22 +18,153 @@ type Multiplexer struct {
 	proxyServer ServerPort
 	proxyClient ClientPort
 
-	targetHost     string
-	targetPort     int
-	targetPassword string
+	// endpoints in failover order; in dial-home mode a single entry holding
+	// only the password
+	endpoints        []TargetEndpoint
+	activeEndpoint   int // guarded by stateMu
+	failBack         bool
+	failBackInterval time.Duration
+	connectTimeout   time.Duration
+
+	// upstream liveness
+	keepAlive          time.Duration
+	heartbeatInterval  time.Duration
+	heartbeatTimeout   time.Duration
+	stallTimeout       time.Duration
+	staleOverlay       bool
+	lastUpstreamUpdate atomic.Int64 // UnixNano of the last update from the target
+
+	// dial-home mode: wait for the target to connect in instead of dialing it
+	targets  *TargetListener
+	targetID string
 
 	listenPort int
 
-	isConnected         bool
+	// lazy mode: serve a waiting screen of the default size until the
+	// target is first reached
+	lazy          bool
+	defaultWidth  int
+	defaultHeight int
+
+	// on-demand mode: only stay connected to the target while viewers are
+	// connected, plus a grace period
+	onDemand       bool
+	onDemandGrace  time.Duration
+	viewersChanged chan struct{}
+
+	// connected viewers, keyed by their libvncserver client
+	viewersMu         sync.Mutex
+	viewers           map[unsafe.Pointer]*viewer
+	nextViewerID      int
+	viewerSubscribers map[int]func(ViewerEvent)
+	nextViewerSubID   int
+	sharing           SharingPolicy
+
+	// viewer authentication and roles
+	credentials []ViewerCredential
+	defaultRole ViewerRole
+	authorizer  ViewerAuthorizer
+
+	// input arbitration between viewers, see ControlMode
+	controlMu          sync.Mutex
+	controlMode        ControlMode
+	controlIdleTimeout time.Duration
+	controller         *viewer
+	controlQueue       []*viewer
+	controlSubscribers map[int]func(ControlEvent)
+	nextControlSubID   int
+
+	pixelFormat     PixelFormat
+	appData         *AppDataConfig
+	reconnectPolicy ReconnectPolicy
+	logger          *log.Logger
+
+	isConnected      bool
+	stateMu          sync.Mutex
+	notifyMu         sync.Mutex
+	state            MultiplexerState
+	stateSince       time.Time
+	width, height    int // framebuffer size reported in state events
+	stateSubscribers map[int]func(StateEvent)
+	nextSubscriberID int
+
+	// shown while the target is not connected; the reconnect status it
+	// reports is guarded by stateMu
+	placeholder         PlaceholderRenderer
+	reconnectAttempt    int
+	reconnectErr        error
+	nextAttempt         time.Time
 	onConnectionOnline  func()
 	onConnectionOffline func()
+	onReconnectAttempt  func(attempt int, lastErr error)
+	onReconnectGiveUp   func(attempts int, lastErr error)
+	retryNow            chan struct{}
 
 	clientFactory ClientFactory
 	serverFactory ServerFactory
 
+	mdns         *MDNSAdvertiser
+	mdnsInstance string
+
+	shutdownMessage string
+
+	// input policy and filters applied before input reaches the target
+	blockedChords  []compiledChord
+	maxInputRate   int
+	pointerRegions []PointerRegion
+	filtersMu      sync.Mutex
+	inputFilters   []InputFilter
+
+	// audit log, see AuditConfig; pending input is guarded by auditMu
+	auditLog     *AuditLog
+	auditMu      sync.Mutex
+	auditPending map[*viewer]*auditInput
+	auditMasked  bool
+	auditDone    chan struct{}
+
+	// viewer pointer overlay, see ViewerPointers; positions and the
+	// rectangles drawn are guarded by pointersMu. The overlay is only
+	// drawn on the goroutine copying from the target, pointersDirty asks
+	// it to.
+	viewerPointers    bool
+	pointerLabel      ViewerPointerLabel
+	pointersMu        sync.Mutex
+	pointerPositions  map[*viewer]*viewerPointer
+	pointerMarks      []image.Rectangle
+	nextPointerColour int
+	pointersDirty     atomic.Bool
+
+	// session limits, see SessionLimits; viewer session clocks, notices
+	// and the height of the warning banner are guarded by sessionMu
+	sessionLimits     SessionLimits
+	roleSessionLimits map[ViewerRole]SessionLimits
+	sessionMu         sync.Mutex
+	sessionNotices    map[*viewer]sessionNotice
+	sessionBanner     int
+
+	// keys and buttons held down on the target, per viewer; the target
+	// sees their union
+	inputMu    sync.Mutex
+	pressed    map[*viewer]*pressedInput
+	buttonMask uint8
+	pointerX   int
+	pointerY   int
+	// releases owed to whichever target is connected next, in case the
+	// last one dropped or stalled before they could be sent
+	pendingKeys    map[uint32]bool
+	pendingButtons bool
+
 	// internal coordination helpers
-	serverLoopStop chan struct{} // closes to stop current proxyServer event loop
-	runningWG      sync.WaitGroup
+	serverLoopCancel context.CancelFunc // stops the current proxyServer event loop
+	runningWG        sync.WaitGroup
+
+	mu                sync.Mutex
+	running           bool
+	interruptUpstream context.CancelCauseFunc // drops the current upstream connection, see SetTarget
+	clientStopped     chan struct{}           // closed once Run no longer touches proxyClient
+	shuttingDown      chan struct{}           // closed when Shutdown or Close begins
+	shutdownDone      chan struct{}           // closed when the multiplexer is fully torn down
+	shutdownOnce      sync.Once
 }
 
 func NewMultiplexer(targetHost string, targetPort int, targetPassword string, listenPort int, onConnectionOnline func(), onConnectionOffline func()) (*Multiplexer, error) {
@@ -38,32 +172,196 @@ func NewMultiplexer(targetHost string, targetPort int, targetPassword string, li
 }
 
 func NewMultiplexerWithFactories(targetHost string, targetPort int, targetPassword string, listenPort int, onConnectionOnline func(), onConnectionOffline func(), clientFactory ClientFactory, serverFactory ServerFactory) (*Multiplexer, error) {
+	return NewMultiplexerFromConfig(MultiplexerConfig{
+		TargetHost:          targetHost,
+		TargetPort:          targetPort,
+		TargetPassword:      targetPassword,
+		ListenPort:          listenPort,
+		OnConnectionOnline:  onConnectionOnline,
+		OnConnectionOffline: onConnectionOffline,
+		ClientFactory:       clientFactory,
+		ServerFactory:       serverFactory,
+	})
+}
+
+// NewDialHomeMultiplexer creates a multiplexer whose target connects in
+// through targets, identified by targetID ("" for targets that send no ID),
+// instead of being dialed. When the target drops, the multiplexer goes
+// offline until it dials in again.
+func NewDialHomeMultiplexer(targets *TargetListener, targetID string, targetPassword string, listenPort int, onConnectionOnline func(), onConnectionOffline func()) (*Multiplexer, error) {
+	return NewDialHomeMultiplexerWithFactories(targets, targetID, targetPassword, listenPort, onConnectionOnline, onConnectionOffline, defaultClientFactory, defaultServerFactory)
+}
+
+func NewDialHomeMultiplexerWithFactories(targets *TargetListener, targetID string, targetPassword string, listenPort int, onConnectionOnline func(), onConnectionOffline func(), clientFactory ClientFactory, serverFactory ServerFactory) (*Multiplexer, error) {
+	if targets == nil {
+		return nil, fmt.Errorf("target listener cannot be nil")
+	}
+	return NewMultiplexerFromConfig(MultiplexerConfig{
+		Targets:             targets,
+		TargetID:            targetID,
+		TargetPassword:      targetPassword,
+		ListenPort:          listenPort,
+		OnConnectionOnline:  onConnectionOnline,
+		OnConnectionOffline: onConnectionOffline,
+		ClientFactory:       clientFactory,
+		ServerFactory:       serverFactory,
+	})
+}
+
+// NewMultiplexerFromConfig fills in defaults for cfg, validates it and
+// connects to the target. Errors from validation wrap ErrInvalidConfig.
+func NewMultiplexerFromConfig(cfg MultiplexerConfig) (*Multiplexer, error) {
+	cfg = cfg.WithDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+
+	placeholder, err := cfg.Placeholder.renderer()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load placeholder: %w", err)
+	}
+	blockedChords, err := cfg.InputPolicy.compile()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+	}
+
+	var auditLog *AuditLog
+	if cfg.Audit != nil {
+		if auditLog, err = NewAuditLog(*cfg.Audit); err != nil {
+			return nil, err
+		}
+	}
+
+	// registered last so that no error above leaves the ID taken
+	if cfg.Targets != nil {
+		if err := cfg.Targets.register(cfg.TargetID); err != nil {
+			if auditLog != nil {
+				auditLog.Close()
+			}
+			return nil, err
+		}
+	}
+
+	var appData *AppDataConfig
+	if cfg.AppData != nil {
+		data := *cfg.AppData
+		appData = &data
+	}
+
 	m := &Multiplexer{
-		targetHost:          targetHost,
-		targetPort:          targetPort,
-		targetPassword:      targetPassword,
-		listenPort:          listenPort,
-		onConnectionOnline:  onConnectionOnline,
-		onConnectionOffline: onConnectionOffline,
-		clientFactory:       clientFactory,
-		serverFactory:       serverFactory,
-		serverLoopStop:      make(chan struct{}),
-	}
-
-	if err := m.initProxyClient(clientFactory); err != nil {
+		endpoints:           cfg.endpoints(),
+		failBack:            cfg.FailBack,
+		failBackInterval:    time.Duration(cfg.FailBackInterval),
+		connectTimeout:      time.Duration(cfg.ConnectTimeout),
+		keepAlive:           time.Duration(cfg.KeepAlive),
+		heartbeatInterval:   time.Duration(cfg.HeartbeatInterval),
+		heartbeatTimeout:    time.Duration(cfg.HeartbeatTimeout),
+		stallTimeout:        time.Duration(cfg.StallTimeout),
+		staleOverlay:        cfg.StaleOverlay,
+		targets:             cfg.Targets,
+		targetID:            cfg.TargetID,
+		listenPort:          cfg.ListenPort,
+		lazy:                cfg.Lazy,
+		defaultWidth:        cfg.DefaultWidth,
+		defaultHeight:       cfg.DefaultHeight,
+		onDemand:            cfg.OnDemand,
+		onDemandGrace:       time.Duration(cfg.OnDemandGrace),
+		credentials:         cfg.Credentials,
+		defaultRole:         cfg.DefaultRole,
+		authorizer:          cfg.Authorize,
+		sharing:             cfg.Sharing,
+		viewerPointers:      cfg.ViewerPointers,
+		pointerLabel:        cfg.ViewerPointerLabel,
+		controlMode:         cfg.ControlMode,
+		blockedChords:       blockedChords,
+		maxInputRate:        cfg.InputPolicy.MaxEventsPerSecond,
+		pointerRegions:      cfg.InputPolicy.PointerRegions,
+		inputFilters:        append([]InputFilter(nil), cfg.InputFilters...),
+		auditLog:            auditLog,
+		sessionLimits:       cfg.SessionLimits,
+		roleSessionLimits:   cfg.RoleSessionLimits,
+		controlIdleTimeout:  time.Duration(cfg.ControlIdleTimeout),
+		pixelFormat:         *cfg.PixelFormat,
+		appData:             appData,
+		reconnectPolicy:     cfg.ReconnectPolicy,
+		shutdownMessage:     cfg.ShutdownMessage,
+		placeholder:         placeholder,
+		logger:              cfg.Logger,
+		onConnectionOnline:  cfg.OnConnectionOnline,
+		onConnectionOffline: cfg.OnConnectionOffline,
+		onReconnectAttempt:  cfg.OnReconnectAttempt,
+		onReconnectGiveUp:   cfg.OnReconnectGiveUp,
+		clientFactory:       cfg.ClientFactory,
+		serverFactory:       cfg.ServerFactory,
+	}
+
+	if cfg.OnStateChange != nil {
+		m.SubscribeState(cfg.OnStateChange)
+	}
+	if cfg.OnControlChange != nil {
+		m.SubscribeControl(cfg.OnControlChange)
+	}
+	if cfg.OnViewerChange != nil {
+		m.SubscribeViewers(cfg.OnViewerChange)
+	}
+
+	mux, err := m.start()
+	if err != nil {
+		if cfg.Targets != nil {
+			cfg.Targets.unregister(cfg.TargetID)
+		}
+		if auditLog != nil {
+			auditLog.Close()
+		}
+		return nil, err
+	}
+	if auditLog != nil {
+		go m.runAuditFlusher()
+	}
+	if m.sessionLimitsEnabled() {
+		go m.watchSessions()
+	}
+	return mux, nil
+}
+
+func (m *Multiplexer) start() (*Multiplexer, error) {
+	m.pressed = make(map[*viewer]*pressedInput)
+	m.pendingKeys = make(map[uint32]bool)
+	m.auditPending = make(map[*viewer]*auditInput)
+	m.auditDone = make(chan struct{})
+	m.sessionNotices = make(map[*viewer]sessionNotice)
+	m.pointerPositions = make(map[*viewer]*viewerPointer)
+	m.shuttingDown = make(chan struct{})
+	m.shutdownDone = make(chan struct{})
+	m.retryNow = make(chan struct{}, 1)
+	m.viewersChanged = make(chan struct{}, 1)
+	m.viewers = make(map[unsafe.Pointer]*viewer)
+	m.stateSince = time.Now()
+
+	if m.lazy || m.onDemand {
+		if err := m.initProxyServer(m.serverFactory); err != nil {
+			return nil, fmt.Errorf("failed to initialize proxy server: %w", err)
+		}
+		m.renderPlaceholder(nil)
+		m.setupHandlers()
+		return m, nil
+	}
+
+	if err := m.connectEndpoints(context.Background(), 0, StateConnecting, 0, nil); err != nil {
 		return nil, fmt.Errorf("failed to initialize proxy client: %w", err)
 	}
 
-	if err := m.initProxyServer(serverFactory); err != nil {
+	if err := m.initProxyServer(m.serverFactory); err != nil {
 		return nil, fmt.Errorf("failed to initialize proxy server: %w", err)
 	}
 
 	m.setupHandlers()
+	m.setState(StateOnline, nil, 0)
 
 	return m, nil
 }
 
-func (m *Multiplexer) initProxyClient(factory ClientFactory) error {
+func (m *Multiplexer) initProxyClient(ctx context.Context, factory ClientFactory) error {
 	if factory == nil {
 		factory = defaultClientFactory
 	}
@@ -74,21 +372,43 @@ func (m *Multiplexer) initProxyClient(factory ClientFactory) error {
 	}
 	m.proxyClient = client
 
-	m.proxyClient.SetHost(m.targetHost)
-	m.proxyClient.SetPort(m.targetPort)
-	if m.targetPassword != "" {
-		m.proxyClient.SetPassword(m.targetPassword)
+	endpoint := m.endpoint()
+	if m.targets == nil {
+		m.proxyClient.SetHost(endpoint.Host)
+		m.proxyClient.SetPort(endpoint.Port)
+	}
+	if endpoint.Password != "" {
+		m.proxyClient.SetPassword(endpoint.Password)
+	}
+	m.proxyClient.SetPixelFormat(m.pixelFormat)
+	m.proxyClient.SetKeepAlive(m.keepAlive)
+	if m.appData != nil {
+		m.proxyClient.SetAppData(*m.appData)
 	}
-	m.proxyClient.SetStandardPixelFormat()
 
-	if !m.proxyClient.Init() {
-		return fmt.Errorf("failed to initialize VNC client connection")
+	if m.targets != nil {
+		m.logger.Printf("Waiting for target %q to dial in...", m.targetID)
+		conn, err := m.targets.waitForTarget(ctx, m.targetID)
+		if err != nil {
+			return err
+		}
+		if err := m.proxyClient.ConnectWithConn(ctx, conn); err != nil {
+			return err
+		}
+	} else {
+		m.logger.Printf("Connecting to target %s...", endpoint)
+		connectCtx, cancel := context.WithTimeout(ctx, m.connectTimeout)
+		defer cancel()
+		if err := m.proxyClient.Connect(connectCtx); err != nil {
+			return err
+		}
 	}
 
-	log.Println("Proxy client initialized and connected to target server.")
+	m.logger.Println("Proxy client initialized and connected to target server.")
 
 	width := m.proxyClient.GetFrameBufferWidth()
 	height := m.proxyClient.GetFrameBufferHeight()
+	m.setSize(width, height)
 	m.proxyClient.SendFrameBufferUpdateRequest(0, 0, width, height, false)
 
 	if !m.isConnected {
@@ -102,8 +422,11 @@ func (m *Multiplexer) initProxyClient(factory ClientFactory) error {
 }
 
 func (m *Multiplexer) initProxyServer(factory ServerFactory) error {
-	width := m.proxyClient.GetFrameBufferWidth()
-	height := m.proxyClient.GetFrameBufferHeight()
+	width, height := m.defaultWidth, m.defaultHeight
+	if m.proxyClient != nil && m.proxyClient.IsConnected() {
+		width = m.proxyClient.GetFrameBufferWidth()
+		height = m.proxyClient.GetFrameBufferHeight()
+	}
 
 	if factory == nil {
 		factory = defaultServerFactory
@@ -114,38 +437,96 @@ func (m *Multiplexer) initProxyServer(factory ServerFactory) error {
 		return err
 	}
 	m.proxyServer = server
+	m.setSize(width, height)
 
 	m.proxyServer.SetPort(m.listenPort)
-	m.proxyServer.SetStandardPixelFormat()
+	m.proxyServer.SetPixelFormat(m.pixelFormat)
+	if err := m.proxyServer.SetSharingPolicy(m.SharingPolicy()); err != nil {
+		return err
+	}
 
 	if err := m.proxyServer.InitServer(); err != nil {
 		return fmt.Errorf("failed to initialize VNC server: %w", err)
 	}
 
-	log.Printf("Proxy server initialized and listening on port %d.", m.listenPort)
+	if m.listenPort > 0 {
+		m.logger.Printf("Proxy server initialized and listening on port %d.", m.listenPort)
+	} else {
+		m.logger.Println("Proxy server initialized.")
+	}
+
+	if m.mdns != nil {
+		m.mdns.Update(m.mdnsService())
+	}
 	return nil
 }
 
-func (m *Multiplexer) setupHandlers() {
-	m.proxyServer.SetPointerEventHandler(m.handlePointerEvent)
-	m.proxyServer.SetKeyEventHandler(m.handleKeyEvent)
+// EnableMDNS advertises the proxy server as an _rfb._tcp service named
+// instance. The announcement follows target resizes and stops on Close.
+func (m *Multiplexer) EnableMDNS(instance string, opts MDNSOptions) error {
+	if instance == "" {
+		instance = m.endpointList()[0].Host
+		if m.targets != nil {
+			instance = m.targetID
+		}
+	}
+	m.mdnsInstance = instance
 
-	m.proxyClient.SetGotFrameBufferUpdateHandler(m.handleFramebufferUpdate)
+	if m.mdns != nil {
+		m.mdns.Update(m.mdnsService())
+		return nil
+	}
+	advertiser, err := AdvertiseMDNS(m.mdnsService(), opts)
+	if err != nil {
+		return err
+	}
+	m.mdns = advertiser
+	return nil
 }
 
-func (m *Multiplexer) handlePointerEvent(buttonMask, x, y int, clientPtr unsafe.Pointer) {
-	if m.proxyClient.IsConnected() {
-		m.proxyClient.SendPointerEvent(x, y, uint8(buttonMask))
+func (m *Multiplexer) mdnsService() MDNSService {
+	service := MDNSService{
+		Instance:     m.mdnsInstance,
+		Port:         m.listenPort,
+		AuthRequired: len(m.credentials) > 0,
 	}
+	if m.proxyServer != nil {
+		service.Width = m.proxyServer.GetWidth()
+		service.Height = m.proxyServer.GetHeight()
+	}
+	return service
 }
 
-func (m *Multiplexer) handleKeyEvent(down bool, key uint32, clientPtr unsafe.Pointer) {
-	if m.proxyClient.IsConnected() {
-		m.proxyClient.SendKeyEvent(key, down)
+func (m *Multiplexer) setupHandlers() {
+	m.proxyServer.SetPointerEventHandler(m.handlePointerEvent)
+	m.proxyServer.SetKeyEventHandler(m.handleKeyEvent)
+	m.proxyServer.SetNewClientHandler(m.handleViewerJoined)
+	m.proxyServer.SetClientGoneHandler(m.handleViewerLeft)
+	m.proxyServer.SetCutTextHandler(m.handleViewerCutText)
+	if len(m.credentials) > 0 {
+		m.proxyServer.SetPasswordCheckHandler(m.handlePasswordCheck)
+	}
+
+	if m.proxyClient != nil {
+		m.proxyClient.SetGotFrameBufferUpdateHandler(m.handleFramebufferUpdate)
+		m.proxyClient.SetGotCutTextHandler(m.handleTargetCutText)
 	}
 }
 
 func (m *Multiplexer) handleFramebufferUpdate(x, y, w, h int) {
+	m.lastUpstreamUpdate.Store(time.Now().UnixNano())
+	m.copyFromTarget(x, y, w, h)
+	if m.sessionBannerCovers(y, h) {
+		m.drawSessionOverlay()
+	}
+	if m.pointersDirty.Swap(false) || m.viewerPointersCover(x, y, w, h) {
+		m.redrawViewerPointers()
+	}
+}
+
+// copyFromTarget copies a rectangle of the target's framebuffer to the proxy
+// server and marks it modified.
+func (m *Multiplexer) copyFromTarget(x, y, w, h int) {
 	if m.proxyServer == nil {
 		return
 	}
@@ -173,29 +554,14 @@ func (m *Multiplexer) handleFramebufferUpdate(x, y, w, h int) {
 	m.proxyServer.MarkRectAsModified(x, y, w, h)
 }
 
-func (m *Multiplexer) drawDisconnectedScreen() {
+// AttachViewer hands an already accepted viewer connection to the proxy
+// server, e.g. one routed by a Gateway.
+func (m *Multiplexer) AttachViewer(conn net.Conn) error {
 	if m.proxyServer == nil {
-		return
-	}
-	width := m.proxyServer.GetWidth()
-	height := m.proxyServer.GetHeight()
-	serverFB := m.proxyServer.GetFrameBuffer()
-
-	img := image.NewRGBA(image.Rect(0, 0, width, height))
-	draw.Draw(img, img.Bounds(), &image.Uniform{color.Black}, image.Point{}, draw.Src)
-
-	for y := 0; y < height; y++ {
-		for x := 0; x < width; x++ {
-			r, g, b, a := img.At(x, y).RGBA()
-			offset := (y*width + x) * 4
-			serverFB[offset] = byte(b >> 8)
-			serverFB[offset+1] = byte(g >> 8)
-			serverFB[offset+2] = byte(r >> 8)
-			serverFB[offset+3] = byte(a >> 8)
-		}
+		conn.Close()
+		return fmt.Errorf("proxy server not running")
 	}
-
-	m.proxyServer.MarkRectAsModified(0, 0, width, height)
+	return m.proxyServer.AttachConn(conn)
 }
 
 func (m *Multiplexer) GetRGBData() ([]byte, int, int) {
@@ -208,14 +574,15 @@ func (m *Multiplexer) GetRGBData() ([]byte, int, int) {
 	height := m.proxyServer.GetHeight()
 
 	rgbData := make([]byte, width*height*3)
+	r, g, b := colourOffsets(m.pixelFormat)
 
 	for y := 0; y < height; y++ {
 		for x := 0; x < width; x++ {
 			offset := (y*width + x) * 3
 			fbOffset := (y*width + x) * 4
-			rgbData[offset] = serverFB[fbOffset]
-			rgbData[offset+1] = serverFB[fbOffset+1]
-			rgbData[offset+2] = serverFB[fbOffset+2]
+			rgbData[offset] = serverFB[fbOffset+r]
+			rgbData[offset+1] = serverFB[fbOffset+g]
+			rgbData[offset+2] = serverFB[fbOffset+b]
 		}
 	}
 
@@ -223,9 +590,9 @@ func (m *Multiplexer) GetRGBData() ([]byte, int, int) {
 }
 
 // startProxyServerLoop launches the event loop for the currently configured
-// proxyServer in a dedicated goroutine. The loop terminates when either the
-// serverLoopStop channel is closed or the proxyServer.RunEventLoop returns.
-func (m *Multiplexer) startProxyServerLoop() {
+// proxyServer in a dedicated goroutine. The loop terminates when ctx is
+// cancelled, stopProxyServerLoop is called or proxyServer.Serve returns.
+func (m *Multiplexer) startProxyServerLoop(ctx context.Context) {
 	if m.proxyServer == nil {
 		return
 	}
@@ -233,51 +600,160 @@ func (m *Multiplexer) startProxyServerLoop() {
 	// Ensure any previous loop is stopped
 	m.stopProxyServerLoop()
 
-	m.serverLoopStop = make(chan struct{})
+	loopCtx, cancel := context.WithCancel(ctx)
+	m.serverLoopCancel = cancel
 	m.runningWG.Add(1)
-	go func(srv ServerPort, stop <-chan struct{}) {
+	go func(srv ServerPort) {
 		defer m.runningWG.Done()
-		log.Println("Proxy server event loop started.")
-		doneCh := make(chan struct{})
-		go func() {
-			_ = srv.RunEventLoop(10) // blocks until srv.Stop() / Close()
-			close(doneCh)
-		}()
-
-		select {
-		case <-stop:
-			srv.Stop()
-		case <-doneCh:
-			// server finished on its own
+		m.logger.Println("Proxy server event loop started.")
+		if err := srv.Serve(loopCtx); err != nil && loopCtx.Err() == nil {
+			m.logger.Printf("Proxy server event loop error: %v", err)
 		}
-		log.Println("Proxy server event loop stopped.")
-	}(m.proxyServer, m.serverLoopStop)
+		m.logger.Println("Proxy server event loop stopped.")
+	}(m.proxyServer)
 }
 
 // stopProxyServerLoop requests the currently running proxyServer event loop to
 // stop and waits for the goroutine to terminate.
 func (m *Multiplexer) stopProxyServerLoop() {
-	if m.serverLoopStop != nil {
-		select {
-		case <-m.serverLoopStop:
-		default:
-			close(m.serverLoopStop)
-		}
+	if m.serverLoopCancel != nil {
+		m.serverLoopCancel()
 		m.runningWG.Wait()
-		m.serverLoopStop = nil
+		m.serverLoopCancel = nil
 	}
 }
 
-func (m *Multiplexer) Run() {
-	log.Println("Starting VNC multiplexer...")
+// Run proxies the target to viewers, reconnecting whenever the target drops,
+// until ctx is cancelled or the reconnect policy gives up. It then stops the
+// proxy server loop and returns ctx.Err() or an error wrapping
+// ErrReconnectGaveUp; the multiplexer still has to be closed with Close.
+func (m *Multiplexer) Run(ctx context.Context) error {
+	m.mu.Lock()
+	if m.isShuttingDown() {
+		m.mu.Unlock()
+		return ErrMultiplexerClosed
+	}
+	if m.running {
+		m.mu.Unlock()
+		return fmt.Errorf("multiplexer is already running")
+	}
+	m.running = true
+	m.clientStopped = make(chan struct{})
+	m.mu.Unlock()
+
+	m.logger.Println("Starting VNC multiplexer...")
 
+	// Shutdown only stops the upstream side right away; the proxy server loop
+	// keeps running on ctx so pending updates can still be drained.
+	clientCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-m.shuttingDown:
+			cancel()
+		case <-clientCtx.Done():
+		}
+	}()
+
+	err := m.run(clientCtx, ctx)
+	close(m.clientStopped)
+
+	if m.isShuttingDown() {
+		<-m.shutdownDone
+		return nil
+	}
+	m.stopProxyServerLoop()
+
+	m.mu.Lock()
+	m.running = false
+	m.mu.Unlock()
+	return err
+}
+
+func (m *Multiplexer) run(ctx context.Context, serverCtx context.Context) error {
 	// start initial server loop
-	m.startProxyServerLoop()
+	m.startProxyServerLoop(serverCtx)
+
+	state := StateReconnecting
+	if m.proxyClient == nil {
+		state = StateConnecting
+	}
+	// why the previous connection ended
+	var cause error
 
 	for {
-		log.Println("Proxy client event loop started.")
-		if err := m.proxyClient.RunEventLoop(1); err != nil {
-			log.Printf("Proxy client event loop error: %v", err)
+		// runCtx covers connecting to and proxying one target; SetTarget
+		// cancels it to move on to another
+		runCtx, interrupt := context.WithCancelCause(ctx)
+		m.setInterruptUpstream(interrupt)
+
+		if m.proxyClient == nil || !m.proxyClient.IsConnected() {
+			if m.onDemand {
+				if err := m.waitForViewer(ctx); err != nil {
+					interrupt(nil)
+					return err
+				}
+			}
+
+			// Keep proxyServer running and show the placeholder to connected
+			// (and future) viewers while we (re-)establish the connection to
+			// the target server. After a target switch the last frame stays.
+			stopPlaceholder := func() {}
+			if cause != ErrTargetSwitched {
+				if cause == ErrNoViewers {
+					cause = nil
+				}
+				m.setReconnectStatus(0, cause, time.Time{})
+				stopPlaceholder = m.showPlaceholder(runCtx)
+			}
+
+			err := m.reconnect(runCtx, state, cause)
+			stopPlaceholder()
+			if err != nil {
+				m.setInterruptUpstream(nil)
+				interrupt(nil)
+				if ctx.Err() == nil && runCtx.Err() != nil {
+					// target switched while connecting; start over
+					cause = ErrTargetSwitched
+					continue
+				}
+				return err
+			}
+			m.resumeProxying(serverCtx)
+		}
+		state = StateReconnecting
+
+		if m.failBack && m.endpointIndex() != 0 {
+			go m.watchPrimary(runCtx, interrupt)
+		}
+		if m.onDemand {
+			go m.watchIdle(runCtx, interrupt)
+		}
+		if m.heartbeatInterval > 0 {
+			go m.watchHeartbeat(runCtx, interrupt)
+		}
+
+		m.logger.Println("Proxy client event loop started.")
+		cause = m.proxyClient.Run(runCtx)
+		if cause != nil && runCtx.Err() == nil {
+			m.logger.Printf("Proxy client event loop error: %v", cause)
+		}
+		interrupted := runCtx.Err() != nil
+		m.setInterruptUpstream(nil)
+		interrupt(nil)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if interrupted {
+			cause = context.Cause(runCtx)
+			// the old target is still connected; let go of its keys
+			m.releaseHeldInput()
+		} else {
+			if cause == nil {
+				cause = ErrTargetDisconnected
+			}
+			// owed to the target once it is back
+			m.releaseHeldInput()
 		}
 
 		// Client connection lost here
@@ -289,56 +765,145 @@ func (m *Multiplexer) Run() {
 				m.onConnectionOffline()
 			}
 		}
+		m.setState(StateOffline, cause, 0)
+	}
+}
 
-		// Keep proxyServer running; just show disconnected screen to currently
-		// connected viewers (and future viewers) so they can still connect.
-		if m.proxyServer != nil {
-			m.drawDisconnectedScreen()
-		}
+// setInterruptUpstream records how SetTarget can interrupt the upstream
+// connection or connection attempt in progress.
+func (m *Multiplexer) setInterruptUpstream(interrupt context.CancelCauseFunc) {
+	m.mu.Lock()
+	m.interruptUpstream = interrupt
+	m.mu.Unlock()
+}
 
-		// Re-establish connection to the target server (proxyClient)
-		for {
-			log.Println("Attempting to reconnect to target server...")
-			if err := m.initProxyClient(m.clientFactory); err == nil {
-				break
-			}
-			time.Sleep(5 * time.Second)
-		}
+// resumeProxying fits the proxy server to the freshly connected target and
+// goes online.
+func (m *Multiplexer) resumeProxying(serverCtx context.Context) {
+	width := m.proxyClient.GetFrameBufferWidth()
+	height := m.proxyClient.GetFrameBufferHeight()
 
-		// If framebuffer size changed, we need a new server; detect and recreate
-		if m.proxyServer != nil {
-			if m.proxyServer.GetWidth() != m.proxyClient.GetFrameBufferWidth() || m.proxyServer.GetHeight() != m.proxyClient.GetFrameBufferHeight() {
-				log.Println("Framebuffer size changed, recreating proxy server.")
+	if m.proxyServer == nil {
+		// if server was nil for some reason (first startup), create one
+		if err := m.initProxyServer(m.serverFactory); err != nil {
+			m.logger.Printf("Failed to recreate proxy server: %v", err)
+		}
+	} else if m.proxyServer.GetWidth() != width || m.proxyServer.GetHeight() != height {
+		m.logger.Printf("Framebuffer size changed to %dx%d, resizing proxy server.", width, height)
+		m.setState(StateResizing, nil, 0)
 
-				// safely stop old server loop and close screen
-				m.stopProxyServerLoop()
-				m.proxyServer.Close()
+		if err := m.proxyServer.Resize(width, height); err != nil {
+			m.logger.Printf("Failed to resize proxy server, recreating it: %v", err)
 
-				if err := m.initProxyServer(m.serverFactory); err != nil {
-					log.Printf("Failed to recreate proxy server: %v", err)
-					// fall back to continuing with old server (though closed) - try next loop
-					continue
-				}
+			// safely stop old server loop and close screen
+			m.stopProxyServerLoop()
+			m.proxyServer.Close()
+			m.proxyServer = nil
 
-				m.startProxyServerLoop()
-			}
-		} else {
-			// if server was nil for some reason (first startup), create one
 			if err := m.initProxyServer(m.serverFactory); err != nil {
-				log.Printf("Failed to recreate proxy server: %v", err)
-			} else {
-				m.startProxyServerLoop()
+				m.logger.Printf("Failed to recreate proxy server: %v", err)
 			}
+		} else if m.mdns != nil {
+			m.mdns.Update(m.mdnsService())
 		}
+	}
 
+	if m.proxyServer != nil {
 		// reset handlers for new client or server
 		m.setupHandlers()
 
-		// ensure server event loop is running (idempotent)
-		m.startProxyServerLoop()
+		// ensure server event loop is running
+		if m.serverLoopCancel == nil {
+			m.startProxyServerLoop(serverCtx)
+		}
+	}
+	m.flushPendingRelease()
+	m.redrawPendingPointers()
+	m.setState(StateOnline, nil, 0)
+}
+
+// reconnect retries initProxyClient as the reconnect policy dictates until
+// it succeeds, the policy gives up or ctx is cancelled.
+func (m *Multiplexer) reconnect(ctx context.Context, state MultiplexerState, cause error) error {
+	// a retry requested while still online is moot
+	select {
+	case <-m.retryNow:
+	default:
+	}
+
+	// a stalled endpoint still accepts connections, so start with the next
+	// one and only come back to it once the others failed
+	first := m.firstEndpoint()
+	if cause == ErrTargetStalled {
+		first = m.endpointIndex() + 1
+	}
+
+	var lastErr error
+	status := cause
+	for attempt := 1; ; attempt++ {
+		if lastErr != nil {
+			status = lastErr
+		}
+		m.setReconnectStatus(attempt, status, time.Time{})
+		if m.onReconnectAttempt != nil {
+			m.onReconnectAttempt(attempt, lastErr)
+		}
+		m.logger.Printf("Attempting to reconnect to target server (attempt %d)...", attempt)
+		lastErr = m.connectEndpoints(ctx, first, state, attempt, lastErr)
+		if lastErr == nil {
+			m.setReconnectStatus(0, nil, time.Time{})
+			return nil
+		}
+		first = m.firstEndpoint()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		delay, ok := m.reconnectPolicy.NextDelay(attempt, lastErr)
+		if !ok {
+			m.logger.Printf("Giving up reconnecting after %d attempts: %v", attempt, lastErr)
+			if m.onReconnectGiveUp != nil {
+				m.onReconnectGiveUp(attempt, lastErr)
+			}
+			err := fmt.Errorf("%w after %d attempts: %v", ErrReconnectGaveUp, attempt, lastErr)
+			m.setReconnectStatus(attempt, err, time.Time{})
+			m.setState(StateOffline, err, attempt)
+			return err
+		}
+		m.logger.Printf("Reconnect attempt %d failed: %v; retrying in %s", attempt, lastErr, delay.Round(time.Millisecond))
+		m.setReconnectStatus(attempt, lastErr, time.Now().Add(delay))
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-m.retryNow:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// RetryNow cuts the current reconnect wait short so the next attempt is made
+// immediately, e.g. when the caller knows the target is back up. It has no
+// effect while the target is connected.
+func (m *Multiplexer) RetryNow() {
+	select {
+	case m.retryNow <- struct{}{}:
+	default:
 	}
 }
 
+// SetReconnectPolicy replaces the policy used for subsequent reconnect
+// attempts; nil restores DefaultReconnectPolicy.
+func (m *Multiplexer) SetReconnectPolicy(policy ReconnectPolicy) {
+	if policy == nil {
+		policy = DefaultReconnectPolicy
+	}
+	m.reconnectPolicy = policy
+}
+
 func (m *Multiplexer) SetConnectionOnlineCallback(callback func()) {
 	m.onConnectionOnline = callback
 }
@@ -348,7 +913,7 @@ func (m *Multiplexer) SetConnectionOfflineCallback(callback func()) {
 }
 
 func (m *Multiplexer) RefreshVnc() {
-	log.Println("RefreshVnc requested - recreating target connection")
+	m.logger.Println("RefreshVnc requested - recreating target connection")
 	if m.proxyClient != nil {
 		m.proxyClient.Close()
 	}
@@ -361,8 +926,83 @@ func (m *Multiplexer) RefreshVnc() {
 	}
 }
 
+// SetShutdownMessage sets the text of the maintenance screen Shutdown shows
+// viewers before disconnecting them. With no message Shutdown leaves the
+// last frame in place.
+func (m *Multiplexer) SetShutdownMessage(message string) {
+	m.shutdownMessage = message
+}
+
+// Shutdown gracefully stops the multiplexer: it stops accepting viewers,
+// releases keys and buttons viewers hold on the target, stops the upstream
+// connection, shows the maintenance screen (see SetShutdownMessage), waits
+// until pending updates have reached the viewers, then closes everything and
+// makes Run return nil. If ctx expires first the remaining steps are cut
+// short and ctx.Err() is returned.
+func (m *Multiplexer) Shutdown(ctx context.Context) error {
+	return m.shutdown(ctx, true)
+}
+
+// Close tears the multiplexer down immediately, making Run return.
 func (m *Multiplexer) Close() {
-	log.Println("Closing multiplexer...")
+	m.shutdown(context.Background(), false)
+}
+
+func (m *Multiplexer) isShuttingDown() bool {
+	select {
+	case <-m.shuttingDown:
+		return true
+	default:
+		return false
+	}
+}
+
+func (m *Multiplexer) shutdown(ctx context.Context, graceful bool) error {
+	first := false
+	m.shutdownOnce.Do(func() {
+		first = true
+	})
+	if !first {
+		select {
+		case <-m.shutdownDone:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if graceful {
+		m.logger.Println("Shutting down multiplexer...")
+	} else {
+		m.logger.Println("Closing multiplexer...")
+	}
+
+	m.mu.Lock()
+	close(m.shuttingDown)
+	running := m.running
+	m.mu.Unlock()
+	m.setState(StateShuttingDown, nil, 0)
+
+	if m.proxyServer != nil {
+		m.proxyServer.StopListening()
+	}
+
+	// wait for Run to let go of the upstream connection
+	if running {
+		<-m.clientStopped
+	}
+	m.releaseHeldInput()
+
+	var err error
+	if graceful && m.proxyServer != nil {
+		if m.shutdownMessage != "" {
+			m.drawMaintenanceScreen()
+		}
+		if m.serverLoopCancel == nil {
+			m.startProxyServerLoop(context.Background())
+		}
+		err = m.drainViewers(ctx)
+	}
 
 	// stop server loop first to avoid use-after-free
 	m.stopProxyServerLoop()
@@ -375,4 +1015,69 @@ func (m *Multiplexer) Close() {
 		m.proxyServer.Close()
 		m.proxyServer = nil
 	}
+
+	if m.targets != nil {
+		m.targets.unregister(m.targetID)
+	}
+
+	if m.mdns != nil {
+		m.mdns.Close()
+		m.mdns = nil
+	}
+
+	m.closeAudit()
+
+	if m.isConnected {
+		m.isConnected = false
+		if m.onConnectionOffline != nil {
+			m.onConnectionOffline()
+		}
+	}
+
+	m.mu.Lock()
+	m.running = false
+	m.mu.Unlock()
+	m.setState(StateClosed, nil, 0)
+	close(m.shutdownDone)
+	return err
+}
+
+// shutdownDrainTimeout caps how long Shutdown waits for viewers to receive
+// the final picture, so a viewer that stopped reading cannot hold it up.
+const shutdownDrainTimeout = 5 * time.Second
+
+// drainViewers waits until every viewer has received the pending
+// framebuffer changes, ctx expires or shutdownDrainTimeout passes.
+func (m *Multiplexer) drainViewers(ctx context.Context) error {
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.NewTimer(shutdownDrainTimeout)
+	defer timeout.Stop()
+
+	for m.proxyServer.HasPendingUpdates() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout.C:
+			m.logger.Printf("Viewers did not take the final picture within %s, closing anyway.", shutdownDrainTimeout)
+			return nil
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+func (m *Multiplexer) drawMaintenanceScreen() {
+	m.drawMessage(maintenanceBackground, strings.Split(m.shutdownMessage, "\n"))
+}
+
+// drawMessage replaces the proxy framebuffer with lines of text on bg.
+func (m *Multiplexer) drawMessage(bg color.Color, lines []string) {
+	img := frameBufferImage(m.proxyServer.GetFrameBuffer(), m.proxyServer.GetWidth(), m.proxyServer.GetHeight())
+	if img == nil {
+		return
+	}
+	drawMessageScreen(img, bg, lines)
+	convertFromStandard(img.Pix, m.pixelFormat)
+	m.proxyServer.MarkRectAsModified(0, 0, img.Rect.Dx(), img.Rect.Dy())
 }
@@ -0,0 +1,193 @@
+package vnc
+
+import (
+	"math/bits"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// auditInput is a viewer's input activity not yet written to the audit log.
+type auditInput struct {
+	start    time.Time
+	keys     strings.Builder
+	keyCount int
+	clicks   int
+	moves    int
+	masked   bool
+}
+
+// SetAuditMasking masks typed text in the audit log while masked is set,
+// e.g. while a password field has focus on the target.
+func (m *Multiplexer) SetAuditMasking(masked bool) {
+	m.auditMu.Lock()
+	defer m.auditMu.Unlock()
+	m.auditMasked = masked
+}
+
+func (m *Multiplexer) audit(event AuditEvent) {
+	if m.auditLog == nil {
+		return
+	}
+	event.Target = m.targetName()
+	if err := m.auditLog.Write(event); err != nil {
+		m.logger.Printf("Failed to write audit log: %v", err)
+	}
+}
+
+func (m *Multiplexer) auditClipboard(v *viewer, direction, text string) {
+	if m.auditLog == nil {
+		return
+	}
+
+	event := AuditEvent{Type: "clipboard", Direction: direction, Length: utf8.RuneCountInString(text)}
+	if v != nil {
+		event.Viewer = v.id
+	}
+	m.auditMu.Lock()
+	masked := m.auditMasked
+	m.auditMu.Unlock()
+	if m.auditLog.cfg.ClipboardText && !masked {
+		event.Text = text
+	}
+	m.audit(event)
+}
+
+// auditKey records a key press by v, which holds held.
+func (m *Multiplexer) auditKey(v *viewer, key uint32, held map[uint32]bool) {
+	if m.auditLog == nil || isModifierKeysym(key) {
+		return
+	}
+
+	m.auditMu.Lock()
+	defer m.auditMu.Unlock()
+
+	input := m.pendingAuditInput(v)
+	input.keyCount++
+	switch {
+	case m.auditLog.cfg.Keystrokes == KeystrokesCount:
+	case m.auditLog.cfg.Keystrokes == KeystrokesMasked || m.auditMasked:
+		input.keys.WriteByte('*')
+		input.masked = true
+	default:
+		input.keys.WriteString(auditKeyText(key, held))
+	}
+}
+
+// auditPointer records a pointer event by v that changed its buttons from
+// previous to buttonMask.
+func (m *Multiplexer) auditPointer(v *viewer, previous, buttonMask uint8) {
+	if m.auditLog == nil {
+		return
+	}
+
+	m.auditMu.Lock()
+	defer m.auditMu.Unlock()
+
+	input := m.pendingAuditInput(v)
+	if pressed := buttonMask &^ previous; pressed != 0 {
+		input.clicks += bits.OnesCount8(pressed)
+	} else if buttonMask == previous {
+		input.moves++
+	}
+}
+
+func (m *Multiplexer) pendingAuditInput(v *viewer) *auditInput {
+	input := m.auditPending[v]
+	if input == nil {
+		input = &auditInput{start: time.Now()}
+		m.auditPending[v] = input
+	}
+	return input
+}
+
+// flushAuditInput writes the input activity of v, or of every viewer if v
+// is nil, that is older than age.
+func (m *Multiplexer) flushAuditInput(v *viewer, age time.Duration) {
+	if m.auditLog == nil {
+		return
+	}
+
+	m.auditMu.Lock()
+	var events []AuditEvent
+	for pending, input := range m.auditPending {
+		if (v != nil && pending != v) || time.Since(input.start) < age {
+			continue
+		}
+		delete(m.auditPending, pending)
+		events = append(events, AuditEvent{
+			Time:     input.start,
+			Type:     "input",
+			Viewer:   pending.id,
+			Keys:     input.keys.String(),
+			KeyCount: input.keyCount,
+			Clicks:   input.clicks,
+			Moves:    input.moves,
+			Masked:   input.masked,
+		})
+	}
+	m.auditMu.Unlock()
+
+	for _, event := range events {
+		m.audit(event)
+	}
+}
+
+// runAuditFlusher writes coalesced input activity every flush interval
+// until the multiplexer shuts down.
+func (m *Multiplexer) runAuditFlusher() {
+	defer close(m.auditDone)
+
+	interval := time.Duration(m.auditLog.cfg.FlushInterval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.shuttingDown:
+			return
+		case <-ticker.C:
+			m.flushAuditInput(nil, interval)
+		}
+	}
+}
+
+// closeAudit writes what is left and closes the audit log.
+func (m *Multiplexer) closeAudit() {
+	if m.auditLog == nil {
+		return
+	}
+	<-m.auditDone
+	m.flushAuditInput(nil, 0)
+	if err := m.auditLog.Close(); err != nil {
+		m.logger.Printf("Failed to close audit log: %v", err)
+	}
+}
+
+func isModifierKeysym(key uint32) bool {
+	return key >= 0xffe1 && key <= 0xffee
+}
+
+// auditKeyText renders a key press as typed text, or as a <Name> token for
+// special keys and shortcuts.
+func auditKeyText(key uint32, held map[uint32]bool) string {
+	var modifiers []string
+	for _, modifier := range []string{"Ctrl", "Alt", "Meta", "Super"} {
+		for _, keysym := range keysymNames[modifier] {
+			if held[keysym] {
+				modifiers = append(modifiers, modifier)
+				break
+			}
+		}
+	}
+
+	printable := (key >= 0x20 && key <= 0x7e) || (key >= 0xa0 && key <= 0xff)
+	if printable && len(modifiers) == 0 {
+		return string(rune(key))
+	}
+
+	name := keysymName(key)
+	if printable {
+		name = string(rune(key))
+	}
+	return "<" + strings.Join(append(modifiers, name), "+") + ">"
+}
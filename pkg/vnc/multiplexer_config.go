@@ -0,0 +1,437 @@
+package vnc
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	DefaultTargetPort       = 5900
+	DefaultWidth            = 1024
+	DefaultHeight           = 768
+	DefaultConnectTimeout   = 10 * time.Second
+	DefaultFailBackInterval = 30 * time.Second
+	DefaultOnDemandGrace    = 30 * time.Second
+	DefaultHeartbeatTimeout = 5 * time.Second
+	// DefaultControlIdleTimeout is how long a controller may stay idle
+	// before losing control in ControlFirstCome and ControlQueue modes.
+	DefaultControlIdleTimeout = 30 * time.Second
+)
+
+// MultiplexerConfig holds everything needed to build a Multiplexer. The
+// serialisable part can be loaded from JSON or YAML with
+// LoadMultiplexerConfig; callbacks, factories, the logger and the target
+// listener can only be set from Go.
+type MultiplexerConfig struct {
+	// TargetHost and TargetPort locate the VNC server to proxy. TargetPort
+	// defaults to DefaultTargetPort.
+	TargetHost     string `json:"targetHost,omitempty" yaml:"targetHost,omitempty"`
+	TargetPort     int    `json:"targetPort,omitempty" yaml:"targetPort,omitempty"`
+	TargetPassword string `json:"targetPassword,omitempty" yaml:"targetPassword,omitempty"`
+
+	// Endpoints are standby targets tried in order after TargetHost when it
+	// is unreachable; with no TargetHost the first endpoint is the primary.
+	// Ports default to DefaultTargetPort and passwords to TargetPassword.
+	Endpoints []TargetEndpoint `json:"endpoints,omitempty" yaml:"endpoints,omitempty"`
+	// FailBack returns to the primary as soon as it accepts connections
+	// again, probing it every FailBackInterval (default
+	// DefaultFailBackInterval) while a standby is in use. Without it the
+	// multiplexer stays on whichever endpoint works.
+	FailBack         bool     `json:"failBack,omitempty" yaml:"failBack,omitempty"`
+	FailBackInterval Duration `json:"failBackInterval,omitempty" yaml:"failBackInterval,omitempty"`
+	// ConnectTimeout bounds each connection attempt so a hung endpoint is
+	// failed over (default DefaultConnectTimeout).
+	ConnectTimeout Duration `json:"connectTimeout,omitempty" yaml:"connectTimeout,omitempty"`
+
+	// Targets switches to dial-home mode: instead of dialing TargetHost the
+	// multiplexer waits for the target identified by TargetID to connect in.
+	Targets  *TargetListener `json:"-" yaml:"-"`
+	TargetID string          `json:"targetID,omitempty" yaml:"targetID,omitempty"`
+
+	// ListenPort is the port viewers connect to; 0 disables listening so
+	// viewers can only be attached with AttachViewer.
+	ListenPort int `json:"listenPort" yaml:"listenPort"`
+
+	// Lazy starts the proxy server right away with a DefaultWidth x
+	// DefaultHeight "waiting for target" screen and connects to the target
+	// in Run, instead of failing construction when it is unreachable. The
+	// proxy server is resized to the target once connected.
+	Lazy          bool `json:"lazy,omitempty" yaml:"lazy,omitempty"`
+	DefaultWidth  int  `json:"defaultWidth,omitempty" yaml:"defaultWidth,omitempty"`
+	DefaultHeight int  `json:"defaultHeight,omitempty" yaml:"defaultHeight,omitempty"`
+
+	// KeepAlive is the TCP keepalive period of the target connection; zero
+	// keeps Go's default and a negative value disables keepalives.
+	KeepAlive Duration `json:"keepAlive,omitempty" yaml:"keepAlive,omitempty"`
+	// HeartbeatInterval enables a heartbeat: every interval the target is
+	// asked for a non-incremental 1x1 update, and if nothing arrives within
+	// HeartbeatTimeout (default DefaultHeartbeatTimeout) the multiplexer
+	// goes to StateStalled until the target answers again. A target stalled
+	// for StallTimeout is dropped like a broken connection; zero waits
+	// forever. StaleOverlay marks the picture as stale for viewers while
+	// stalled.
+	HeartbeatInterval Duration `json:"heartbeatInterval,omitempty" yaml:"heartbeatInterval,omitempty"`
+	HeartbeatTimeout  Duration `json:"heartbeatTimeout,omitempty" yaml:"heartbeatTimeout,omitempty"`
+	StallTimeout      Duration `json:"stallTimeout,omitempty" yaml:"stallTimeout,omitempty"`
+	StaleOverlay      bool     `json:"staleOverlay,omitempty" yaml:"staleOverlay,omitempty"`
+
+	// OnDemand connects to the target only when the first viewer has
+	// authenticated and disconnects once the last one has been gone for
+	// OnDemandGrace
+	// (default DefaultOnDemandGrace). It implies Lazy; after an idle
+	// disconnect the last frame is served until the target is back.
+	OnDemand      bool     `json:"onDemand,omitempty" yaml:"onDemand,omitempty"`
+	OnDemandGrace Duration `json:"onDemandGrace,omitempty" yaml:"onDemandGrace,omitempty"`
+
+	// Credentials, if any, make viewers authenticate with one of the
+	// passwords and grant them its role; otherwise viewers need no password
+	// and get DefaultRole (default RoleFull), which is also the role of
+	// credentials without one. Authorize, if set, is asked for the final
+	// role of every authenticated viewer and may refuse it.
+	Credentials []ViewerCredential `json:"credentials,omitempty" yaml:"credentials,omitempty"`
+	DefaultRole ViewerRole         `json:"defaultRole,omitempty" yaml:"defaultRole,omitempty"`
+	Authorize   ViewerAuthorizer   `json:"-" yaml:"-"`
+
+	// InputPolicy declares viewer input that is dropped before it reaches
+	// the target; InputFilters then run in order, see AddInputFilter.
+	InputPolicy  InputPolicy   `json:"inputPolicy,omitempty" yaml:"inputPolicy,omitempty"`
+	InputFilters []InputFilter `json:"-" yaml:"-"`
+
+	// Audit, if set, writes an audit log of viewer sessions and activity.
+	Audit *AuditConfig `json:"audit,omitempty" yaml:"audit,omitempty"`
+
+	// SessionLimits disconnect idle viewers and end sessions after a
+	// maximum duration, warning all viewers with a banner first.
+	// RoleSessionLimits replaces them for the roles it lists.
+	SessionLimits     SessionLimits                `json:"sessionLimits,omitempty" yaml:"sessionLimits,omitempty"`
+	RoleSessionLimits map[ViewerRole]SessionLimits `json:"roleSessionLimits,omitempty" yaml:"roleSessionLimits,omitempty"`
+
+	// ViewerPointers draws every viewer's last pointer position with a
+	// coloured label, ViewerPointerLabel (default PointerLabelName), into
+	// the picture viewers receive. The target never sees it.
+	ViewerPointers     bool               `json:"viewerPointers,omitempty" yaml:"viewerPointers,omitempty"`
+	ViewerPointerLabel ViewerPointerLabel `json:"viewerPointerLabel,omitempty" yaml:"viewerPointerLabel,omitempty"`
+
+	// Sharing decides whether viewers asking for exclusive access
+	// disconnect, or are refused by, the viewers already connected.
+	Sharing SharingPolicy `json:"sharing,omitempty" yaml:"sharing,omitempty"`
+
+	// ControlMode decides whose input reaches the target when several
+	// viewers are connected (default ControlFree). ControlIdleTimeout
+	// (default DefaultControlIdleTimeout) applies to ControlFirstCome and
+	// ControlQueue.
+	ControlMode        ControlMode `json:"controlMode,omitempty" yaml:"controlMode,omitempty"`
+	ControlIdleTimeout Duration    `json:"controlIdleTimeout,omitempty" yaml:"controlIdleTimeout,omitempty"`
+
+	// PixelFormat used towards both target and viewers (default
+	// PixelFormatStandard). Only 32 bit true colour formats are supported.
+	PixelFormat *PixelFormat `json:"pixelFormat,omitempty" yaml:"pixelFormat,omitempty"`
+	// AppData sets encodings, compression and quality for the target
+	// connection; nil keeps libvncclient's defaults.
+	AppData *AppDataConfig `json:"appData,omitempty" yaml:"appData,omitempty"`
+
+	// Reconnect configures the backoff between reconnect attempts (default
+	// DefaultReconnectPolicy). A zero InitialInterval or Multiplier takes
+	// DefaultReconnectPolicy's, a zero Multiplier its MaxInterval too.
+	// ReconnectPolicy, if set, takes precedence.
+	Reconnect       *BackoffPolicy  `json:"reconnect,omitempty" yaml:"reconnect,omitempty"`
+	ReconnectPolicy ReconnectPolicy `json:"-" yaml:"-"`
+
+	// Placeholder is what viewers see while the target is not connected
+	// (default PlaceholderStatus).
+	Placeholder PlaceholderConfig `json:"placeholder,omitempty" yaml:"placeholder,omitempty"`
+
+	// ShutdownMessage is shown to viewers by Shutdown, see SetShutdownMessage.
+	ShutdownMessage string `json:"shutdownMessage,omitempty" yaml:"shutdownMessage,omitempty"`
+
+	Logger *log.Logger `json:"-" yaml:"-"`
+
+	// OnStateChange is subscribed with SubscribeState before connecting.
+	OnStateChange       func(StateEvent) `json:"-" yaml:"-"`
+	OnConnectionOnline  func()           `json:"-" yaml:"-"`
+	OnConnectionOffline func()           `json:"-" yaml:"-"`
+	// OnReconnectAttempt is called before each reconnect attempt with its
+	// number and the error of the previous attempt (nil for the first).
+	OnReconnectAttempt func(attempt int, lastErr error) `json:"-" yaml:"-"`
+	// OnReconnectGiveUp is called when the reconnect policy gives up, just
+	// before Run returns ErrReconnectGaveUp.
+	OnReconnectGiveUp func(attempts int, lastErr error) `json:"-" yaml:"-"`
+	// OnControlChange is subscribed with SubscribeControl.
+	OnControlChange func(ControlEvent) `json:"-" yaml:"-"`
+	// OnViewerChange is subscribed with SubscribeViewers.
+	OnViewerChange func(ViewerEvent) `json:"-" yaml:"-"`
+
+	ClientFactory ClientFactory `json:"-" yaml:"-"`
+	ServerFactory ServerFactory `json:"-" yaml:"-"`
+}
+
+// LoadMultiplexerConfig reads a configuration file, choosing YAML for .yaml
+// and .yml files and JSON otherwise.
+func LoadMultiplexerConfig(path string) (MultiplexerConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return MultiplexerConfig{}, err
+	}
+
+	var cfg MultiplexerConfig
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &cfg)
+	default:
+		err = json.Unmarshal(data, &cfg)
+	}
+	if err != nil {
+		return MultiplexerConfig{}, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// WithDefaults returns a copy of cfg with unset fields filled in.
+func (cfg MultiplexerConfig) WithDefaults() MultiplexerConfig {
+	if cfg.TargetPort == 0 && cfg.Targets == nil {
+		cfg.TargetPort = DefaultTargetPort
+	}
+	if len(cfg.Endpoints) > 0 {
+		endpoints := make([]TargetEndpoint, len(cfg.Endpoints))
+		for i, endpoint := range cfg.Endpoints {
+			if endpoint.Port == 0 {
+				endpoint.Port = DefaultTargetPort
+			}
+			if endpoint.Password == "" {
+				endpoint.Password = cfg.TargetPassword
+			}
+			endpoints[i] = endpoint
+		}
+		cfg.Endpoints = endpoints
+	}
+	if cfg.FailBackInterval <= 0 {
+		cfg.FailBackInterval = Duration(DefaultFailBackInterval)
+	}
+	if cfg.OnDemandGrace <= 0 {
+		cfg.OnDemandGrace = Duration(DefaultOnDemandGrace)
+	}
+	if cfg.DefaultRole == "" {
+		cfg.DefaultRole = RoleFull
+	}
+	if len(cfg.Credentials) > 0 {
+		credentials := make([]ViewerCredential, len(cfg.Credentials))
+		for i, credential := range cfg.Credentials {
+			if credential.Role == "" {
+				credential.Role = cfg.DefaultRole
+			}
+			credentials[i] = credential
+		}
+		cfg.Credentials = credentials
+	}
+	if cfg.ControlMode == "" {
+		cfg.ControlMode = ControlFree
+	}
+	if cfg.ControlIdleTimeout <= 0 {
+		cfg.ControlIdleTimeout = Duration(DefaultControlIdleTimeout)
+	}
+	if cfg.HeartbeatTimeout <= 0 {
+		cfg.HeartbeatTimeout = Duration(DefaultHeartbeatTimeout)
+	}
+	if cfg.ConnectTimeout <= 0 {
+		cfg.ConnectTimeout = Duration(DefaultConnectTimeout)
+	}
+	if cfg.DefaultWidth == 0 {
+		cfg.DefaultWidth = DefaultWidth
+	}
+	if cfg.DefaultHeight == 0 {
+		cfg.DefaultHeight = DefaultHeight
+	}
+	if cfg.PixelFormat == nil {
+		format := PixelFormatStandard
+		cfg.PixelFormat = &format
+	} else if cfg.PixelFormat.Depth == 0 {
+		format := *cfg.PixelFormat
+		format.Depth = 24
+		cfg.PixelFormat = &format
+	}
+	if cfg.ReconnectPolicy == nil {
+		if cfg.Reconnect != nil {
+			cfg.ReconnectPolicy = cfg.Reconnect.withDefaults()
+		} else {
+			cfg.ReconnectPolicy = DefaultReconnectPolicy
+		}
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = log.Default()
+	}
+	if cfg.ClientFactory == nil {
+		cfg.ClientFactory = defaultClientFactory
+	}
+	if cfg.ServerFactory == nil {
+		cfg.ServerFactory = defaultServerFactory
+	}
+	return cfg
+}
+
+// Validate reports the first problem that would keep cfg from working.
+func (cfg MultiplexerConfig) Validate() error {
+	if cfg.Targets == nil {
+		if cfg.TargetHost == "" && len(cfg.Endpoints) == 0 {
+			return fmt.Errorf("target host is required")
+		}
+		if cfg.TargetPort < 0 || cfg.TargetPort > 65535 {
+			return fmt.Errorf("invalid target port %d", cfg.TargetPort)
+		}
+		for _, endpoint := range cfg.Endpoints {
+			if endpoint.Host == "" {
+				return fmt.Errorf("endpoint host is required")
+			}
+			if endpoint.Port < 0 || endpoint.Port > 65535 {
+				return fmt.Errorf("invalid port %d for endpoint %s", endpoint.Port, endpoint.Host)
+			}
+		}
+	} else if len(cfg.Endpoints) > 0 {
+		return fmt.Errorf("endpoints cannot be used with a target listener")
+	}
+	if cfg.ListenPort < 0 || cfg.ListenPort > 65535 {
+		return fmt.Errorf("invalid listen port %d", cfg.ListenPort)
+	}
+	if cfg.HeartbeatInterval < 0 || cfg.StallTimeout < 0 {
+		return fmt.Errorf("heartbeat interval and stall timeout cannot be negative")
+	}
+	if cfg.DefaultWidth < 0 || cfg.DefaultHeight < 0 {
+		return fmt.Errorf("invalid default size %dx%d", cfg.DefaultWidth, cfg.DefaultHeight)
+	}
+	if format := cfg.PixelFormat; format != nil {
+		if format.BitsPerPixel != 32 || !format.TrueColour {
+			return fmt.Errorf("unsupported pixel format: only 32 bit true colour is supported")
+		}
+		seen := make(map[int]bool)
+		for _, shift := range []int{format.RedShift, format.GreenShift, format.BlueShift} {
+			if shift%8 != 0 || shift < 0 || shift > 24 || seen[shift] {
+				return fmt.Errorf("unsupported pixel format: colour shifts must be distinct whole bytes")
+			}
+			seen[shift] = true
+		}
+		if format.RedMax != 255 || format.GreenMax != 255 || format.BlueMax != 255 {
+			return fmt.Errorf("unsupported pixel format: colour maxima must be 255")
+		}
+	}
+	if cfg.DefaultRole != "" {
+		if err := cfg.DefaultRole.validate(); err != nil {
+			return err
+		}
+	}
+	for i, credential := range cfg.Credentials {
+		if credential.Password == "" {
+			return fmt.Errorf("credential %d (%s) has no password", i, credential.Name)
+		}
+		if credential.Role != "" {
+			if err := credential.Role.validate(); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := cfg.InputPolicy.compile(); err != nil {
+		return err
+	}
+	if cfg.Audit != nil {
+		if err := cfg.Audit.validate(); err != nil {
+			return err
+		}
+	}
+	if err := cfg.SessionLimits.validate(); err != nil {
+		return err
+	}
+	for role, limits := range cfg.RoleSessionLimits {
+		if err := role.validate(); err != nil {
+			return err
+		}
+		if err := limits.validate(); err != nil {
+			return fmt.Errorf("%s: %w", role, err)
+		}
+	}
+	if err := cfg.ViewerPointerLabel.validate(); err != nil {
+		return err
+	}
+	if err := cfg.Sharing.validate(); err != nil {
+		return err
+	}
+	if err := cfg.ControlMode.validate(); err != nil {
+		return err
+	}
+	if err := cfg.Placeholder.validate(); err != nil {
+		return err
+	}
+	if cfg.Reconnect != nil {
+		if err := cfg.Reconnect.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// endpoints returns the targets in failover order.
+func (cfg MultiplexerConfig) endpoints() []TargetEndpoint {
+	if cfg.Targets != nil {
+		return []TargetEndpoint{{Password: cfg.TargetPassword}}
+	}
+
+	var endpoints []TargetEndpoint
+	if cfg.TargetHost != "" {
+		endpoints = append(endpoints, TargetEndpoint{Host: cfg.TargetHost, Port: cfg.TargetPort, Password: cfg.TargetPassword})
+	}
+	return append(endpoints, cfg.Endpoints...)
+}
+
+// Duration is a time.Duration that reads and writes as a string such as
+// "1m30s" in JSON and YAML. Plain numbers are taken as seconds.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	return d.set(value)
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	var value interface{}
+	if err := node.Decode(&value); err != nil {
+		return err
+	}
+	return d.set(value)
+}
+
+func (d *Duration) set(value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	case float64:
+		*d = Duration(v * float64(time.Second))
+	case int:
+		*d = Duration(time.Duration(v) * time.Second)
+	default:
+		return fmt.Errorf("invalid duration %v", value)
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package vnc
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadMultiplexerConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		data string
+	}{
+		{name: "json", file: "mux.json", data: `{
+			"targetHost": "desk.example",
+			"targetPort": 5901,
+			"listenPort": 5900,
+			"reconnect": {"initialInterval": "3s", "maxAttempts": 4},
+			"connectTimeout": "3s",
+			"onDemandGrace": 90,
+			"credentials": [{"name": "ops", "password": "secret", "role": "admin"}],
+			"pixelFormat": {"bitsPerPixel": 32, "trueColour": true, "redMax": 255, "greenMax": 255, "blueMax": 255, "redShift": 16, "greenShift": 8}
+		}`},
+		{name: "yaml", file: "mux.yaml", data: `
+targetHost: desk.example
+targetPort: 5901
+listenPort: 5900
+reconnect:
+  initialInterval: 3s
+  maxAttempts: 4
+connectTimeout: 3s
+onDemandGrace: 90
+credentials:
+  - name: ops
+    password: secret
+    role: admin
+pixelFormat:
+  bitsPerPixel: 32
+  trueColour: true
+  redMax: 255
+  greenMax: 255
+  blueMax: 255
+  redShift: 16
+  greenShift: 8
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, []byte(tt.data), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := LoadMultiplexerConfig(path)
+			if err != nil {
+				t.Fatalf("LoadMultiplexerConfig: %v", err)
+			}
+			if cfg.TargetHost != "desk.example" || cfg.TargetPort != 5901 || cfg.ListenPort != 5900 {
+				t.Errorf("target %s:%d, listen port %d", cfg.TargetHost, cfg.TargetPort, cfg.ListenPort)
+			}
+			if cfg.Reconnect == nil || cfg.Reconnect.InitialInterval != Duration(3*time.Second) || cfg.Reconnect.MaxAttempts != 4 {
+				t.Errorf("reconnect %+v", cfg.Reconnect)
+			}
+			if cfg.ConnectTimeout != Duration(3*time.Second) {
+				t.Errorf("connect timeout %s", cfg.ConnectTimeout)
+			}
+			if cfg.OnDemandGrace != Duration(90*time.Second) {
+				t.Errorf("on-demand grace %s", cfg.OnDemandGrace)
+			}
+			if len(cfg.Credentials) != 1 || cfg.Credentials[0] != (ViewerCredential{Name: "ops", Password: "secret", Role: RoleAdmin}) {
+				t.Errorf("credentials %+v", cfg.Credentials)
+			}
+			if cfg.PixelFormat == nil || cfg.PixelFormat.RedShift != 16 || cfg.PixelFormat.BlueShift != 0 {
+				t.Errorf("pixel format %+v", cfg.PixelFormat)
+			}
+		})
+	}
+}
+
+func TestLoadMultiplexerConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	bad := filepath.Join(dir, "bad.json")
+	if err := os.WriteFile(bad, []byte(`{"listenPort": "soon"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{bad, filepath.Join(dir, "missing.yaml")} {
+		if _, err := LoadMultiplexerConfig(path); err == nil {
+			t.Errorf("LoadMultiplexerConfig(%s) succeeded, want error", filepath.Base(path))
+		}
+	}
+}
+
+func TestMultiplexerConfigWithDefaults(t *testing.T) {
+	cfg := MultiplexerConfig{
+		TargetHost:     "desk.example",
+		TargetPassword: "target",
+		Endpoints:      []TargetEndpoint{{Host: "standby.example"}},
+		DefaultRole:    RoleViewOnly,
+		Credentials:    []ViewerCredential{{Password: "a"}, {Password: "b", Role: RoleAdmin}},
+	}.WithDefaults()
+
+	if cfg.TargetPort != DefaultTargetPort {
+		t.Errorf("target port %d, want %d", cfg.TargetPort, DefaultTargetPort)
+	}
+	if endpoint := cfg.Endpoints[0]; endpoint.Port != DefaultTargetPort || endpoint.Password != "target" {
+		t.Errorf("endpoint %+v did not inherit port and password", endpoint)
+	}
+	if cfg.Credentials[0].Role != RoleViewOnly || cfg.Credentials[1].Role != RoleAdmin {
+		t.Errorf("credential roles %s, %s", cfg.Credentials[0].Role, cfg.Credentials[1].Role)
+	}
+	if cfg.PixelFormat == nil || *cfg.PixelFormat != PixelFormatStandard {
+		t.Errorf("pixel format %+v, want PixelFormatStandard", cfg.PixelFormat)
+	}
+	if cfg.ReconnectPolicy != DefaultReconnectPolicy || cfg.Logger == nil {
+		t.Error("reconnect policy or logger not defaulted")
+	}
+	if cfg.ControlMode != ControlFree {
+		t.Errorf("control mode %q, want %q", cfg.ControlMode, ControlFree)
+	}
+	backoff := FixedReconnectPolicy(time.Second)
+	if cfg := (MultiplexerConfig{Reconnect: &backoff}).WithDefaults(); cfg.ReconnectPolicy != backoff {
+		t.Errorf("reconnect policy %+v, want %+v", cfg.ReconnectPolicy, backoff)
+	}
+	partial := BackoffPolicy{MaxAttempts: 4}
+	if cfg := (MultiplexerConfig{Reconnect: &partial}).WithDefaults(); cfg.ReconnectPolicy == partial {
+		t.Errorf("reconnect policy %+v kept its zero intervals", cfg.ReconnectPolicy)
+	}
+
+	noDepth := PixelFormatStandard
+	noDepth.Depth = 0
+	if cfg := (MultiplexerConfig{PixelFormat: &noDepth}).WithDefaults(); cfg.PixelFormat.Depth != 24 || noDepth.Depth != 0 {
+		t.Errorf("depth %d, want 24 without changing the caller's format", cfg.PixelFormat.Depth)
+	}
+}
+
+func TestMultiplexerConfigValidate(t *testing.T) {
+	valid := MultiplexerConfig{TargetHost: "desk.example", ListenPort: 5900}
+	swapped := PixelFormatStandard
+	swapped.RedShift, swapped.BlueShift = 16, 0
+	sixteenBit := PixelFormatStandard
+	sixteenBit.BitsPerPixel = 16
+	sameShift := PixelFormatStandard
+	sameShift.GreenShift = 0
+
+	tests := []struct {
+		name    string
+		modify  func(*MultiplexerConfig)
+		wantErr bool
+	}{
+		{name: "valid", modify: func(*MultiplexerConfig) {}},
+		{name: "no target", modify: func(c *MultiplexerConfig) { c.TargetHost = "" }, wantErr: true},
+		{name: "target listener", modify: func(c *MultiplexerConfig) {
+			c.TargetHost = ""
+			c.Targets = &TargetListener{}
+		}},
+		{name: "endpoints only", modify: func(c *MultiplexerConfig) {
+			c.TargetHost = ""
+			c.Endpoints = []TargetEndpoint{{Host: "standby.example"}}
+		}},
+		{name: "endpoint without host", modify: func(c *MultiplexerConfig) { c.Endpoints = []TargetEndpoint{{Port: 5901}} }, wantErr: true},
+		{name: "target listener with endpoints", modify: func(c *MultiplexerConfig) {
+			c.Targets = &TargetListener{}
+			c.Endpoints = []TargetEndpoint{{Host: "standby.example"}}
+		}, wantErr: true},
+		{name: "target port", modify: func(c *MultiplexerConfig) { c.TargetPort = 70000 }, wantErr: true},
+		{name: "listen port", modify: func(c *MultiplexerConfig) { c.ListenPort = -1 }, wantErr: true},
+		{name: "swapped channels", modify: func(c *MultiplexerConfig) { c.PixelFormat = &swapped }},
+		{name: "16 bit pixels", modify: func(c *MultiplexerConfig) { c.PixelFormat = &sixteenBit }, wantErr: true},
+		{name: "shared shift", modify: func(c *MultiplexerConfig) { c.PixelFormat = &sameShift }, wantErr: true},
+		{name: "negative reconnect interval", modify: func(c *MultiplexerConfig) { c.Reconnect = &BackoffPolicy{InitialInterval: -1} }, wantErr: true},
+		{name: "reconnect jitter", modify: func(c *MultiplexerConfig) { c.Reconnect = &BackoffPolicy{Jitter: 2} }, wantErr: true},
+		{name: "negative heartbeat", modify: func(c *MultiplexerConfig) { c.HeartbeatInterval = -1 }, wantErr: true},
+		{name: "unknown control mode", modify: func(c *MultiplexerConfig) { c.ControlMode = "loudest" }, wantErr: true},
+		{name: "credential without password", modify: func(c *MultiplexerConfig) { c.Credentials = []ViewerCredential{{Name: "ops"}} }, wantErr: true},
+		{name: "unknown role", modify: func(c *MultiplexerConfig) { c.DefaultRole = "owner" }, wantErr: true},
+		{name: "negative session limit", modify: func(c *MultiplexerConfig) { c.SessionLimits.IdleTimeout = -1 }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid
+			tt.modify(&cfg)
+			if err := cfg.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDurationJSON(t *testing.T) {
+	tests := []struct {
+		json    string
+		want    Duration
+		wantErr bool
+	}{
+		{json: `"1m30s"`, want: Duration(90 * time.Second)},
+		{json: `"250ms"`, want: Duration(250 * time.Millisecond)},
+		{json: `45`, want: Duration(45 * time.Second)},
+		{json: `1.5`, want: Duration(1500 * time.Millisecond)},
+		{json: `"soon"`, wantErr: true},
+		{json: `true`, wantErr: true},
+	}
+	for _, tt := range tests {
+		var d Duration
+		err := json.Unmarshal([]byte(tt.json), &d)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("Unmarshal(%s) = %s, want error", tt.json, d)
+			}
+			continue
+		}
+		if err != nil || d != tt.want {
+			t.Errorf("Unmarshal(%s) = %s, %v; want %s", tt.json, d, err, tt.want)
+		}
+	}
+
+	out, err := json.Marshal(Duration(90 * time.Second))
+	if err != nil || string(out) != `"1m30s"` {
+		t.Errorf("Marshal = %s, %v; want \"1m30s\"", out, err)
+	}
+}
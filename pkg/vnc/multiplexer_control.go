@@ -0,0 +1,359 @@
+package vnc
+
+import (
+	"fmt"
+	"time"
+)
+
+// ControlMode decides whose keyboard and pointer input reaches the target
+// when several viewers are connected.
+type ControlMode string
+
+const (
+	// ControlFree forwards everyone's input.
+	ControlFree ControlMode = "free"
+	// ControlExclusive forwards only the controller's input. Control is only
+	// handed out through TakeControl and ReleaseControl.
+	ControlExclusive ControlMode = "exclusive"
+	// ControlFirstCome gives control to the first viewer that sends input
+	// while nobody holds it. A controller idle for the control idle timeout
+	// loses control to the next viewer that sends input.
+	ControlFirstCome ControlMode = "firstCome"
+	// ControlQueue queues viewers that send input without control, or call
+	// RequestControl, and hands control to the head of the queue when the
+	// controller releases it, leaves or stays idle for the control idle
+	// timeout.
+	ControlQueue ControlMode = "queue"
+)
+
+// ControlEvent describes a change of controller.
+type ControlEvent struct {
+	Mode ControlMode
+	// Previous and Controller are viewer IDs; empty means nobody.
+	Previous   string
+	Controller string
+	// Reason is "taken", "granted", "queued", "released", "idle", "left",
+	// "role" or "mode".
+	Reason string
+	// Queue holds the viewer IDs waiting for control, in order.
+	Queue []string
+	Time  time.Time
+}
+
+func (mode ControlMode) validate() error {
+	switch mode {
+	case "", ControlFree, ControlExclusive, ControlFirstCome, ControlQueue:
+		return nil
+	default:
+		return fmt.Errorf("unknown control mode %q", mode)
+	}
+}
+
+// ControlMode returns the current control mode.
+func (m *Multiplexer) ControlMode() ControlMode {
+	m.controlMu.Lock()
+	defer m.controlMu.Unlock()
+	return m.controlMode
+}
+
+// SetControlMode switches the control mode. Control is dropped and the
+// queue cleared.
+func (m *Multiplexer) SetControlMode(mode ControlMode) error {
+	if err := mode.validate(); err != nil {
+		return err
+	}
+	if mode == "" {
+		mode = ControlFree
+	}
+
+	m.controlMu.Lock()
+	m.controlMode = mode
+	m.controlQueue = nil
+	event, changed := m.setControllerLocked(nil, "mode")
+	m.controlMu.Unlock()
+
+	m.logger.Printf("Control mode set to %s.", mode)
+	m.controlChanged(event, changed, true)
+	return nil
+}
+
+// Controller returns the ID of the viewer in control, or "" if nobody is.
+func (m *Multiplexer) Controller() string {
+	m.controlMu.Lock()
+	defer m.controlMu.Unlock()
+	if m.controller == nil {
+		return ""
+	}
+	return m.controller.id
+}
+
+// ControlQueue returns the IDs of viewers waiting for control, in order.
+func (m *Multiplexer) ControlQueue() []string {
+	m.controlMu.Lock()
+	defer m.controlMu.Unlock()
+	return m.queueIDsLocked()
+}
+
+// TakeControl gives control to a viewer, taking it from the current
+// controller. It is how control is transferred in any mode but ControlFree.
+func (m *Multiplexer) TakeControl(viewerID string) error {
+	v := m.viewerByID(viewerID)
+	if v == nil {
+		return fmt.Errorf("unknown viewer %q", viewerID)
+	}
+
+	m.controlMu.Lock()
+	if m.controlMode == ControlFree {
+		m.controlMu.Unlock()
+		return fmt.Errorf("control cannot be taken in %s mode", ControlFree)
+	}
+	m.removeFromQueueLocked(v)
+	event, changed := m.setControllerLocked(v, "taken")
+	m.controlMu.Unlock()
+
+	m.controlChanged(event, changed, false)
+	return nil
+}
+
+// ReleaseControl gives up control held by a viewer, passing it on to the
+// next queued viewer in ControlQueue mode.
+func (m *Multiplexer) ReleaseControl(viewerID string) error {
+	m.controlMu.Lock()
+	if m.controller == nil || m.controller.id != viewerID {
+		m.controlMu.Unlock()
+		return fmt.Errorf("viewer %q is not in control", viewerID)
+	}
+	event, changed := m.passControlLocked("released")
+	m.controlMu.Unlock()
+
+	m.controlChanged(event, changed, false)
+	return nil
+}
+
+// RequestControl queues a viewer for control in ControlQueue mode, granting
+// it right away if nobody holds control.
+func (m *Multiplexer) RequestControl(viewerID string) error {
+	v := m.viewerByID(viewerID)
+	if v == nil {
+		return fmt.Errorf("unknown viewer %q", viewerID)
+	}
+
+	m.controlMu.Lock()
+	if m.controlMode != ControlQueue {
+		m.controlMu.Unlock()
+		return fmt.Errorf("control can only be requested in %s mode", ControlQueue)
+	}
+	queued := m.controller != v && !m.queuedLocked(v)
+	event, changed := m.requestControlLocked(v)
+	m.controlMu.Unlock()
+
+	m.controlChanged(event, changed || queued, false)
+	return nil
+}
+
+// SubscribeControl registers fn to be called with every change of
+// controller or control queue and returns a function that unregisters it.
+// Like state subscribers it must not block.
+func (m *Multiplexer) SubscribeControl(fn func(ControlEvent)) func() {
+	m.controlMu.Lock()
+	defer m.controlMu.Unlock()
+
+	if m.controlSubscribers == nil {
+		m.controlSubscribers = make(map[int]func(ControlEvent))
+	}
+	id := m.nextControlSubID
+	m.nextControlSubID++
+	m.controlSubscribers[id] = fn
+
+	return func() {
+		m.controlMu.Lock()
+		defer m.controlMu.Unlock()
+		delete(m.controlSubscribers, id)
+	}
+}
+
+// allowInput reports whether input from v may reach the target, updating
+// control as the mode dictates.
+func (m *Multiplexer) allowInput(v *viewer) bool {
+	if v == nil {
+		return false
+	}
+	now := time.Now()
+
+	m.controlMu.Lock()
+	// the idle handover is its own change, reported before whatever v's
+	// input changes next
+	var idleEvent ControlEvent
+	idle := false
+	if m.controller != nil && m.controller != v && m.controllerIdleLocked(now) {
+		idleEvent, idle = m.passControlLocked("idle")
+	}
+
+	var event ControlEvent
+	changed := false
+
+	allowed := false
+	queued := false
+	switch {
+	case m.viewerRole(v) == RoleAdmin:
+		allowed = true
+	case m.controlMode == ControlFree:
+		allowed = true
+	case m.controlMode == ControlExclusive:
+		allowed = m.controller == v
+	case m.controlMode == ControlFirstCome:
+		if m.controller == nil {
+			event, changed = m.setControllerLocked(v, "taken")
+		}
+		allowed = m.controller == v
+	case m.controlMode == ControlQueue:
+		if m.controller != v && !m.queuedLocked(v) {
+			event, changed = m.requestControlLocked(v)
+			queued = !changed
+		}
+		allowed = m.controller == v
+	}
+	if allowed {
+		v.lastInput = now
+	}
+	m.controlMu.Unlock()
+
+	m.controlChanged(idleEvent, idle, false)
+	m.controlChanged(event, changed || queued, false)
+	return allowed
+}
+
+// viewerGone drops a leaving viewer from control and the queue.
+func (m *Multiplexer) viewerGone(v *viewer) {
+	m.controlMu.Lock()
+	wasQueued := m.removeFromQueueLocked(v)
+	var event ControlEvent
+	changed := false
+	if m.controller == v {
+		event, changed = m.passControlLocked("left")
+	} else if wasQueued {
+		event = m.controlEventLocked(m.controller, "left")
+	}
+	m.controlMu.Unlock()
+
+	m.controlChanged(event, changed || wasQueued, false)
+}
+
+func (m *Multiplexer) controllerIdleLocked(now time.Time) bool {
+	if m.controlMode != ControlFirstCome && m.controlMode != ControlQueue {
+		return false
+	}
+	return now.Sub(m.controller.lastInput) >= m.controlIdleTimeout
+}
+
+// requestControlLocked grants control to v if nobody holds it, and queues
+// it otherwise.
+func (m *Multiplexer) requestControlLocked(v *viewer) (ControlEvent, bool) {
+	if m.controller == nil {
+		return m.setControllerLocked(v, "granted")
+	}
+	if m.controller != v && !m.queuedLocked(v) {
+		m.controlQueue = append(m.controlQueue, v)
+		m.logger.Printf("Viewer %s is waiting for control.", v.id)
+	}
+	return m.controlEventLocked(m.controller, "queued"), false
+}
+
+// passControlLocked hands control to the next queued viewer, or to nobody.
+func (m *Multiplexer) passControlLocked(reason string) (ControlEvent, bool) {
+	var next *viewer
+	if m.controlMode == ControlQueue && len(m.controlQueue) > 0 {
+		next = m.controlQueue[0]
+		m.controlQueue = m.controlQueue[1:]
+	}
+	return m.setControllerLocked(next, reason)
+}
+
+func (m *Multiplexer) setControllerLocked(v *viewer, reason string) (ControlEvent, bool) {
+	event := m.controlEventLocked(v, reason)
+	if m.controller == v {
+		return event, false
+	}
+	if m.controller != nil {
+		event.Previous = m.controller.id
+	}
+	m.controller = v
+	if v != nil {
+		v.lastInput = time.Now()
+	}
+	return event, true
+}
+
+func (m *Multiplexer) controlEventLocked(controller *viewer, reason string) ControlEvent {
+	event := ControlEvent{
+		Mode:   m.controlMode,
+		Reason: reason,
+		Queue:  m.queueIDsLocked(),
+		Time:   time.Now(),
+	}
+	if controller != nil {
+		event.Controller = controller.id
+	}
+	if m.controller != nil {
+		event.Previous = m.controller.id
+	}
+	return event
+}
+
+func (m *Multiplexer) queuedLocked(v *viewer) bool {
+	for _, queued := range m.controlQueue {
+		if queued == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Multiplexer) removeFromQueueLocked(v *viewer) bool {
+	for i, queued := range m.controlQueue {
+		if queued == v {
+			m.controlQueue = append(m.controlQueue[:i:i], m.controlQueue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Multiplexer) queueIDsLocked() []string {
+	ids := make([]string, len(m.controlQueue))
+	for i, v := range m.controlQueue {
+		ids[i] = v.id
+	}
+	return ids
+}
+
+// controlChanged releases input the previous controller still holds and
+// notifies subscribers. It must be called without controlMu held.
+func (m *Multiplexer) controlChanged(event ControlEvent, notify bool, force bool) {
+	if !notify && !force {
+		return
+	}
+	if event.Previous != event.Controller {
+		if event.Controller != "" {
+			m.logger.Printf("Viewer %s has control (%s).", event.Controller, event.Reason)
+		} else if event.Previous != "" {
+			m.logger.Printf("Viewer %s lost control (%s).", event.Previous, event.Reason)
+		}
+		m.audit(AuditEvent{Type: "control", Previous: event.Previous, Controller: event.Controller, Reason: event.Reason})
+		// a viewer that left is released by handleViewerLeft
+		if previous := m.viewerByID(event.Previous); previous != nil {
+			m.releaseViewerInput(previous)
+		}
+	}
+
+	m.controlMu.Lock()
+	subscribers := make([]func(ControlEvent), 0, len(m.controlSubscribers))
+	for _, fn := range m.controlSubscribers {
+		subscribers = append(subscribers, fn)
+	}
+	m.controlMu.Unlock()
+
+	for _, fn := range subscribers {
+		fn(event)
+	}
+}
@@ -0,0 +1,140 @@
+package vnc
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMultiplexerControlModes(t *testing.T) {
+	tests := []struct {
+		mode ControlMode
+		// keys of the first and second viewer that reach the target
+		want []uint32
+		// controller and queue after both typed
+		controller string
+		queue      []string
+	}{
+		{mode: ControlFree, want: []uint32{'a', 'b'}},
+		{mode: ControlExclusive, want: nil},
+		{mode: ControlFirstCome, want: []uint32{'a'}, controller: "viewer-1"},
+		{mode: ControlQueue, want: []uint32{'a'}, controller: "viewer-1", queue: []string{"viewer-2"}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			m, ports, srv := runFakeMultiplexer(t, MultiplexerConfig{ControlMode: tt.mode})
+			first := srv.connect("10.0.0.1:5000")
+			second := srv.connect("10.0.0.2:5000")
+
+			srv.key(first, 'a', true)
+			srv.key(second, 'b', true)
+
+			var got []uint32
+			for _, k := range ports.client().sentKeys() {
+				got = append(got, k.key)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("keys reaching the target = %q, want %q", got, tt.want)
+			}
+			if controller := m.Controller(); controller != tt.controller {
+				t.Errorf("Controller() = %q, want %q", controller, tt.controller)
+			}
+			if queue := m.ControlQueue(); len(queue) != len(tt.queue) || (len(queue) > 0 && !reflect.DeepEqual(queue, tt.queue)) {
+				t.Errorf("ControlQueue() = %q, want %q", queue, tt.queue)
+			}
+		})
+	}
+}
+
+func TestMultiplexerControlHandover(t *testing.T) {
+	m, ports, srv := runFakeMultiplexer(t, MultiplexerConfig{ControlMode: ControlQueue})
+	first := srv.connect("10.0.0.1:5000")
+	second := srv.connect("10.0.0.2:5000")
+	var events []ControlEvent
+	m.SubscribeControl(func(event ControlEvent) {
+		events = append(events, event)
+	})
+
+	srv.key(first, 0xffe3, true) // Control_L
+	if err := m.RequestControl("viewer-2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.ReleaseControl("viewer-1"); err != nil {
+		t.Fatal(err)
+	}
+	srv.key(second, 'b', true)
+
+	want := []ControlEvent{
+		{Previous: "", Controller: "viewer-1", Reason: "granted"},
+		{Previous: "viewer-1", Controller: "viewer-1", Reason: "queued"},
+		{Previous: "viewer-1", Controller: "viewer-2", Reason: "released"},
+	}
+	checkControlEvents(t, events, want)
+	wantKeys := []fakeKey{{0xffe3, true}, {0xffe3, false}, {'b', true}}
+	if got := ports.client().sentKeys(); !reflect.DeepEqual(got, wantKeys) {
+		t.Errorf("keys sent to the target = %v, want %v", got, wantKeys)
+	}
+
+	if err := m.TakeControl("viewer-1"); err != nil {
+		t.Fatal(err)
+	}
+	if controller := m.Controller(); controller != "viewer-1" {
+		t.Errorf("Controller() after TakeControl = %q", controller)
+	}
+	if err := m.SetControlMode(ControlExclusive); err != nil {
+		t.Fatal(err)
+	}
+	if controller := m.Controller(); controller != "" {
+		t.Errorf("Controller() after a mode change = %q", controller)
+	}
+}
+
+func TestMultiplexerControlIdleHandover(t *testing.T) {
+	for _, mode := range []ControlMode{ControlFirstCome, ControlQueue} {
+		t.Run(string(mode), func(t *testing.T) {
+			m, ports, srv := runFakeMultiplexer(t, MultiplexerConfig{
+				ControlMode:        mode,
+				ControlIdleTimeout: Duration(20 * time.Millisecond),
+			})
+			first := srv.connect("10.0.0.1:5000")
+			second := srv.connect("10.0.0.2:5000")
+
+			srv.key(first, 0xffe3, true) // Control_L, then idle
+			if mode == ControlQueue {
+				srv.key(second, 'b', true)
+			}
+			time.Sleep(30 * time.Millisecond)
+
+			var events []ControlEvent
+			m.SubscribeControl(func(event ControlEvent) {
+				events = append(events, event)
+			})
+			srv.key(second, 'c', true)
+
+			if controller := m.Controller(); controller != "viewer-2" {
+				t.Fatalf("Controller() = %q, want viewer-2", controller)
+			}
+			if len(events) == 0 || events[0].Reason != "idle" || events[0].Previous != "viewer-1" {
+				t.Errorf("control events = %+v, want an idle handover from viewer-1 first", events)
+			}
+			wantKeys := []fakeKey{{0xffe3, true}, {0xffe3, false}, {'c', true}}
+			if got := ports.client().sentKeys(); !reflect.DeepEqual(got, wantKeys) {
+				t.Errorf("keys sent to the target = %v, want %v", got, wantKeys)
+			}
+		})
+	}
+}
+
+func checkControlEvents(t *testing.T, got, want []ControlEvent) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d control events, want %d: %+v", len(got), len(want), got)
+	}
+	for i, event := range got {
+		if event.Previous != want[i].Previous || event.Controller != want[i].Controller || event.Reason != want[i].Reason {
+			t.Errorf("control event %d = %s -> %s (%s), want %s -> %s (%s)", i,
+				event.Previous, event.Controller, event.Reason,
+				want[i].Previous, want[i].Controller, want[i].Reason)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package vnc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// TargetEndpoint is one VNC server a Multiplexer can proxy.
+type TargetEndpoint struct {
+	Host     string `json:"host" yaml:"host"`
+	Port     int    `json:"port,omitempty" yaml:"port,omitempty"`
+	Password string `json:"password,omitempty" yaml:"password,omitempty"`
+}
+
+func (e TargetEndpoint) String() string {
+	if e.Host == "" {
+		return ""
+	}
+	return net.JoinHostPort(e.Host, strconv.Itoa(e.Port))
+}
+
+func (m *Multiplexer) endpoint() TargetEndpoint {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	return m.endpoints[m.activeEndpoint]
+}
+
+// targetName is the endpoint address, or the ID in dial-home mode.
+func (m *Multiplexer) targetName() string {
+	if m.targets != nil {
+		return m.targetID
+	}
+	return m.endpoint().String()
+}
+
+func (m *Multiplexer) endpointIndex() int {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	return m.activeEndpoint
+}
+
+// setEndpointIndex makes endpoint index active, wrapping it in case
+// SetTarget shortened the list meanwhile.
+func (m *Multiplexer) setEndpointIndex(index int) {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	m.activeEndpoint = index % len(m.endpoints)
+}
+
+func (m *Multiplexer) endpointList() []TargetEndpoint {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	return m.endpoints
+}
+
+// firstEndpoint is where a connection attempt starts: the primary when
+// failing back, otherwise the endpoint that worked last.
+func (m *Multiplexer) firstEndpoint() int {
+	if m.failBack {
+		return 0
+	}
+	return m.endpointIndex()
+}
+
+// connectEndpoints tries the endpoints in order from first, wrapping around,
+// until one connects, announcing each try as state. It returns the error of
+// the last try if none connects.
+func (m *Multiplexer) connectEndpoints(ctx context.Context, first int, state MultiplexerState, attempt int, lastErr error) error {
+	err := lastErr
+	endpoints := m.endpointList()
+	for i := range endpoints {
+		m.setEndpointIndex(first + i)
+		m.setState(state, err, attempt)
+
+		if err = m.initProxyClient(ctx, m.clientFactory); err == nil {
+			return nil
+		}
+		if endpoint := m.endpoint().String(); endpoint != "" {
+			m.logger.Printf("Failed to connect to target %s: %v", endpoint, err)
+		}
+		if m.proxyClient != nil {
+			m.proxyClient.Close()
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// watchPrimary probes the primary endpoint while a standby is active and
+// interrupts the current connection once the primary accepts connections
+// again, so Run fails back to it.
+func (m *Multiplexer) watchPrimary(ctx context.Context, interrupt context.CancelCauseFunc) {
+	ticker := time.NewTicker(m.failBackInterval)
+	defer ticker.Stop()
+
+	primary := m.endpointList()[0].String()
+	dialer := net.Dialer{Timeout: m.connectTimeout}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		conn, err := dialer.DialContext(ctx, "tcp", primary)
+		if err != nil {
+			continue
+		}
+		conn.Close()
+
+		m.logger.Printf("Primary target %s is reachable again, failing back.", primary)
+		interrupt(ErrFailBack)
+		return
+	}
+}
+
+// SetTarget switches the multiplexer to another target, replacing any
+// failover endpoints. A running multiplexer drops the current upstream
+// connection and connects to the new target, keeping viewers connected and
+// resizing the proxy server if needed. Dial-home multiplexers cannot switch
+// targets.
+func (m *Multiplexer) SetTarget(host string, port int, password string) error {
+	if m.targets != nil {
+		return fmt.Errorf("cannot set the target of a dial-home multiplexer")
+	}
+	if host == "" {
+		return fmt.Errorf("target host is required")
+	}
+	if port == 0 {
+		port = DefaultTargetPort
+	}
+	if port < 0 || port > 65535 {
+		return fmt.Errorf("invalid target port %d", port)
+	}
+	if m.isShuttingDown() {
+		return ErrMultiplexerClosed
+	}
+
+	endpoint := TargetEndpoint{Host: host, Port: port, Password: password}
+	m.stateMu.Lock()
+	m.endpoints = []TargetEndpoint{endpoint}
+	m.activeEndpoint = 0
+	m.stateMu.Unlock()
+	m.logger.Printf("Switching target to %s.", endpoint)
+
+	m.mu.Lock()
+	interrupt := m.interruptUpstream
+	running := m.running
+	m.mu.Unlock()
+
+	if interrupt != nil {
+		interrupt(ErrTargetSwitched)
+	} else if !running && m.proxyClient != nil && m.proxyClient.IsConnected() {
+		// not running: just drop the old target so Run connects to the new one
+		m.releaseHeldInput()
+		m.proxyClient.Close()
+		if m.isConnected {
+			m.isConnected = false
+			if m.onConnectionOffline != nil {
+				m.onConnectionOffline()
+			}
+		}
+		m.setState(StateOffline, ErrTargetSwitched, 0)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package vnc
+
+import (
+	"context"
+	"errors"
+	"image"
+	"io"
+	"log"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMultiplexerTriesEndpointsInOrder(t *testing.T) {
+	ports := newFakePorts(64, 48)
+	refused := errors.New("connection refused")
+	ports.refuseHost("primary.example", refused)
+	ports.refuseHost("standby.example", refused)
+	m, err := NewMultiplexerFromConfig(MultiplexerConfig{
+		Endpoints:     []TargetEndpoint{{Host: "primary.example"}, {Host: "standby.example"}, {Host: "spare.example"}},
+		Logger:        log.New(io.Discard, "", 0),
+		ClientFactory: ports.clientFactory,
+		ServerFactory: ports.serverFactory,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	want := []string{"primary.example", "standby.example", "spare.example"}
+	if hosts := ports.hosts(); !reflect.DeepEqual(hosts, want) {
+		t.Errorf("tried %v, want %v", hosts, want)
+	}
+	if endpoint := m.targetName(); endpoint != "spare.example:5900" {
+		t.Errorf("active endpoint %q, want spare.example:5900", endpoint)
+	}
+}
+
+func TestMultiplexerFailsBackToPrimary(t *testing.T) {
+	// a free port for the primary, which comes up later
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary := l.Addr().(*net.TCPAddr)
+	l.Close()
+
+	ports := newFakePorts(64, 48)
+	ports.refuseHost("127.0.0.1", errors.New("connection refused"))
+	m, err := NewMultiplexerFromConfig(MultiplexerConfig{
+		Endpoints:        []TargetEndpoint{{Host: "127.0.0.1", Port: primary.Port}, {Host: "standby.example"}},
+		FailBack:         true,
+		FailBackInterval: Duration(5 * time.Millisecond),
+		Logger:           log.New(io.Discard, "", 0),
+		ClientFactory:    ports.clientFactory,
+		ServerFactory:    ports.serverFactory,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	var mu sync.Mutex
+	var online []string
+	m.SubscribeState(func(event StateEvent) {
+		if event.To == StateOnline {
+			mu.Lock()
+			online = append(online, event.Endpoint)
+			mu.Unlock()
+		}
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+
+	time.Sleep(20 * time.Millisecond)
+	if hosts := ports.hosts(); len(hosts) != 2 {
+		t.Fatalf("connected to %v while the primary is down, want to stay on the standby", hosts)
+	}
+
+	ports.refuseHost("127.0.0.1", nil)
+	l, err = net.Listen("tcp", primary.String())
+	if err != nil {
+		t.Skipf("primary port taken meanwhile: %v", err)
+	}
+	defer l.Close()
+
+	waitFor(t, "the fail back", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(online) > 0 && online[len(online)-1] == primary.String()
+	})
+}
+
+func TestMultiplexerFailsOverFromStalledTarget(t *testing.T) {
+	for _, failBack := range []bool{false, true} {
+		m, ports := newFakeMultiplexer(t, MultiplexerConfig{
+			Endpoints:         []TargetEndpoint{{Host: "primary.example"}, {Host: "standby.example"}},
+			FailBack:          failBack,
+			HeartbeatInterval: Duration(5 * time.Millisecond),
+			HeartbeatTimeout:  Duration(5 * time.Millisecond),
+			StallTimeout:      Duration(10 * time.Millisecond),
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go m.Run(ctx)
+
+		// fake targets never answer the heartbeat
+		waitFor(t, "a reconnect after the stall", func() bool { return len(ports.hosts()) >= 2 })
+		if hosts := ports.hosts(); hosts[1] != "standby.example" {
+			t.Errorf("fail back %v: reconnected to %s after %s stalled, want standby.example", failBack, hosts[1], hosts[0])
+		}
+	}
+}
+
+func TestMultiplexerSetTarget(t *testing.T) {
+	m, ports, srv := runFakeMultiplexer(t, MultiplexerConfig{})
+	srv.connect("10.0.0.1:5000")
+
+	for _, bad := range []TargetEndpoint{{Host: ""}, {Host: "wall.example", Port: 70000}} {
+		if err := m.SetTarget(bad.Host, bad.Port, ""); err == nil {
+			t.Errorf("SetTarget(%q, %d) succeeded", bad.Host, bad.Port)
+		}
+	}
+
+	ports.resize(80, 60)
+	if err := m.SetTarget("wall.example", 5901, "secret"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the new target", func() bool {
+		return ports.client().hostName() == "wall.example" && m.State() == StateOnline
+	})
+
+	want := TargetEndpoint{Host: "wall.example", Port: 5901, Password: "secret"}
+	if got := ports.client().endpoint(); got != want {
+		t.Errorf("connected to %+v, want %+v", got, want)
+	}
+	waitFor(t, "the resize", func() bool { return srv.GetWidth() == 80 && srv.GetHeight() == 60 })
+	if n := m.ViewerCount(); n != 1 {
+		t.Errorf("ViewerCount() = %d after switching targets, want the viewer kept", n)
+	}
+}
+
+func TestMultiplexerMarksStalledTarget(t *testing.T) {
+	m, ports, srv := runFakeMultiplexer(t, MultiplexerConfig{
+		KeepAlive:         Duration(time.Minute),
+		HeartbeatInterval: Duration(5 * time.Millisecond),
+		HeartbeatTimeout:  Duration(5 * time.Millisecond),
+		StaleOverlay:      true,
+	})
+	var mu sync.Mutex
+	var events []StateEvent
+	m.SubscribeState(func(event StateEvent) {
+		mu.Lock()
+		events = append(events, event)
+		mu.Unlock()
+	})
+	client := ports.client()
+	client.mu.Lock()
+	keepAlive := client.keepAlive
+	client.mu.Unlock()
+	if keepAlive != time.Minute {
+		t.Errorf("target connection keepalive %s, want 1m", keepAlive)
+	}
+	// a pixel inside the stale banner
+	overlaid := func() bool {
+		fb := srv.GetFrameBuffer()
+		at := (10*64 + 2) * 4
+		return !reflect.DeepEqual(fb[at:at+4], client.GetFrameBuffer()[at:at+4])
+	}
+
+	// fake targets never answer the heartbeat
+	waitFor(t, "the stall", func() bool { return m.State() == StateStalled })
+	if !overlaid() {
+		t.Error("stale overlay not drawn")
+	}
+	mu.Lock()
+	stalled := events[len(events)-1]
+	mu.Unlock()
+	if !errors.Is(stalled.Err, ErrTargetStalled) {
+		t.Errorf("stalled with %v, want ErrTargetStalled", stalled.Err)
+	}
+
+	waitFor(t, "the recovery", func() bool {
+		client.update(image.Rect(0, 0, 1, 1))
+		return m.State() == StateOnline
+	})
+	if overlaid() {
+		t.Error("stale overlay left after the target answered")
+	}
+	if hosts := ports.hosts(); len(hosts) != 1 {
+		t.Errorf("reconnected to %v without a stall timeout", hosts)
+	}
+}
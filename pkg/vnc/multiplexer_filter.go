@@ -0,0 +1,253 @@
+package vnc
+
+import (
+	"fmt"
+	"image"
+	"time"
+)
+
+// InputEvent is a viewer's key or pointer event on its way to the target.
+type InputEvent struct {
+	ViewerID string
+	Role     ViewerRole
+	Time     time.Time
+
+	// Pointer is set for pointer events, which carry X, Y and ButtonMask;
+	// key events carry Key and Down.
+	Pointer    bool
+	X, Y       int
+	ButtonMask uint8
+	Key        uint32
+	Down       bool
+
+	// HeldKeys are the keysyms the viewer holds down on the target.
+	HeldKeys map[uint32]bool
+}
+
+// InputFilter is called for every viewer input event that passed the input
+// policy. Returning false drops the event; filters may also change it, e.g.
+// to remap keys. Filters run on the proxy server's event goroutine and must
+// not block. Dropping releases leaves keys or buttons held on the target.
+type InputFilter func(event *InputEvent) bool
+
+// InputPolicy declares which viewer input never reaches the target.
+type InputPolicy struct {
+	BlockedChords []ChordRule `json:"blockedChords,omitempty" yaml:"blockedChords,omitempty"`
+	// MaxEventsPerSecond limits the input of each viewer, allowing bursts
+	// of as many events; 0 is unlimited. Releases are never dropped.
+	MaxEventsPerSecond int             `json:"maxEventsPerSecond,omitempty" yaml:"maxEventsPerSecond,omitempty"`
+	PointerRegions     []PointerRegion `json:"pointerRegions,omitempty" yaml:"pointerRegions,omitempty"`
+}
+
+// ChordRule blocks a key combination, such as "Ctrl+Alt+Delete",
+// "Alt+SysRq" or "Super". Keys are X keysym names, single characters or
+// hexadecimal keysyms joined by "+"; Ctrl, Alt, Shift, Meta and Super match
+// either side. The key completing the combination is dropped.
+type ChordRule struct {
+	Chord string `json:"chord" yaml:"chord"`
+	// Roles the rule applies to; empty means every role.
+	Roles []ViewerRole `json:"roles,omitempty" yaml:"roles,omitempty"`
+}
+
+// PointerRegion restricts where viewers may use the pointer. Pointer events
+// inside a Deny region are dropped; if any other regions apply to a viewer,
+// its pointer events outside all of them are dropped. Button releases are
+// sent at the last allowed position instead.
+type PointerRegion struct {
+	X      int  `json:"x" yaml:"x"`
+	Y      int  `json:"y" yaml:"y"`
+	Width  int  `json:"width" yaml:"width"`
+	Height int  `json:"height" yaml:"height"`
+	Deny   bool `json:"deny,omitempty" yaml:"deny,omitempty"`
+	// Roles the region applies to; empty means every role.
+	Roles []ViewerRole `json:"roles,omitempty" yaml:"roles,omitempty"`
+}
+
+type compiledChord struct {
+	name  string
+	chord keyChord
+	roles []ViewerRole
+}
+
+func (p InputPolicy) compile() ([]compiledChord, error) {
+	if p.MaxEventsPerSecond < 0 {
+		return nil, fmt.Errorf("max input events per second cannot be negative")
+	}
+	for _, region := range p.PointerRegions {
+		if region.Width <= 0 || region.Height <= 0 {
+			return nil, fmt.Errorf("invalid pointer region %dx%d", region.Width, region.Height)
+		}
+		if err := validateRoles(region.Roles); err != nil {
+			return nil, err
+		}
+	}
+
+	chords := make([]compiledChord, 0, len(p.BlockedChords))
+	for _, rule := range p.BlockedChords {
+		chord, err := parseKeyChord(rule.Chord)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateRoles(rule.Roles); err != nil {
+			return nil, err
+		}
+		chords = append(chords, compiledChord{name: rule.Chord, chord: chord, roles: rule.Roles})
+	}
+	return chords, nil
+}
+
+func validateRoles(roles []ViewerRole) error {
+	for _, role := range roles {
+		if err := role.validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appliesTo(roles []ViewerRole, role ViewerRole) bool {
+	if len(roles) == 0 {
+		return true
+	}
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func (r PointerRegion) contains(x, y int) bool {
+	return image.Pt(x, y).In(image.Rect(r.X, r.Y, r.X+r.Width, r.Y+r.Height))
+}
+
+// AddInputFilter appends filter to the input filter chain.
+func (m *Multiplexer) AddInputFilter(filter InputFilter) {
+	m.filtersMu.Lock()
+	defer m.filtersMu.Unlock()
+	m.inputFilters = append(m.inputFilters, filter)
+}
+
+// filterInput runs event from v through the input policy and the filter
+// chain, reporting whether it may be sent on.
+func (m *Multiplexer) filterInput(v *viewer, event *InputEvent) bool {
+	event.ViewerID = v.id
+	event.Role = m.viewerRole(v)
+	event.Time = time.Now()
+	var buttons uint8
+	event.HeldKeys, buttons = m.viewerHeldInput(v)
+
+	release := (event.Pointer && event.ButtonMask&buttons != buttons) || (!event.Pointer && !event.Down)
+	if !release && !m.takeInputToken(v, event.Time) {
+		return false
+	}
+
+	if event.Pointer {
+		if !m.pointerAllowed(event) {
+			if !release {
+				return false
+			}
+			event.X, event.Y = v.pointer.X, v.pointer.Y
+		}
+	} else if event.Down && len(m.blockedChords) > 0 {
+		// the target sees the keys of all viewers at once, so a chord can
+		// be completed across viewers
+		held := m.heldKeys()
+		for _, rule := range m.blockedChords {
+			if appliesTo(rule.roles, event.Role) && rule.chord.completedBy(event.Key, held) {
+				m.logger.Printf("Blocked %s from viewer %s.", rule.name, v.id)
+				m.audit(AuditEvent{Type: "blocked", Viewer: v.id, Keys: rule.name, Reason: "chord"})
+				return false
+			}
+		}
+	}
+
+	m.filtersMu.Lock()
+	filters := m.inputFilters
+	m.filtersMu.Unlock()
+	for _, filter := range filters {
+		if !filter(event) {
+			return false
+		}
+	}
+
+	if event.Pointer {
+		v.pointer = image.Pt(event.X, event.Y)
+	}
+	return true
+}
+
+// takeInputToken rate limits v with a token bucket refilled at
+// maxInputRate tokens per second.
+func (m *Multiplexer) takeInputToken(v *viewer, now time.Time) bool {
+	if m.maxInputRate <= 0 {
+		return true
+	}
+
+	limit := float64(m.maxInputRate)
+	if v.inputRefill.IsZero() {
+		v.inputTokens = limit
+	} else {
+		v.inputTokens = min(limit, v.inputTokens+now.Sub(v.inputRefill).Seconds()*limit)
+	}
+	v.inputRefill = now
+
+	if v.inputTokens < 1 {
+		if !v.rateLimited {
+			v.rateLimited = true
+			m.logger.Printf("Viewer %s exceeds %d input events per second, dropping input.", v.id, m.maxInputRate)
+			m.audit(AuditEvent{Type: "blocked", Viewer: v.id, Reason: "rateLimit"})
+		}
+		return false
+	}
+	v.inputTokens--
+	v.rateLimited = false
+	return true
+}
+
+func (m *Multiplexer) pointerAllowed(event *InputEvent) bool {
+	confined, inside := false, false
+	for _, region := range m.pointerRegions {
+		if !appliesTo(region.Roles, event.Role) {
+			continue
+		}
+		if region.Deny {
+			if region.contains(event.X, event.Y) {
+				return false
+			}
+			continue
+		}
+		confined = true
+		inside = inside || region.contains(event.X, event.Y)
+	}
+	return !confined || inside
+}
+
+func (m *Multiplexer) viewerHeldInput(v *viewer) (map[uint32]bool, uint8) {
+	m.inputMu.Lock()
+	defer m.inputMu.Unlock()
+
+	keys := make(map[uint32]bool)
+	p := m.pressed[v]
+	if p == nil {
+		return keys, 0
+	}
+	for key := range p.keys {
+		keys[key] = true
+	}
+	return keys, p.buttons
+}
+
+// heldKeys returns the keysyms any viewer holds down on the target.
+func (m *Multiplexer) heldKeys() map[uint32]bool {
+	m.inputMu.Lock()
+	defer m.inputMu.Unlock()
+
+	keys := make(map[uint32]bool)
+	for _, p := range m.pressed {
+		for key := range p.keys {
+			keys[key] = true
+		}
+	}
+	return keys
+}
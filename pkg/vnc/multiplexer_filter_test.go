@@ -0,0 +1,193 @@
+package vnc
+
+import (
+	"image"
+	"io"
+	"log"
+	"testing"
+	"time"
+)
+
+func newFilterTestMultiplexer(t *testing.T, policy InputPolicy) *Multiplexer {
+	t.Helper()
+	chords, err := policy.compile()
+	if err != nil {
+		t.Fatalf("compile: %v", err)
+	}
+	return &Multiplexer{
+		logger:         log.New(io.Discard, "", 0),
+		blockedChords:  chords,
+		maxInputRate:   policy.MaxEventsPerSecond,
+		pointerRegions: policy.PointerRegions,
+		pressed:        make(map[*viewer]*pressedInput),
+	}
+}
+
+func TestFilterInputChords(t *testing.T) {
+	m := newFilterTestMultiplexer(t, InputPolicy{BlockedChords: []ChordRule{
+		{Chord: "Ctrl+Alt+Delete"},
+		{Chord: "Super", Roles: []ViewerRole{RoleFull}},
+	}})
+
+	tests := []struct {
+		name   string
+		role   ViewerRole
+		held   []uint32
+		others []uint32 // held by another viewer
+		key    uint32
+		down   bool
+		want   bool
+	}{
+		{name: "ctrl alt delete", role: RoleFull, held: []uint32{0xffe3, 0xffe9}, key: 0xffff, down: true},
+		{name: "ctrl alt keypad delete", role: RoleFull, held: []uint32{0xffe3, 0xffe9}, key: 0xff9f, down: true},
+		{name: "across viewers", role: RoleFull, held: []uint32{0xffe9}, others: []uint32{0xffe3}, key: 0xffff, down: true},
+		{name: "delete alone", role: RoleFull, key: 0xffff, down: true, want: true},
+		{name: "release after block", role: RoleFull, held: []uint32{0xffe3, 0xffe9}, key: 0xffff, want: true},
+		{name: "super for full", role: RoleFull, key: 0xffeb, down: true},
+		{name: "super for admin", role: RoleAdmin, key: 0xffeb, down: true, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &viewer{id: "viewer-1", role: tt.role}
+			other := &viewer{id: "viewer-2", role: RoleFull}
+			m.pressed = map[*viewer]*pressedInput{
+				v:     {keys: make(map[uint32]bool)},
+				other: {keys: make(map[uint32]bool)},
+			}
+			for _, key := range tt.held {
+				m.pressed[v].keys[key] = true
+			}
+			for _, key := range tt.others {
+				m.pressed[other].keys[key] = true
+			}
+
+			event := &InputEvent{Key: tt.key, Down: tt.down}
+			if got := m.filterInput(v, event); got != tt.want {
+				t.Errorf("filterInput = %v, want %v", got, tt.want)
+			}
+			if event.ViewerID != v.id || event.Role != tt.role || len(event.HeldKeys) != len(tt.held) {
+				t.Errorf("event not filled in: %+v", event)
+			}
+		})
+	}
+}
+
+func TestFilterInputPointerRegions(t *testing.T) {
+	m := newFilterTestMultiplexer(t, InputPolicy{PointerRegions: []PointerRegion{
+		{X: 0, Y: 0, Width: 100, Height: 100},
+		{X: 40, Y: 40, Width: 20, Height: 20, Deny: true},
+		{X: 0, Y: 0, Width: 1000, Height: 1000, Roles: []ViewerRole{RoleAdmin}},
+	}})
+
+	tests := []struct {
+		name    string
+		role    ViewerRole
+		buttons uint8 // held before the event
+		event   InputEvent
+		want    bool
+		wantAt  image.Point // where an allowed event ends up
+	}{
+		{name: "inside", role: RoleFull, event: InputEvent{Pointer: true, X: 10, Y: 10}, want: true, wantAt: image.Pt(10, 10)},
+		{name: "outside", role: RoleFull, event: InputEvent{Pointer: true, X: 200, Y: 10}},
+		{name: "denied hole", role: RoleFull, event: InputEvent{Pointer: true, X: 50, Y: 50}},
+		{name: "admin region", role: RoleAdmin, event: InputEvent{Pointer: true, X: 200, Y: 10}, want: true, wantAt: image.Pt(200, 10)},
+		{name: "release outside", role: RoleFull, buttons: 1, event: InputEvent{Pointer: true, X: 200, Y: 10}, want: true, wantAt: image.Pt(5, 5)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &viewer{id: "viewer-1", role: tt.role, pointer: image.Pt(5, 5)}
+			m.pressed[v] = &pressedInput{keys: map[uint32]bool{}, buttons: tt.buttons}
+
+			event := tt.event
+			if got := m.filterInput(v, &event); got != tt.want {
+				t.Fatalf("filterInput = %v, want %v", got, tt.want)
+			}
+			if tt.want && image.Pt(event.X, event.Y) != tt.wantAt {
+				t.Errorf("event sent at %d,%d, want %v", event.X, event.Y, tt.wantAt)
+			}
+		})
+	}
+}
+
+func TestFilterInputChain(t *testing.T) {
+	m := newFilterTestMultiplexer(t, InputPolicy{})
+	var seen []uint32
+	m.AddInputFilter(func(event *InputEvent) bool {
+		if event.Key == 'a' {
+			event.Key = 'b'
+		}
+		return true
+	})
+	m.AddInputFilter(func(event *InputEvent) bool {
+		seen = append(seen, event.Key)
+		return event.Key != 'x'
+	})
+
+	v := &viewer{id: "viewer-1", role: RoleFull}
+	remapped := &InputEvent{Key: 'a', Down: true}
+	if !m.filterInput(v, remapped) || remapped.Key != 'b' {
+		t.Errorf("remapped event: key %q", rune(remapped.Key))
+	}
+	if m.filterInput(v, &InputEvent{Key: 'x', Down: true}) {
+		t.Error("event dropped by the second filter was let through")
+	}
+	if len(seen) != 2 || seen[0] != 'b' {
+		t.Errorf("second filter saw %q, want the remapped key first", seen)
+	}
+}
+
+func TestTakeInputToken(t *testing.T) {
+	m := newFilterTestMultiplexer(t, InputPolicy{MaxEventsPerSecond: 5})
+	v := &viewer{id: "viewer-1"}
+	start := time.Now()
+
+	for i := 0; i < 5; i++ {
+		if !m.takeInputToken(v, start) {
+			t.Fatalf("event %d of the initial burst dropped", i+1)
+		}
+	}
+	if m.takeInputToken(v, start) {
+		t.Fatal("event beyond the burst allowed")
+	}
+	if !v.rateLimited {
+		t.Error("viewer not marked rate limited")
+	}
+	if m.takeInputToken(v, start.Add(100*time.Millisecond)) {
+		t.Error("token granted before one was refilled")
+	}
+	if !m.takeInputToken(v, start.Add(300*time.Millisecond)) {
+		t.Error("refilled token not granted")
+	}
+	if v.rateLimited {
+		t.Error("viewer still marked rate limited")
+	}
+	if !m.takeInputToken(v, start.Add(time.Hour)) || v.inputTokens > 4 {
+		t.Errorf("bucket overfilled to %.1f tokens", v.inputTokens+1)
+	}
+}
+
+func TestInputPolicyCompile(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  InputPolicy
+		wantErr bool
+	}{
+		{name: "empty"},
+		{name: "chords", policy: InputPolicy{BlockedChords: []ChordRule{{Chord: "Ctrl+Alt+Delete"}, {Chord: "Super", Roles: []ViewerRole{RoleViewOnly}}}}},
+		{name: "bad chord", policy: InputPolicy{BlockedChords: []ChordRule{{Chord: "Ctrl+Nope"}}}, wantErr: true},
+		{name: "bad chord role", policy: InputPolicy{BlockedChords: []ChordRule{{Chord: "Super", Roles: []ViewerRole{"owner"}}}}, wantErr: true},
+		{name: "negative rate", policy: InputPolicy{MaxEventsPerSecond: -1}, wantErr: true},
+		{name: "empty region", policy: InputPolicy{PointerRegions: []PointerRegion{{Width: 0, Height: 10}}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chords, err := tt.policy.compile()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("compile() = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && len(chords) != len(tt.policy.BlockedChords) {
+				t.Errorf("compiled %d chords, want %d", len(chords), len(tt.policy.BlockedChords))
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package vnc
+
+import (
+	"context"
+	"image"
+	"time"
+)
+
+// staleBannerHeight is the height of the overlay marking a stalled picture.
+const staleBannerHeight = 24
+
+// watchHeartbeat asks the target for a non-incremental 1x1 update every
+// heartbeat interval. A target that answers nothing within the heartbeat
+// timeout is marked stalled; one that stays silent for the stall timeout is
+// dropped so Run reconnects or fails over.
+func (m *Multiplexer) watchHeartbeat(ctx context.Context, interrupt context.CancelCauseFunc) {
+	var stalledSince time.Time
+	timer := time.NewTimer(m.heartbeatInterval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		requested := time.Now()
+		m.proxyClient.SendFrameBufferUpdateRequest(0, 0, 1, 1, false)
+
+		timer.Reset(m.heartbeatTimeout)
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		if m.lastUpstreamUpdate.Load() >= requested.UnixNano() {
+			if !stalledSince.IsZero() {
+				m.logger.Println("Target is responding again.")
+				stalledSince = time.Time{}
+				m.clearStaleOverlay()
+				m.setState(StateOnline, nil, 0)
+			}
+		} else {
+			if stalledSince.IsZero() {
+				m.logger.Printf("Target did not answer a heartbeat within %s.", m.heartbeatTimeout)
+				stalledSince = requested
+				m.setState(StateStalled, ErrTargetStalled, 0)
+				m.drawStaleOverlay()
+			}
+			if m.stallTimeout > 0 && time.Since(stalledSince) >= m.stallTimeout {
+				m.logger.Printf("Target stalled for %s, dropping the connection.", m.stallTimeout)
+				interrupt(ErrTargetStalled)
+				return
+			}
+		}
+
+		timer.Reset(m.heartbeatInterval)
+	}
+}
+
+func (m *Multiplexer) drawStaleOverlay() {
+	if !m.staleOverlay || m.proxyServer == nil {
+		return
+	}
+	img := frameBufferImage(m.proxyServer.GetFrameBuffer(), m.proxyServer.GetWidth(), m.proxyServer.GetHeight())
+	if img == nil {
+		return
+	}
+
+	height := min(staleBannerHeight, img.Rect.Dy())
+	banner := img.SubImage(image.Rect(0, 0, img.Rect.Dx(), height)).(*image.RGBA)
+	drawMessageScreen(banner, staleBackground, []string{"Picture is stale: target not responding"})
+	// full-width rows from the top are contiguous in Pix
+	convertFromStandard(img.Pix[:height*img.Stride], m.pixelFormat)
+	m.proxyServer.MarkRectAsModified(0, 0, img.Rect.Dx(), height)
+}
+
+// clearStaleOverlay puts the target's picture back where the overlay was.
+func (m *Multiplexer) clearStaleOverlay() {
+	if !m.staleOverlay || m.proxyServer == nil {
+		return
+	}
+	height := min(staleBannerHeight, m.proxyServer.GetHeight())
+	m.copyFromTarget(0, 0, m.proxyServer.GetWidth(), height)
+}
@@ -0,0 +1,212 @@
+package vnc
+
+import "unsafe"
+
+// pressedInput is what one viewer holds down on the target.
+type pressedInput struct {
+	keys    map[uint32]bool
+	buttons uint8
+}
+
+func (m *Multiplexer) handlePointerEvent(buttonMask, x, y int, clientPtr unsafe.Pointer) {
+	v := m.viewerFor(clientPtr)
+	if v == nil {
+		return
+	}
+	m.touchSession(v)
+	m.trackViewerPointer(v, x, y)
+	if !m.viewerRole(v).canPoint() {
+		return
+	}
+	event := InputEvent{Pointer: true, X: x, Y: y, ButtonMask: uint8(buttonMask)}
+	if !m.filterInput(v, &event) || !m.allowInput(v) {
+		return
+	}
+	x, y, buttonMask = event.X, event.Y, int(event.ButtonMask)
+
+	m.inputMu.Lock()
+	defer m.inputMu.Unlock()
+
+	if m.isShuttingDown() {
+		return
+	}
+	if m.proxyClient != nil && m.proxyClient.IsConnected() {
+		p := m.pressedBy(v)
+		m.auditPointer(v, p.buttons, uint8(buttonMask))
+		p.buttons = uint8(buttonMask)
+		// a button stays down while any viewer holds it
+		mask := m.mergedButtons()
+		m.proxyClient.SendPointerEvent(x, y, mask)
+		m.buttonMask = mask
+		m.pointerX, m.pointerY = x, y
+	}
+}
+
+func (m *Multiplexer) handleKeyEvent(down bool, key uint32, clientPtr unsafe.Pointer) {
+	v := m.viewerFor(clientPtr)
+	if v == nil {
+		return
+	}
+	m.touchSession(v)
+	if !m.viewerRole(v).canType() {
+		return
+	}
+	event := InputEvent{Key: key, Down: down}
+	if !m.filterInput(v, &event) || !m.allowInput(v) {
+		return
+	}
+	key, down = event.Key, event.Down
+
+	m.inputMu.Lock()
+	defer m.inputMu.Unlock()
+
+	if m.isShuttingDown() {
+		return
+	}
+	if m.proxyClient != nil && m.proxyClient.IsConnected() {
+		if down {
+			m.pressedBy(v).keys[key] = true
+			m.proxyClient.SendKeyEvent(key, true)
+			m.auditKey(v, key, event.HeldKeys)
+			return
+		}
+		if p := m.pressed[v]; p != nil {
+			delete(p.keys, key)
+		}
+		// a key stays down while any viewer holds it
+		if !m.keyHeld(key) {
+			m.proxyClient.SendKeyEvent(key, false)
+		}
+	}
+}
+
+// handleViewerCutText forwards clipboard text from viewers allowed to type.
+func (m *Multiplexer) handleViewerCutText(text string, clientPtr unsafe.Pointer) {
+	v := m.viewerFor(clientPtr)
+	if v == nil {
+		return
+	}
+	m.touchSession(v)
+	if !m.viewerRole(v).canType() || !m.allowInput(v) {
+		return
+	}
+
+	m.inputMu.Lock()
+	defer m.inputMu.Unlock()
+
+	if m.isShuttingDown() {
+		return
+	}
+	if m.proxyClient != nil && m.proxyClient.IsConnected() {
+		m.proxyClient.SendCutText(text)
+		m.auditClipboard(v, "toTarget", text)
+	}
+}
+
+// handleTargetCutText forwards clipboard text from the target to all
+// viewers.
+func (m *Multiplexer) handleTargetCutText(text string) {
+	if m.proxyServer == nil || m.isShuttingDown() {
+		return
+	}
+	m.proxyServer.SendCutText(text)
+	m.auditClipboard(nil, "toViewers", text)
+}
+
+// releaseViewerInput sends the target a release for every key and button v
+// holds that no other viewer holds as well.
+func (m *Multiplexer) releaseViewerInput(v *viewer) {
+	m.inputMu.Lock()
+	defer m.inputMu.Unlock()
+
+	p := m.pressed[v]
+	if p == nil {
+		return
+	}
+	delete(m.pressed, v)
+
+	if m.proxyClient == nil || !m.proxyClient.IsConnected() {
+		return
+	}
+	for key := range p.keys {
+		if !m.keyHeld(key) {
+			m.proxyClient.SendKeyEvent(key, false)
+		}
+	}
+	if mask := m.mergedButtons(); mask != m.buttonMask {
+		m.proxyClient.SendPointerEvent(m.pointerX, m.pointerY, mask)
+		m.buttonMask = mask
+	}
+}
+
+// releaseHeldInput sends the target a release for every key and button a
+// viewer still holds, so nothing stays stuck once viewers are gone or the
+// upstream connection is dropped. The releases are sent again to the next
+// target connection, as the current one may already be dead.
+func (m *Multiplexer) releaseHeldInput() {
+	m.inputMu.Lock()
+	defer m.inputMu.Unlock()
+
+	connected := m.proxyClient != nil && m.proxyClient.IsConnected()
+	for _, p := range m.pressed {
+		for key := range p.keys {
+			if connected {
+				m.proxyClient.SendKeyEvent(key, false)
+			}
+			m.pendingKeys[key] = true
+		}
+	}
+	if m.buttonMask != 0 {
+		if connected {
+			m.proxyClient.SendPointerEvent(m.pointerX, m.pointerY, 0)
+		}
+		m.pendingButtons = true
+	}
+	m.pressed = make(map[*viewer]*pressedInput)
+	m.buttonMask = 0
+}
+
+// flushPendingRelease sends a freshly connected target the releases owed
+// since the previous connection.
+func (m *Multiplexer) flushPendingRelease() {
+	m.inputMu.Lock()
+	defer m.inputMu.Unlock()
+
+	if m.proxyClient == nil || !m.proxyClient.IsConnected() {
+		return
+	}
+	for key := range m.pendingKeys {
+		m.proxyClient.SendKeyEvent(key, false)
+	}
+	if m.pendingButtons {
+		m.proxyClient.SendPointerEvent(m.pointerX, m.pointerY, 0)
+	}
+	m.pendingKeys = make(map[uint32]bool)
+	m.pendingButtons = false
+}
+
+func (m *Multiplexer) pressedBy(v *viewer) *pressedInput {
+	p := m.pressed[v]
+	if p == nil {
+		p = &pressedInput{keys: make(map[uint32]bool)}
+		m.pressed[v] = p
+	}
+	return p
+}
+
+func (m *Multiplexer) keyHeld(key uint32) bool {
+	for _, p := range m.pressed {
+		if p.keys[key] {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Multiplexer) mergedButtons() uint8 {
+	var mask uint8
+	for _, p := range m.pressed {
+		mask |= p.buttons
+	}
+	return mask
+}
@@ -0,0 +1,60 @@
+package vnc
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMultiplexerReleasesInputOfLeavingViewers(t *testing.T) {
+	_, ports, srv := runFakeMultiplexer(t, MultiplexerConfig{})
+	first := srv.connect("10.0.0.1:5000")
+	second := srv.connect("10.0.0.2:5000")
+	client := ports.client()
+
+	srv.key(first, 0xffe3, true) // Control_L
+	srv.key(second, 0xffe3, true)
+	srv.key(first, 'a', true)
+	srv.pointer(first, 5, 5, 1)
+	srv.pointer(second, 6, 6, 4)
+
+	// the other viewer still holds Control_L and button 3
+	srv.CloseClient(first)
+	srv.CloseClient(second)
+
+	wantKeys := []fakeKey{{0xffe3, true}, {0xffe3, true}, {'a', true}, {'a', false}, {0xffe3, false}}
+	if got := client.sentKeys(); !reflect.DeepEqual(got, wantKeys) {
+		t.Errorf("keys sent to the target = %v, want %v", got, wantKeys)
+	}
+	wantPointers := []fakePointer{{5, 5, 1}, {6, 6, 5}, {6, 6, 4}, {6, 6, 0}}
+	if got := client.sentPointers(); !reflect.DeepEqual(got, wantPointers) {
+		t.Errorf("pointer events sent to the target = %v, want %v", got, wantPointers)
+	}
+}
+
+func TestMultiplexerReleasesHeldInputAfterReconnect(t *testing.T) {
+	_, ports, srv := runFakeMultiplexer(t, MultiplexerConfig{
+		Reconnect: &BackoffPolicy{InitialInterval: Duration(time.Millisecond), Multiplier: 1},
+	})
+	viewer := srv.connect("10.0.0.1:5000")
+	dropped := ports.client()
+	srv.key(viewer, 0xffe1, true) // Shift_L
+	srv.pointer(viewer, 7, 8, 1)
+
+	dropped.drop <- errors.New("connection reset")
+	waitFor(t, "the reconnect", func() bool {
+		c := ports.client()
+		return c != dropped && c.IsConnected()
+	})
+
+	client := ports.client()
+	waitFor(t, "the releases", func() bool { return len(client.sentKeys()) > 0 && len(client.sentPointers()) > 0 })
+	if got, want := client.sentKeys(), []fakeKey{{0xffe1, false}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("keys sent to the new connection = %v, want %v", got, want)
+	}
+	if got, want := client.sentPointers(), []fakePointer{{7, 8, 0}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("pointer events sent to the new connection = %v, want %v", got, want)
+	}
+
+}
@@ -0,0 +1,259 @@
+package vnc
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"sort"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// ViewerPointerLabel decides what labels a viewer's pointer in the overlay.
+type ViewerPointerLabel string
+
+const (
+	// PointerLabelName labels pointers with the viewer's credential name,
+	// or its ID without one.
+	PointerLabelName ViewerPointerLabel = "name"
+	// PointerLabelAddress labels pointers with the viewer's address.
+	PointerLabelAddress ViewerPointerLabel = "address"
+)
+
+func (label ViewerPointerLabel) validate() error {
+	switch label {
+	case "", PointerLabelName, PointerLabelAddress:
+		return nil
+	default:
+		return fmt.Errorf("unknown viewer pointer label %q", label)
+	}
+}
+
+// viewerPointerColors are handed out to viewers in turn; all are dark
+// enough for white label text.
+var viewerPointerColors = []color.RGBA{
+	{R: 0xd0, G: 0x30, B: 0x30, A: 0xff},
+	{R: 0x20, G: 0x80, B: 0x30, A: 0xff},
+	{R: 0x30, G: 0x50, B: 0xc0, A: 0xff},
+	{R: 0xa0, G: 0x40, B: 0xa0, A: 0xff},
+	{R: 0xb0, G: 0x60, B: 0x00, A: 0xff},
+	{R: 0x10, G: 0x80, B: 0x90, A: 0xff},
+}
+
+var pointerOutline = color.RGBA{A: 0xff}
+
+const (
+	pointerArrowHeight = 13
+	pointerLabelHeight = 15
+)
+
+// viewerPointer is where a viewer last pointed and how it is drawn.
+type viewerPointer struct {
+	at     image.Point
+	colour color.RGBA
+}
+
+// trackViewerPointer records the pointer position of v and has the overlay
+// redrawn if it moved.
+func (m *Multiplexer) trackViewerPointer(v *viewer, x, y int) {
+	if !m.viewerPointers {
+		return
+	}
+
+	label := m.viewerPointerLabel(v)
+	m.pointersMu.Lock()
+	p := m.pointerPositions[v]
+	if p == nil {
+		p = &viewerPointer{at: image.Pt(-1, -1), colour: viewerPointerColors[m.nextPointerColour%len(viewerPointerColors)]}
+		m.nextPointerColour++
+		m.pointerPositions[v] = p
+	}
+	moved := p.at != image.Pt(x, y)
+	p.at = image.Pt(x, y)
+	m.pointersMu.Unlock()
+
+	if moved {
+		m.schedulePointerRedraw(viewerPointerBounds(image.Pt(x, y), label))
+	}
+}
+
+// forgetViewerPointer removes the pointer of a viewer that left.
+func (m *Multiplexer) forgetViewerPointer(v *viewer) {
+	if !m.viewerPointers {
+		return
+	}
+
+	m.pointersMu.Lock()
+	_, ok := m.pointerPositions[v]
+	delete(m.pointerPositions, v)
+	m.pointersMu.Unlock()
+
+	if ok {
+		m.schedulePointerRedraw(image.Rectangle{})
+	}
+}
+
+// schedulePointerRedraw has the overlay redrawn on the proxy client
+// goroutine, which alone may copy from the target. The target is asked to
+// resend the pointers drawn so far and area, so that an update arrives to
+// redraw on.
+func (m *Multiplexer) schedulePointerRedraw(area image.Rectangle) {
+	m.pointersDirty.Store(true)
+	if m.proxyServer == nil || m.proxyClient == nil || !m.proxyClient.IsConnected() {
+		return
+	}
+
+	m.pointersMu.Lock()
+	for _, mark := range m.pointerMarks {
+		area = area.Union(mark)
+	}
+	m.pointersMu.Unlock()
+
+	area = area.Intersect(image.Rect(0, 0, m.proxyServer.GetWidth(), m.proxyServer.GetHeight()))
+	if !area.Empty() {
+		m.proxyClient.SendFrameBufferUpdateRequest(area.Min.X, area.Min.Y, area.Dx(), area.Dy(), false)
+	}
+}
+
+// redrawPendingPointers redraws the overlay if pointers moved since it was
+// last drawn. Like redrawViewerPointers it must not run concurrently with
+// the proxy client's event loop.
+func (m *Multiplexer) redrawPendingPointers() {
+	if m.pointersDirty.Swap(false) {
+		m.redrawViewerPointers()
+	}
+}
+
+// viewerPointersCover reports whether an update of the given rectangle
+// was drawn over a viewer's pointer.
+func (m *Multiplexer) viewerPointersCover(x, y, w, h int) bool {
+	if !m.viewerPointers {
+		return false
+	}
+
+	m.pointersMu.Lock()
+	defer m.pointersMu.Unlock()
+	updated := image.Rect(x, y, x+w, y+h)
+	for _, mark := range m.pointerMarks {
+		if mark.Overlaps(updated) {
+			return true
+		}
+	}
+	return false
+}
+
+// redrawViewerPointers puts the target's picture back where pointers were
+// drawn and draws them at their current positions. The overlay only lives
+// in the proxy framebuffer; nothing of it reaches the target. It runs on
+// the proxy client goroutine, see schedulePointerRedraw.
+func (m *Multiplexer) redrawViewerPointers() {
+	if !m.viewerPointers || m.proxyServer == nil || m.proxyClient == nil || !m.proxyClient.IsConnected() {
+		return
+	}
+
+	m.pointersMu.Lock()
+	defer m.pointersMu.Unlock()
+
+	width, height := m.proxyServer.GetWidth(), m.proxyServer.GetHeight()
+	restoredStale, restoredBanner := false, false
+	for _, mark := range m.pointerMarks {
+		m.copyFromTarget(mark.Min.X, mark.Min.Y, mark.Dx(), mark.Dy())
+		restoredStale = restoredStale || mark.Min.Y < staleBannerHeight
+		restoredBanner = restoredBanner || m.sessionBannerCovers(mark.Min.Y, mark.Dy())
+	}
+	m.pointerMarks = m.pointerMarks[:0]
+	if restoredStale && m.State() == StateStalled {
+		m.drawStaleOverlay()
+	}
+	if restoredBanner {
+		m.drawSessionOverlay()
+	}
+
+	img := frameBufferImage(m.proxyServer.GetFrameBuffer(), width, height)
+	if img == nil {
+		return
+	}
+
+	viewers := make([]*viewer, 0, len(m.pointerPositions))
+	for v, p := range m.pointerPositions {
+		if p.at.X >= 0 {
+			viewers = append(viewers, v)
+		}
+	}
+	sort.Slice(viewers, func(i, j int) bool {
+		return viewers[i].joined.Before(viewers[j].joined)
+	})
+	for _, v := range viewers {
+		p := m.pointerPositions[v]
+		mark := m.drawViewerPointer(img, p.at, m.viewerPointerLabel(v), p.colour)
+		if !mark.Empty() {
+			m.pointerMarks = append(m.pointerMarks, mark)
+			m.proxyServer.MarkRectAsModified(mark.Min.X, mark.Min.Y, mark.Dx(), mark.Dy())
+		}
+	}
+}
+
+func (m *Multiplexer) viewerPointerLabel(v *viewer) string {
+	if m.pointerLabel == PointerLabelAddress && v.address != "" {
+		return v.address
+	}
+	m.viewersMu.Lock()
+	defer m.viewersMu.Unlock()
+	if v.credential != "" {
+		return v.credential
+	}
+	return v.id
+}
+
+// drawViewerPointer draws an arrow at at with a label next to it into fb,
+// which is in the proxy pixel format, and returns the rectangle it covered.
+func (m *Multiplexer) drawViewerPointer(fb *image.RGBA, at image.Point, label string, colour color.RGBA) image.Rectangle {
+	face := basicfont.Face7x13
+	full := viewerPointerBounds(at, label)
+	bounds := full.Intersect(fb.Rect)
+	if bounds.Empty() {
+		return bounds
+	}
+
+	// draw on a copy in PixelFormatStandard layout
+	img := image.NewRGBA(bounds)
+	rowBytes := bounds.Dx() * 4
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		copy(img.Pix[img.PixOffset(bounds.Min.X, y):][:rowBytes], fb.Pix[fb.PixOffset(bounds.Min.X, y):])
+	}
+	convertToStandard(img.Pix, m.pixelFormat)
+
+	// arrow pointing up and to the left, outlined for contrast
+	for row := 0; row < pointerArrowHeight; row++ {
+		edge := row * 2 / 3
+		for col := 0; col <= edge; col++ {
+			c := colour
+			if col == 0 || col == edge || row == pointerArrowHeight-1 {
+				c = pointerOutline
+			}
+			img.SetRGBA(at.X+col, at.Y+row, c)
+		}
+	}
+
+	box := image.Rect(at.X+8, at.Y+pointerArrowHeight-2, full.Max.X, full.Max.Y)
+	draw.Draw(img, box, &image.Uniform{colour}, image.Point{}, draw.Src)
+	drawer := font.Drawer{Dst: img, Src: image.NewUniform(screenTextColor), Face: face}
+	drawer.Dot = fixed.P(box.Min.X+3, box.Min.Y+face.Metrics().Ascent.Ceil()+1)
+	drawer.DrawString(label)
+
+	convertFromStandard(img.Pix, m.pixelFormat)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		copy(fb.Pix[fb.PixOffset(bounds.Min.X, y):][:rowBytes], img.Pix[img.PixOffset(bounds.Min.X, y):])
+	}
+	return bounds
+}
+
+// viewerPointerBounds returns the rectangle a pointer drawn at at with
+// label covers.
+func viewerPointerBounds(at image.Point, label string) image.Rectangle {
+	labelWidth := font.MeasureString(basicfont.Face7x13, label).Ceil() + 6
+	return image.Rect(at.X, at.Y, at.X+8+labelWidth, at.Y+pointerArrowHeight-2+pointerLabelHeight)
+}
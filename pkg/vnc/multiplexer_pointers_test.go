@@ -0,0 +1,60 @@
+package vnc
+
+import (
+	"bytes"
+	"image"
+	"testing"
+)
+
+func TestMultiplexerDrawsViewerPointersOnUpdates(t *testing.T) {
+	_, ports, srv := runFakeMultiplexer(t, MultiplexerConfig{ViewerPointers: true})
+	client := ports.client()
+	target := client.GetFrameBuffer()
+	for i := range target {
+		target[i] = 0x40
+	}
+	client.update(image.Rect(0, 0, 64, 48))
+
+	// pixel offset of x, y in both framebuffers
+	at := func(x, y int) int { return (y*64 + x) * 4 }
+	drawn := func(x, y int) bool {
+		return !bytes.Equal(srv.GetFrameBuffer()[at(x, y):at(x, y)+4], target[at(x, y):at(x, y)+4])
+	}
+
+	// the requests made since connecting
+	connected := len(client.updateRequests())
+	requested := func() []image.Rectangle { return client.updateRequests()[connected:] }
+
+	viewer := srv.connect("10.0.0.1:5000")
+	srv.pointer(viewer, 10, 10, 0)
+	if drawn(10, 10) {
+		t.Fatal("pointer drawn by the viewer's event handler")
+	}
+	requests := requested()
+	if len(requests) != 1 || !image.Pt(10, 10).In(requests[0]) {
+		t.Fatalf("update requests = %v, want one covering the pointer", requests)
+	}
+	client.update(requests[0])
+	if !drawn(10, 10) {
+		t.Fatal("pointer not drawn on the target's update")
+	}
+
+	srv.pointer(viewer, 30, 20, 0)
+	requests = requested()
+	if len(requests) != 2 || !image.Pt(10, 10).In(requests[1]) || !image.Pt(30, 20).In(requests[1]) {
+		t.Fatalf("update requests = %v, want one covering both positions", requests)
+	}
+	client.update(requests[1])
+	if drawn(10, 10) || !drawn(30, 20) {
+		t.Errorf("pointer drawn at 10,10: %v, at 30,20: %v; want it moved", drawn(10, 10), drawn(30, 20))
+	}
+	if sent := client.sentPointers(); len(sent) != 2 || sent[1] != (fakePointer{30, 20, 0}) {
+		t.Errorf("pointer events sent to the target = %v", sent)
+	}
+
+	srv.CloseClient(viewer)
+	client.update(requested()[2])
+	if drawn(30, 20) {
+		t.Error("pointer of a viewer that left still drawn")
+	}
+}
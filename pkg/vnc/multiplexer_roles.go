@@ -0,0 +1,175 @@
+package vnc
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"time"
+	"unsafe"
+)
+
+// ViewerRole decides what input a viewer may send to the target.
+type ViewerRole string
+
+const (
+	// RoleViewOnly viewers only watch; all their input is dropped.
+	RoleViewOnly ViewerRole = "viewOnly"
+	// RolePointerOnly viewers may move and click the pointer but not type.
+	RolePointerOnly ViewerRole = "pointerOnly"
+	// RoleFull viewers may use pointer and keyboard, subject to the control
+	// mode.
+	RoleFull ViewerRole = "full"
+	// RoleAdmin viewers have full control and are never held back by the
+	// control mode.
+	RoleAdmin ViewerRole = "admin"
+)
+
+func (r ViewerRole) validate() error {
+	switch r {
+	case RoleViewOnly, RolePointerOnly, RoleFull, RoleAdmin:
+		return nil
+	default:
+		return fmt.Errorf("unknown viewer role %q", r)
+	}
+}
+
+func (r ViewerRole) canPoint() bool {
+	return r == RolePointerOnly || r == RoleFull || r == RoleAdmin
+}
+
+func (r ViewerRole) canType() bool {
+	return r == RoleFull || r == RoleAdmin
+}
+
+// ViewerCredential is a password viewers may authenticate with and the role
+// it grants.
+type ViewerCredential struct {
+	// Name identifies the credential in ViewerAuthInfo and logs.
+	Name     string     `json:"name,omitempty" yaml:"name,omitempty"`
+	Password string     `json:"password" yaml:"password"`
+	Role     ViewerRole `json:"role" yaml:"role"`
+}
+
+// ViewerAuthInfo is passed to the viewer authorization callback.
+type ViewerAuthInfo struct {
+	ViewerID string
+	Address  string
+	// Credential is the name of the credential the viewer authenticated
+	// with, empty when no credentials are configured.
+	Credential string
+	// Role is the role the credential grants, or the default role.
+	Role ViewerRole
+}
+
+// ViewerAuthorizer decides a viewer's role once it has authenticated.
+// Returning an error refuses the viewer.
+type ViewerAuthorizer func(info ViewerAuthInfo) (ViewerRole, error)
+
+// ViewerRole returns the role of a connected viewer.
+func (m *Multiplexer) ViewerRole(viewerID string) (ViewerRole, error) {
+	v := m.viewerByID(viewerID)
+	if v == nil {
+		return "", fmt.Errorf("unknown viewer %q", viewerID)
+	}
+	m.viewersMu.Lock()
+	defer m.viewersMu.Unlock()
+	return v.role, nil
+}
+
+// SetViewerRole changes the role of a connected viewer. Input it still holds
+// is released, and a viewer that may no longer type loses control.
+func (m *Multiplexer) SetViewerRole(viewerID string, role ViewerRole) error {
+	if err := role.validate(); err != nil {
+		return err
+	}
+	v := m.viewerByID(viewerID)
+	if v == nil {
+		return fmt.Errorf("unknown viewer %q", viewerID)
+	}
+
+	m.viewersMu.Lock()
+	previous := v.role
+	v.role = role
+	m.viewersMu.Unlock()
+	if previous == role {
+		return nil
+	}
+	m.logger.Printf("Viewer %s role changed from %s to %s.", v.id, previous, role)
+	m.audit(AuditEvent{Type: "role", Viewer: v.id, Role: role, Reason: "changed from " + string(previous)})
+
+	if !role.canType() {
+		m.controlMu.Lock()
+		var event ControlEvent
+		changed := false
+		if m.controller == v {
+			event, changed = m.passControlLocked("role")
+		}
+		m.controlMu.Unlock()
+		m.controlChanged(event, changed, false)
+	}
+	m.releaseViewerInput(v)
+	return nil
+}
+
+func (m *Multiplexer) viewerRole(v *viewer) ViewerRole {
+	m.viewersMu.Lock()
+	defer m.viewersMu.Unlock()
+	return v.role
+}
+
+// authorizeViewer settles the role of a viewer that has authenticated,
+// asking the authorizer if there is one.
+func (m *Multiplexer) authorizeViewer(v *viewer, credential string, role ViewerRole) error {
+	if m.authorizer != nil {
+		var err error
+		role, err = m.authorizer(ViewerAuthInfo{
+			ViewerID:   v.id,
+			Address:    v.address,
+			Credential: credential,
+			Role:       role,
+		})
+		if err == nil {
+			err = role.validate()
+		}
+		if err != nil {
+			m.audit(AuditEvent{Type: "refused", Viewer: v.id, Address: v.address, Credential: credential, Reason: err.Error()})
+			return err
+		}
+	}
+
+	m.viewersMu.Lock()
+	v.credential = credential
+	v.role = role
+	v.authorized = true
+	m.viewersMu.Unlock()
+
+	m.logger.Printf("Viewer %s authorized as %s.", v.id, role)
+	m.audit(AuditEvent{Type: "connect", Viewer: v.id, Address: v.address, Role: role, Credential: credential})
+	m.notifyViewerEvent(ViewerEvent{Type: "joined", Viewer: m.viewerInfo(v), Time: time.Now()})
+	m.notifyViewersChanged()
+	return nil
+}
+
+// handlePasswordCheck accepts a viewer whose response matches one of the
+// credentials, granting that credential's role.
+func (m *Multiplexer) handlePasswordCheck(clientPtr unsafe.Pointer, challenge, response []byte) bool {
+	v := m.viewerFor(clientPtr)
+	if v == nil {
+		return false
+	}
+
+	for _, credential := range m.credentials {
+		expected, err := vncAuthResponse(challenge, credential.Password)
+		if err != nil || subtle.ConstantTimeCompare(expected, response) != 1 {
+			continue
+		}
+		if err := m.authorizeViewer(v, credential.Name, credential.Role); err != nil {
+			m.logger.Printf("Viewer %s refused: %v", v.id, err)
+			return false
+		}
+		return true
+	}
+
+	m.logger.Printf("Viewer %s failed authentication.", v.id)
+	m.audit(AuditEvent{Type: "authFailed", Viewer: v.id, Address: v.address})
+	return false
+}
@@ -0,0 +1,109 @@
+package vnc
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestMultiplexerRolesGateInput(t *testing.T) {
+	tests := []struct {
+		role         ViewerRole
+		wantKeys     int
+		wantPointers int
+	}{
+		{role: RoleViewOnly},
+		{role: RolePointerOnly, wantPointers: 1},
+		{role: RoleFull, wantKeys: 1, wantPointers: 1},
+		{role: RoleAdmin, wantKeys: 1, wantPointers: 1},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.role), func(t *testing.T) {
+			m, ports, srv := runFakeMultiplexer(t, MultiplexerConfig{
+				Credentials: []ViewerCredential{{Name: "team", Password: "secret", Role: tt.role}},
+			})
+			viewer := srv.connect("10.0.0.1:5000")
+			if srv.authenticate(viewer, "wrong") {
+				t.Fatal("viewer accepted with a wrong password")
+			}
+			if !srv.authenticate(viewer, "secret") {
+				t.Fatal("viewer refused")
+			}
+			if role, err := m.ViewerRole("viewer-1"); err != nil || role != tt.role {
+				t.Fatalf("ViewerRole = %s, %v; want %s", role, err, tt.role)
+			}
+
+			srv.key(viewer, 'k', true)
+			srv.pointer(viewer, 5, 5, 1)
+			client := ports.client()
+			if got := len(client.sentKeys()); got != tt.wantKeys {
+				t.Errorf("%d key events reached the target, want %d", got, tt.wantKeys)
+			}
+			if got := len(client.sentPointers()); got != tt.wantPointers {
+				t.Errorf("%d pointer events reached the target, want %d", got, tt.wantPointers)
+			}
+		})
+	}
+}
+
+func TestMultiplexerAuthorizerSettlesRole(t *testing.T) {
+	var infos []ViewerAuthInfo
+	m, _, srv := runFakeMultiplexer(t, MultiplexerConfig{
+		Credentials: []ViewerCredential{
+			{Name: "ops", Password: "secret", Role: RoleFull},
+			{Name: "guest", Password: "guest", Role: RoleFull},
+		},
+		Authorize: func(info ViewerAuthInfo) (ViewerRole, error) {
+			infos = append(infos, info)
+			if info.Credential == "guest" {
+				return "", errors.New("guests not allowed")
+			}
+			return RolePointerOnly, nil
+		},
+	})
+
+	if srv.authenticate(srv.connect("10.0.0.1:5000"), "guest") {
+		t.Error("viewer accepted though the authorizer refused it")
+	}
+	if !srv.authenticate(srv.connect("10.0.0.2:5000"), "secret") {
+		t.Fatal("viewer refused")
+	}
+	if role, _ := m.ViewerRole("viewer-2"); role != RolePointerOnly {
+		t.Errorf("role = %s, want the authorizer's %s", role, RolePointerOnly)
+	}
+	want := []ViewerAuthInfo{
+		{ViewerID: "viewer-1", Address: "10.0.0.1:5000", Credential: "guest", Role: RoleFull},
+		{ViewerID: "viewer-2", Address: "10.0.0.2:5000", Credential: "ops", Role: RoleFull},
+	}
+	if !reflect.DeepEqual(infos, want) {
+		t.Errorf("authorizer called with %+v, want %+v", infos, want)
+	}
+}
+
+func TestMultiplexerSetViewerRole(t *testing.T) {
+	m, ports, srv := runFakeMultiplexer(t, MultiplexerConfig{ControlMode: ControlFirstCome})
+	viewer := srv.connect("10.0.0.1:5000")
+	srv.key(viewer, 0xffe3, true) // Control_L
+	if m.Controller() != "viewer-1" {
+		t.Fatalf("Controller() = %q, want viewer-1", m.Controller())
+	}
+
+	if err := m.SetViewerRole("viewer-1", "owner"); err == nil {
+		t.Error("SetViewerRole accepted an unknown role")
+	}
+	if err := m.SetViewerRole("viewer-9", RoleViewOnly); err == nil {
+		t.Error("SetViewerRole accepted an unknown viewer")
+	}
+	if err := m.SetViewerRole("viewer-1", RoleViewOnly); err != nil {
+		t.Fatal(err)
+	}
+	if m.Controller() != "" {
+		t.Errorf("view-only viewer kept control")
+	}
+	srv.key(viewer, 'k', true)
+
+	want := []fakeKey{{0xffe3, true}, {0xffe3, false}}
+	if got := ports.client().sentKeys(); !reflect.DeepEqual(got, want) {
+		t.Errorf("keys sent to the target = %v, want %v", got, want)
+	}
+}
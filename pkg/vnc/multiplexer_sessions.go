@@ -0,0 +1,142 @@
+package vnc
+
+import (
+	"image"
+	"sort"
+	"time"
+)
+
+// sessionLimitsFor returns the session limits applying to role.
+func (m *Multiplexer) sessionLimitsFor(role ViewerRole) SessionLimits {
+	if limits, ok := m.roleSessionLimits[role]; ok {
+		return limits
+	}
+	return m.sessionLimits
+}
+
+func (m *Multiplexer) sessionLimitsEnabled() bool {
+	if m.sessionLimits.enabled() {
+		return true
+	}
+	for _, limits := range m.roleSessionLimits {
+		if limits.enabled() {
+			return true
+		}
+	}
+	return false
+}
+
+// touchSession records input from v, keeping it from idling out.
+func (m *Multiplexer) touchSession(v *viewer) {
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+	v.session.lastInput = time.Now()
+}
+
+// watchSessions enforces session limits until the multiplexer shuts down.
+func (m *Multiplexer) watchSessions() {
+	ticker := time.NewTicker(sessionCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.shuttingDown:
+			return
+		case <-ticker.C:
+			m.checkSessions()
+		}
+	}
+}
+
+func (m *Multiplexer) checkSessions() {
+	m.viewersMu.Lock()
+	viewers := make([]*viewer, 0, len(m.viewers))
+	for _, v := range m.viewers {
+		viewers = append(viewers, v)
+	}
+	m.viewersMu.Unlock()
+
+	now := time.Now()
+	for _, v := range viewers {
+		limits := m.sessionLimitsFor(m.viewerRole(v))
+
+		m.sessionMu.Lock()
+		over, reason, warning := v.session.check(limits, now)
+		if over || (warning != nil && warning.Reason == "") {
+			delete(m.sessionNotices, v)
+		} else if warning != nil {
+			m.sessionNotices[v] = sessionNotice{reason: reason, deadline: now.Add(warning.Remaining)}
+		}
+		m.sessionMu.Unlock()
+
+		switch {
+		case over:
+			m.logger.Printf("Viewer %s reached the %s, disconnecting.", v.id, sessionEndReason(reason))
+			m.disconnectViewer(v, sessionEndReason(reason))
+		case warning != nil && warning.Reason != "":
+			m.logger.Printf("Viewer %s will be disconnected in %s (%s).", v.id, warning.Remaining.Round(time.Second), sessionEndReason(reason))
+		}
+	}
+
+	m.drawSessionOverlay()
+	if m.proxyServer != nil && m.sessionBannerCovers(0, m.proxyServer.GetHeight()) {
+		// the banner may have been drawn over viewers' pointers
+		m.schedulePointerRedraw(image.Rectangle{})
+	}
+}
+
+// sessionBannerLines describes the pending disconnections, if any.
+func (m *Multiplexer) sessionBannerLines() []string {
+	m.sessionMu.Lock()
+	defer m.sessionMu.Unlock()
+
+	now := time.Now()
+	lines := make([]string, 0, len(m.sessionNotices))
+	for v, notice := range m.sessionNotices {
+		lines = append(lines, notice.line(v.id, now))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// drawSessionBanner draws the warning banner across the bottom of img, in
+// PixelFormatStandard layout, and returns its height.
+func (m *Multiplexer) drawSessionBanner(img *image.RGBA) int {
+	return drawWarningBanner(img, m.sessionBannerLines())
+}
+
+// drawSessionOverlay refreshes the warning banner over the target's
+// picture, or removes it once no warning is pending. While the target is
+// not connected the placeholder draws the banner.
+func (m *Multiplexer) drawSessionOverlay() {
+	if m.proxyServer == nil || m.proxyClient == nil || !m.proxyClient.IsConnected() {
+		return
+	}
+	img := frameBufferImage(m.proxyServer.GetFrameBuffer(), m.proxyServer.GetWidth(), m.proxyServer.GetHeight())
+	if img == nil {
+		return
+	}
+
+	height := m.drawSessionBanner(img)
+	m.sessionMu.Lock()
+	previous := m.sessionBanner
+	m.sessionBanner = height
+	m.sessionMu.Unlock()
+
+	if height > 0 {
+		// full-width rows at the bottom are contiguous in Pix
+		top := img.Rect.Dy() - height
+		convertFromStandard(img.Pix[top*img.Stride:], m.pixelFormat)
+		m.proxyServer.MarkRectAsModified(0, top, img.Rect.Dx(), height)
+	} else if previous > 0 {
+		m.copyFromTarget(0, img.Rect.Dy()-previous, img.Rect.Dx(), previous)
+	}
+}
+
+// sessionBannerCovers reports whether an update of rows y to y+h was drawn
+// over the warning banner.
+func (m *Multiplexer) sessionBannerCovers(y, h int) bool {
+	m.sessionMu.Lock()
+	height := m.sessionBanner
+	m.sessionMu.Unlock()
+	return height > 0 && m.proxyServer != nil && y+h > m.proxyServer.GetHeight()-height
+}
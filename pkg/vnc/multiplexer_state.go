@@ -0,0 +1,156 @@
+package vnc
+
+import (
+	"fmt"
+	"time"
+)
+
+// MultiplexerState is the connection state of a Multiplexer.
+type MultiplexerState int
+
+const (
+	// StateConnecting is the initial connection to the target.
+	StateConnecting MultiplexerState = iota
+	// StateOnline means the target is connected and proxied to viewers.
+	StateOnline
+	// StateOffline means the target dropped; viewers see the disconnected
+	// screen until a reconnect attempt starts.
+	StateOffline
+	// StateReconnecting is entered before every reconnect attempt.
+	StateReconnecting
+	// StateResizing means the target came back with a new size and the proxy
+	// server is being recreated.
+	StateResizing
+	// StateStalled means the target is connected but has not answered a
+	// heartbeat in time; viewers see the last frame, optionally marked stale.
+	StateStalled
+	// StateShuttingDown is entered when Shutdown or Close begins.
+	StateShuttingDown
+	// StateClosed is final.
+	StateClosed
+)
+
+func (s MultiplexerState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateOnline:
+		return "online"
+	case StateOffline:
+		return "offline"
+	case StateReconnecting:
+		return "reconnecting"
+	case StateResizing:
+		return "resizing"
+	case StateStalled:
+		return "stalled"
+	case StateShuttingDown:
+		return "shutting down"
+	case StateClosed:
+		return "closed"
+	default:
+		return fmt.Sprintf("MultiplexerState(%d)", int(s))
+	}
+}
+
+// StateEvent describes a state transition.
+type StateEvent struct {
+	From MultiplexerState
+	To   MultiplexerState
+	// Time is when To was entered, Since when From was.
+	Time  time.Time
+	Since time.Time
+	// Err is the cause of the transition, if any: why the target dropped,
+	// why the previous reconnect attempt failed, ErrReconnectGaveUp or
+	// ErrTargetStalled.
+	Err error
+	// Width and Height are the target framebuffer size, or the proxy
+	// server's while the target is not connected.
+	Width  int
+	Height int
+	// Attempt numbers reconnect attempts, starting at 1 in StateReconnecting.
+	Attempt int
+	// Endpoint is the address of the target endpoint in use or being tried,
+	// empty in dial-home mode.
+	Endpoint string
+}
+
+// State returns the current state. It is safe to call from any goroutine.
+func (m *Multiplexer) State() MultiplexerState {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	return m.state
+}
+
+// SubscribeState registers fn to be called with every state transition and
+// returns a function that unregisters it. Callbacks run synchronously, in
+// transition order, on the goroutine making the transition; they must not
+// block and must not call Shutdown or Close.
+func (m *Multiplexer) SubscribeState(fn func(StateEvent)) func() {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+
+	if m.stateSubscribers == nil {
+		m.stateSubscribers = make(map[int]func(StateEvent))
+	}
+	id := m.nextSubscriberID
+	m.nextSubscriberID++
+	m.stateSubscribers[id] = fn
+
+	return func() {
+		m.stateMu.Lock()
+		defer m.stateMu.Unlock()
+		delete(m.stateSubscribers, id)
+	}
+}
+
+// setState moves to state to and notifies subscribers. Leaving
+// StateShuttingDown or StateClosed is not possible.
+func (m *Multiplexer) setState(to MultiplexerState, err error, attempt int) {
+	m.stateMu.Lock()
+	from := m.state
+	if from == StateClosed || (from == StateShuttingDown && to != StateClosed) {
+		m.stateMu.Unlock()
+		return
+	}
+
+	now := time.Now()
+	event := StateEvent{
+		From:     from,
+		To:       to,
+		Time:     now,
+		Since:    m.stateSince,
+		Err:      err,
+		Width:    m.width,
+		Height:   m.height,
+		Attempt:  attempt,
+		Endpoint: m.endpoints[m.activeEndpoint%len(m.endpoints)].String(),
+	}
+
+	m.state = to
+	m.stateSince = now
+	subscribers := make([]func(StateEvent), 0, len(m.stateSubscribers))
+	for _, fn := range m.stateSubscribers {
+		subscribers = append(subscribers, fn)
+	}
+
+	// hold notifyMu across the hand-over so concurrent transitions reach
+	// subscribers in the order they happened
+	m.notifyMu.Lock()
+	defer m.notifyMu.Unlock()
+	m.stateMu.Unlock()
+
+	m.logger.Printf("Multiplexer state: %s -> %s", from, to)
+	for _, fn := range subscribers {
+		fn(event)
+	}
+}
+
+// setSize records the framebuffer size state events report. It is called
+// where the Run goroutine connects the target or sizes the proxy server, so
+// setState never has to ask a client another goroutine may be closing.
+func (m *Multiplexer) setSize(width, height int) {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	m.width, m.height = width, height
+}
@@ -0,0 +1,136 @@
+package vnc
+
+import (
+	"errors"
+	"io"
+	"log"
+	"testing"
+)
+
+func newStateTestMultiplexer() *Multiplexer {
+	return &Multiplexer{
+		logger:    log.New(io.Discard, "", 0),
+		endpoints: []TargetEndpoint{{Host: "desk.example", Port: 5900}},
+	}
+}
+
+func TestMultiplexerStateTransitions(t *testing.T) {
+	errDropped := errors.New("connection reset")
+	tests := []struct {
+		name  string
+		steps []MultiplexerState
+		want  []MultiplexerState // states subscribers see entered
+	}{
+		{
+			name:  "connect and reconnect",
+			steps: []MultiplexerState{StateOnline, StateOffline, StateReconnecting, StateOnline},
+			want:  []MultiplexerState{StateOnline, StateOffline, StateReconnecting, StateOnline},
+		},
+		{
+			name:  "resize and resume",
+			steps: []MultiplexerState{StateOnline, StateResizing, StateOnline},
+			want:  []MultiplexerState{StateOnline, StateResizing, StateOnline},
+		},
+		{
+			name:  "stall and recover",
+			steps: []MultiplexerState{StateOnline, StateStalled, StateOnline},
+			want:  []MultiplexerState{StateOnline, StateStalled, StateOnline},
+		},
+		{
+			name:  "shutdown is final",
+			steps: []MultiplexerState{StateOnline, StateShuttingDown, StateReconnecting, StateClosed, StateOnline},
+			want:  []MultiplexerState{StateOnline, StateShuttingDown, StateClosed},
+		},
+		{
+			name:  "closed directly",
+			steps: []MultiplexerState{StateClosed, StateShuttingDown},
+			want:  []MultiplexerState{StateClosed},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newStateTestMultiplexer()
+			var events []StateEvent
+			m.SubscribeState(func(event StateEvent) {
+				events = append(events, event)
+			})
+
+			for i, state := range tt.steps {
+				m.setState(state, errDropped, i)
+			}
+
+			if len(events) != len(tt.want) {
+				t.Fatalf("got %d transitions, want %d: %+v", len(events), len(tt.want), events)
+			}
+			from := StateConnecting
+			for i, event := range events {
+				if event.From != from || event.To != tt.want[i] {
+					t.Errorf("transition %d: %s -> %s, want %s -> %s", i, event.From, event.To, from, tt.want[i])
+				}
+				if event.Err != errDropped {
+					t.Errorf("transition %d: err %v", i, event.Err)
+				}
+				if event.Endpoint != "desk.example:5900" {
+					t.Errorf("transition %d: endpoint %q", i, event.Endpoint)
+				}
+				from = event.To
+			}
+			if got := m.State(); got != from {
+				t.Errorf("State() = %s, want %s", got, from)
+			}
+		})
+	}
+}
+
+func TestMultiplexerStateUnsubscribe(t *testing.T) {
+	m := newStateTestMultiplexer()
+	calls := 0
+	unsubscribe := m.SubscribeState(func(StateEvent) { calls++ })
+
+	m.setState(StateOnline, nil, 0)
+	unsubscribe()
+	m.setState(StateOffline, nil, 0)
+
+	if calls != 1 {
+		t.Errorf("subscriber called %d times, want 1", calls)
+	}
+}
+
+func TestMultiplexerStateString(t *testing.T) {
+	tests := []struct {
+		state MultiplexerState
+		want  string
+	}{
+		{StateConnecting, "connecting"},
+		{StateShuttingDown, "shutting down"},
+		{StateClosed, "closed"},
+		{MultiplexerState(42), "MultiplexerState(42)"},
+	}
+	for _, tt := range tests {
+		if got := tt.state.String(); got != tt.want {
+			t.Errorf("%d.String() = %q, want %q", int(tt.state), got, tt.want)
+		}
+	}
+}
+
+func TestMultiplexerStateReportsTargetSize(t *testing.T) {
+	m, ports := newFakeMultiplexer(t, MultiplexerConfig{})
+	var events []StateEvent
+	m.SubscribeState(func(event StateEvent) {
+		events = append(events, event)
+	})
+
+	// the client is gone by the time the closed state is entered
+	m.Close()
+	if ports.client().IsConnected() {
+		t.Fatal("target still connected after Close")
+	}
+	if len(events) != 2 {
+		t.Fatalf("got %d transitions, want shutting down and closed", len(events))
+	}
+	for _, event := range events {
+		if event.Width != 64 || event.Height != 48 {
+			t.Errorf("%s reports %dx%d, want 64x48", event.To, event.Width, event.Height)
+		}
+	}
+}
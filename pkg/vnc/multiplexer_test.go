@@ -0,0 +1,199 @@
+package vnc
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNewMultiplexerFromConfigReleasesTargetID(t *testing.T) {
+	targets, err := ListenForTargetsWithLogger("127.0.0.1:0", log.New(io.Discard, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer targets.Close()
+
+	dir := t.TempDir()
+	tests := []struct {
+		name   string
+		modify func(*MultiplexerConfig)
+	}{
+		{name: "placeholder", modify: func(c *MultiplexerConfig) {
+			c.Placeholder = PlaceholderConfig{Mode: PlaceholderImage, ImagePath: filepath.Join(dir, "missing.png")}
+		}},
+		{name: "input policy", modify: func(c *MultiplexerConfig) {
+			c.InputPolicy.BlockedChords = []ChordRule{{Chord: "Ctrl+NoSuchKey"}}
+		}},
+		{name: "audit log", modify: func(c *MultiplexerConfig) {
+			c.Audit = &AuditConfig{Path: filepath.Join(dir, "missing", "audit.log")}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := MultiplexerConfig{Targets: targets, TargetID: "desk", Logger: log.New(io.Discard, "", 0)}
+			tt.modify(&cfg)
+			if _, err := NewMultiplexerFromConfig(cfg); err == nil {
+				t.Fatal("NewMultiplexerFromConfig succeeded")
+			}
+			if err := targets.register("desk"); err != nil {
+				t.Fatalf("target ID still taken: %v", err)
+			}
+			targets.unregister("desk")
+		})
+	}
+}
+
+func TestMultiplexerOnDemandWaitsForAuthorizedViewers(t *testing.T) {
+	m, ports := newFakeMultiplexer(t, MultiplexerConfig{
+		OnDemand:      true,
+		OnDemandGrace: Duration(20 * time.Millisecond),
+		Credentials:   []ViewerCredential{{Name: "ops", Password: "secret", Role: RoleFull}},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+	srv := ports.proxyServer()
+
+	first := srv.connect("10.0.0.1:5000")
+	time.Sleep(30 * time.Millisecond)
+	if hosts := ports.hosts(); len(hosts) != 0 {
+		t.Fatalf("connected to %v for a viewer that has not authenticated", hosts)
+	}
+	if !srv.authenticate(first, "secret") {
+		t.Fatal("viewer refused")
+	}
+	waitFor(t, "the target", func() bool { return m.State() == StateOnline })
+
+	// a viewer still authenticating does not keep the target connected
+	srv.connect("10.0.0.2:5000")
+	srv.CloseClient(first)
+	waitFor(t, "the idle disconnect", func() bool { return !ports.client().IsConnected() })
+}
+
+func TestMultiplexerRunReturnsOnCancel(t *testing.T) {
+	tests := []struct {
+		name    string
+		offline bool // target refuses connections, so Run sleeps between attempts
+	}{
+		{name: "proxying"},
+		{name: "reconnecting", offline: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := MultiplexerConfig{Lazy: tt.offline, Reconnect: &BackoffPolicy{InitialInterval: Duration(time.Hour)}}
+			m, ports := newFakeMultiplexer(t, cfg)
+			if tt.offline {
+				ports.refuseHost("desk.example", errors.New("connection refused"))
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan error, 1)
+			go func() { done <- m.Run(ctx) }()
+
+			waitFor(t, "Run to start", func() bool {
+				m.mu.Lock()
+				defer m.mu.Unlock()
+				return m.running
+			})
+			if tt.offline {
+				waitFor(t, "a failed attempt", func() bool { return len(ports.hosts()) > 0 })
+			}
+			if err := m.Run(ctx); err == nil {
+				t.Error("second Run succeeded while the first is running")
+			}
+
+			cancel()
+			select {
+			case err := <-done:
+				if !errors.Is(err, context.Canceled) {
+					t.Errorf("Run = %v, want context.Canceled", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Run did not return after cancel")
+			}
+		})
+	}
+}
+
+func TestMultiplexerShutdown(t *testing.T) {
+	m, ports := newFakeMultiplexer(t, MultiplexerConfig{})
+	done := make(chan error, 1)
+	go func() { done <- m.Run(context.Background()) }()
+	waitFor(t, "Run to start", func() bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		return m.running
+	})
+
+	srv := ports.proxyServer()
+	viewer := srv.connect("10.0.0.1:5000")
+	srv.key(viewer, 0xffe3, true) // Control_L
+	m.SetShutdownMessage("Back soon")
+	before := append([]byte(nil), srv.GetFrameBuffer()...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := m.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown = %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run = %v after Shutdown, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after Shutdown")
+	}
+
+	if got := ports.client().sentKeys(); len(got) != 2 || got[1] != (fakeKey{0xffe3, false}) {
+		t.Errorf("keys sent to the target = %v, want Control_L released", got)
+	}
+	if bytes.Equal(srv.GetFrameBuffer(), before) {
+		t.Error("maintenance screen not drawn")
+	}
+	if state := m.State(); state != StateClosed {
+		t.Errorf("State() = %s, want %s", state, StateClosed)
+	}
+	if err := m.Run(context.Background()); !errors.Is(err, ErrMultiplexerClosed) {
+		t.Errorf("Run after Shutdown = %v, want ErrMultiplexerClosed", err)
+	}
+}
+
+func TestMultiplexerLazyStartsWithoutTarget(t *testing.T) {
+	m, ports := newFakeMultiplexer(t, MultiplexerConfig{
+		Lazy:          true,
+		DefaultWidth:  320,
+		DefaultHeight: 200,
+		Reconnect:     &BackoffPolicy{InitialInterval: Duration(time.Millisecond), Multiplier: 1},
+	})
+	ports.refuseHost("desk.example", errors.New("connection refused"))
+	srv := ports.proxyServer()
+	if w, h := srv.GetWidth(), srv.GetHeight(); w != 320 || h != 200 {
+		t.Fatalf("proxy server is %dx%d before the target is up, want 320x200", w, h)
+	}
+	srv.connect("10.0.0.1:5000")
+	if n := m.ViewerCount(); n != 1 {
+		t.Fatalf("ViewerCount() = %d while waiting for the target", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go m.Run(ctx)
+	waitFor(t, "failed attempts", func() bool { return len(ports.hosts()) >= 2 })
+	if state := m.State(); state == StateOnline {
+		t.Fatalf("State() = %s with the target refusing connections", state)
+	}
+
+	ports.refuseHost("desk.example", nil)
+	waitFor(t, "the target", func() bool { return m.State() == StateOnline })
+	if w, h := srv.GetWidth(), srv.GetHeight(); w != 64 || h != 48 {
+		t.Errorf("proxy server is %dx%d once connected, want the target's 64x48", w, h)
+	}
+	if n := m.ViewerCount(); n != 1 {
+		t.Errorf("ViewerCount() = %d after connecting, want the viewer kept", n)
+	}
+}
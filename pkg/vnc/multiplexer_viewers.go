@@ -0,0 +1,356 @@
+package vnc
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"sort"
+	"time"
+	"unsafe"
+)
+
+// ViewerInfo describes a connected viewer.
+type ViewerInfo struct {
+	ID          string
+	Address     string
+	Role        ViewerRole
+	Credential  string
+	ConnectedAt time.Time
+	// LastInput is when input of the viewer last reached the target.
+	LastInput  time.Time
+	BytesSent  int64
+	Controller bool
+}
+
+// ViewerEvent reports a viewer joining, once authenticated, or leaving.
+type ViewerEvent struct {
+	// Type is "joined" or "left".
+	Type   string
+	Viewer ViewerInfo
+	// Reason is why the viewer left: "disconnected", "kicked: <reason>",
+	// "idle timeout" or "session limit".
+	Reason string
+	Time   time.Time
+}
+
+// viewer is a viewer connected to the proxy server.
+type viewer struct {
+	id      string
+	client  unsafe.Pointer
+	address string
+	joined  time.Time
+
+	// guarded by viewersMu
+	role        ViewerRole
+	credential  string
+	authorized  bool
+	leaveReason string
+
+	lastInput time.Time    // guarded by controlMu
+	session   sessionClock // guarded by sessionMu
+
+	// input policy state, only touched by input handlers
+	inputTokens float64
+	inputRefill time.Time
+	rateLimited bool
+	pointer     image.Point // last allowed pointer position
+}
+
+func (m *Multiplexer) handleViewerJoined(clientPtr unsafe.Pointer) {
+	now := time.Now()
+	m.viewersMu.Lock()
+	m.nextViewerID++
+	v := &viewer{
+		id:      fmt.Sprintf("viewer-%d", m.nextViewerID),
+		client:  clientPtr,
+		address: m.proxyServer.ClientAddress(clientPtr),
+		joined:  now,
+		session: sessionClock{joined: now},
+		// with credentials the role is settled by authentication
+		role: RoleViewOnly,
+	}
+	m.viewers[clientPtr] = v
+	m.viewersMu.Unlock()
+
+	m.logger.Printf("Viewer %s connected from %s.", v.id, v.address)
+	if len(m.credentials) == 0 {
+		if err := m.authorizeViewer(v, "", m.defaultRole); err != nil {
+			m.logger.Printf("Viewer %s refused: %v", v.id, err)
+			go m.proxyServer.CloseClient(clientPtr)
+		}
+	}
+	m.notifyViewersChanged()
+}
+
+func (m *Multiplexer) handleViewerLeft(clientPtr unsafe.Pointer) {
+	m.viewersMu.Lock()
+	v := m.viewers[clientPtr]
+	delete(m.viewers, clientPtr)
+	m.viewersMu.Unlock()
+	if v == nil {
+		return
+	}
+
+	m.viewersMu.Lock()
+	reason := v.leaveReason
+	authorized := v.authorized
+	m.viewersMu.Unlock()
+	if reason == "" {
+		reason = "disconnected"
+	}
+
+	m.logger.Printf("Viewer %s disconnected.", v.id)
+	m.sessionMu.Lock()
+	delete(m.sessionNotices, v)
+	m.sessionMu.Unlock()
+	m.forgetViewerPointer(v)
+	m.viewerGone(v)
+	m.releaseViewerInput(v)
+	m.flushAuditInput(v, 0)
+	m.audit(AuditEvent{
+		Type:            "disconnect",
+		Viewer:          v.id,
+		Address:         v.address,
+		Role:            m.viewerRole(v),
+		DurationSeconds: time.Since(v.joined).Seconds(),
+		Reason:          reason,
+	})
+	if authorized {
+		m.notifyViewerEvent(ViewerEvent{Type: "left", Viewer: m.viewerInfo(v), Reason: reason, Time: time.Now()})
+	}
+	m.notifyViewersChanged()
+}
+
+// Viewers lists the authenticated viewers in the order they connected. It
+// must not be called from event handlers.
+func (m *Multiplexer) Viewers() []ViewerInfo {
+	var clients []ClientInfo
+	if m.proxyServer != nil {
+		clients = m.proxyServer.Clients()
+	}
+
+	viewers := make([]ViewerInfo, 0, len(clients))
+	for _, client := range clients {
+		v := m.viewerFor(client.Client)
+		if v == nil {
+			continue
+		}
+		m.viewersMu.Lock()
+		authorized := v.authorized
+		m.viewersMu.Unlock()
+		if !authorized {
+			continue
+		}
+
+		info := m.viewerInfo(v)
+		info.BytesSent = client.BytesSent
+		viewers = append(viewers, info)
+	}
+	sort.Slice(viewers, func(i, j int) bool {
+		return viewers[i].ConnectedAt.Before(viewers[j].ConnectedAt)
+	})
+	return viewers
+}
+
+// Kick disconnects a viewer, recording reason in the log, the audit log and
+// its left event. It must not be called from event handlers.
+func (m *Multiplexer) Kick(viewerID, reason string) error {
+	v := m.viewerByID(viewerID)
+	if v == nil {
+		return fmt.Errorf("unknown viewer %q", viewerID)
+	}
+
+	leaveReason := "kicked"
+	if reason != "" {
+		leaveReason += ": " + reason
+	}
+	m.logger.Printf("Kicking viewer %s: %s", v.id, reason)
+	m.audit(AuditEvent{Type: "kick", Viewer: v.id, Address: v.address, Reason: reason})
+	m.disconnectViewer(v, leaveReason)
+	return nil
+}
+
+// disconnectViewer closes the connection of v, reporting reason when it
+// has left.
+func (m *Multiplexer) disconnectViewer(v *viewer, reason string) {
+	m.viewersMu.Lock()
+	v.leaveReason = reason
+	m.viewersMu.Unlock()
+
+	if m.proxyServer != nil {
+		m.proxyServer.CloseClient(v.client)
+	}
+}
+
+// SharingPolicy returns the current desktop-sharing policy.
+func (m *Multiplexer) SharingPolicy() SharingPolicy {
+	m.viewersMu.Lock()
+	defer m.viewersMu.Unlock()
+	return m.sharing
+}
+
+// SetSharingPolicy changes the desktop-sharing policy for viewers that
+// connect from now on. It must not be called from event handlers.
+func (m *Multiplexer) SetSharingPolicy(policy SharingPolicy) error {
+	if err := policy.validate(); err != nil {
+		return err
+	}
+	m.viewersMu.Lock()
+	m.sharing = policy
+	m.viewersMu.Unlock()
+
+	m.logger.Printf("Sharing policy set to %+v.", policy)
+	if m.proxyServer != nil {
+		return m.proxyServer.SetSharingPolicy(policy)
+	}
+	return nil
+}
+
+// SubscribeViewers registers fn to be called whenever a viewer joins or
+// leaves and returns a function that unregisters it. Callbacks run on the
+// proxy server's event goroutine and must not block or call Viewers or
+// Kick.
+func (m *Multiplexer) SubscribeViewers(fn func(ViewerEvent)) func() {
+	m.viewersMu.Lock()
+	defer m.viewersMu.Unlock()
+
+	if m.viewerSubscribers == nil {
+		m.viewerSubscribers = make(map[int]func(ViewerEvent))
+	}
+	id := m.nextViewerSubID
+	m.nextViewerSubID++
+	m.viewerSubscribers[id] = fn
+
+	return func() {
+		m.viewersMu.Lock()
+		defer m.viewersMu.Unlock()
+		delete(m.viewerSubscribers, id)
+	}
+}
+
+func (m *Multiplexer) notifyViewerEvent(event ViewerEvent) {
+	m.viewersMu.Lock()
+	subscribers := make([]func(ViewerEvent), 0, len(m.viewerSubscribers))
+	for _, fn := range m.viewerSubscribers {
+		subscribers = append(subscribers, fn)
+	}
+	m.viewersMu.Unlock()
+
+	for _, fn := range subscribers {
+		fn(event)
+	}
+}
+
+// viewerInfo describes v, without BytesSent.
+func (m *Multiplexer) viewerInfo(v *viewer) ViewerInfo {
+	m.viewersMu.Lock()
+	info := ViewerInfo{
+		ID:          v.id,
+		Address:     v.address,
+		Role:        v.role,
+		Credential:  v.credential,
+		ConnectedAt: v.joined,
+	}
+	m.viewersMu.Unlock()
+
+	m.controlMu.Lock()
+	info.LastInput = v.lastInput
+	info.Controller = m.controller == v
+	m.controlMu.Unlock()
+	return info
+}
+
+// viewerFor returns the viewer behind an event's client pointer.
+func (m *Multiplexer) viewerFor(clientPtr unsafe.Pointer) *viewer {
+	m.viewersMu.Lock()
+	defer m.viewersMu.Unlock()
+	return m.viewers[clientPtr]
+}
+
+func (m *Multiplexer) viewerByID(id string) *viewer {
+	m.viewersMu.Lock()
+	defer m.viewersMu.Unlock()
+	for _, v := range m.viewers {
+		if v.id == id {
+			return v
+		}
+	}
+	return nil
+}
+
+func (m *Multiplexer) notifyViewersChanged() {
+	select {
+	case m.viewersChanged <- struct{}{}:
+	default:
+	}
+}
+
+// ViewerCount returns the number of viewers connected to the proxy server.
+func (m *Multiplexer) ViewerCount() int {
+	m.viewersMu.Lock()
+	defer m.viewersMu.Unlock()
+	return len(m.viewers)
+}
+
+// authorizedViewerCount returns the number of viewers that have
+// authenticated; on-demand connections wait for those.
+func (m *Multiplexer) authorizedViewerCount() int {
+	m.viewersMu.Lock()
+	defer m.viewersMu.Unlock()
+	n := 0
+	for _, v := range m.viewers {
+		if v.authorized {
+			n++
+		}
+	}
+	return n
+}
+
+// waitForViewer blocks until at least one viewer is authorized.
+func (m *Multiplexer) waitForViewer(ctx context.Context) error {
+	if m.authorizedViewerCount() == 0 {
+		m.logger.Println("Waiting for a viewer before connecting to the target.")
+	}
+	for m.authorizedViewerCount() == 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-m.viewersChanged:
+		}
+	}
+	return nil
+}
+
+// watchIdle interrupts the upstream connection once no viewer has been
+// authorized for the on-demand grace period.
+func (m *Multiplexer) watchIdle(ctx context.Context, interrupt context.CancelCauseFunc) {
+	var timer *time.Timer
+	var expired <-chan time.Time
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for {
+		if m.authorizedViewerCount() > 0 {
+			if timer != nil {
+				timer.Stop()
+				timer, expired = nil, nil
+			}
+		} else if timer == nil {
+			timer = time.NewTimer(m.onDemandGrace)
+			expired = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.viewersChanged:
+		case <-expired:
+			m.logger.Printf("No viewers for %s, disconnecting from the target.", m.onDemandGrace)
+			interrupt(ErrNoViewers)
+			return
+		}
+	}
+}
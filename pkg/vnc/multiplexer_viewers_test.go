@@ -0,0 +1,81 @@
+package vnc
+
+import "testing"
+
+func TestMultiplexerViewersAndKick(t *testing.T) {
+	m, _, srv := runFakeMultiplexer(t, MultiplexerConfig{
+		Credentials: []ViewerCredential{{Name: "ops", Password: "secret", Role: RoleFull}},
+	})
+	var events []ViewerEvent
+	m.SubscribeViewers(func(event ViewerEvent) {
+		events = append(events, event)
+	})
+
+	first := srv.connect("10.0.0.1:5000")
+	if !srv.authenticate(first, "secret") {
+		t.Fatal("viewer refused")
+	}
+	second := srv.connect("10.0.0.2:5000") // still authenticating
+
+	viewers := m.Viewers()
+	if len(viewers) != 1 {
+		t.Fatalf("Viewers() = %+v, want only the authenticated viewer", viewers)
+	}
+	if v := viewers[0]; v.ID != "viewer-1" || v.Address != "10.0.0.1:5000" || v.Role != RoleFull || v.Credential != "ops" || v.ConnectedAt.IsZero() {
+		t.Errorf("Viewers()[0] = %+v", v)
+	}
+
+	if err := m.Kick("viewer-9", "maintenance"); err == nil {
+		t.Error("Kick accepted an unknown viewer")
+	}
+	if err := m.Kick("viewer-1", "maintenance"); err != nil {
+		t.Fatal(err)
+	}
+	srv.CloseClient(second)
+
+	if viewers := m.Viewers(); len(viewers) != 0 {
+		t.Errorf("Viewers() after kick = %+v", viewers)
+	}
+	if m.ViewerCount() != 0 {
+		t.Errorf("ViewerCount() = %d after everyone left", m.ViewerCount())
+	}
+	// viewers that never authenticated neither join nor leave
+	want := []struct{ typ, id, reason string }{
+		{"joined", "viewer-1", ""},
+		{"left", "viewer-1", "kicked: maintenance"},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %d viewer events, want %d: %+v", len(events), len(want), events)
+	}
+	for i, event := range events {
+		if event.Type != want[i].typ || event.Viewer.ID != want[i].id || event.Reason != want[i].reason {
+			t.Errorf("viewer event %d = %s %s %q, want %s %s %q", i,
+				event.Type, event.Viewer.ID, event.Reason, want[i].typ, want[i].id, want[i].reason)
+		}
+	}
+	if clients := srv.Clients(); len(clients) != 0 {
+		t.Errorf("proxy server still has clients %+v", clients)
+	}
+}
+
+func TestMultiplexerSharingPolicy(t *testing.T) {
+	initial := SharingPolicy{Mode: SharingNever, DontDisconnect: true}
+	m, _, srv := runFakeMultiplexer(t, MultiplexerConfig{Sharing: initial})
+	if got := srv.sharingPolicy(); got != initial {
+		t.Errorf("proxy server sharing policy = %+v, want %+v", got, initial)
+	}
+
+	if err := m.SetSharingPolicy(SharingPolicy{Mode: "sometimes"}); err == nil {
+		t.Error("SetSharingPolicy accepted an unknown mode")
+	}
+	always := SharingPolicy{Mode: SharingAlways}
+	if err := m.SetSharingPolicy(always); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.sharingPolicy(); got != always {
+		t.Errorf("proxy server sharing policy = %+v, want %+v", got, always)
+	}
+	if got := m.SharingPolicy(); got != always {
+		t.Errorf("SharingPolicy() = %+v, want %+v", got, always)
+	}
+}
@@ -0,0 +1,242 @@
+package vnc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"math"
+	"os"
+	"time"
+)
+
+// PlaceholderMode selects what viewers see while the target is not
+// connected.
+type PlaceholderMode string
+
+const (
+	// PlaceholderStatus shows status text on a plain background.
+	PlaceholderStatus PlaceholderMode = "status"
+	// PlaceholderLastFrame shows the last frame dimmed and in greyscale with
+	// a status banner across it.
+	PlaceholderLastFrame PlaceholderMode = "lastFrame"
+	// PlaceholderImage shows a custom image, centred.
+	PlaceholderImage PlaceholderMode = "image"
+)
+
+// placeholderRefresh is how often the placeholder is redrawn so countdowns
+// stay current.
+const placeholderRefresh = time.Second
+
+var placeholderBackground = color.RGBA{R: 0x20, G: 0x20, B: 0x20, A: 0xff}
+
+// PlaceholderConfig configures the screen shown while the target is not
+// connected. Renderer, if set, takes precedence over Mode.
+type PlaceholderConfig struct {
+	Mode PlaceholderMode `json:"mode,omitempty" yaml:"mode,omitempty"`
+	// Image, or the PNG, JPEG or GIF file at ImagePath, is shown in
+	// PlaceholderImage mode.
+	Image     image.Image         `json:"-" yaml:"-"`
+	ImagePath string              `json:"imagePath,omitempty" yaml:"imagePath,omitempty"`
+	Renderer  PlaceholderRenderer `json:"-" yaml:"-"`
+}
+
+// PlaceholderRenderer draws the placeholder onto img, which holds the last
+// frame in PixelFormatStandard layout. It is called about once a second
+// while the target is not connected.
+type PlaceholderRenderer func(img *image.RGBA, info PlaceholderInfo)
+
+// PlaceholderInfo describes why the target is not connected.
+type PlaceholderInfo struct {
+	// Target is the endpoint address, or the ID in dial-home mode.
+	Target    string
+	State     MultiplexerState
+	Attempt   int
+	LastError error
+	// NextAttempt is when the next reconnect attempt starts; zero while an
+	// attempt is in progress.
+	NextAttempt time.Time
+}
+
+// Lines returns the status text the built-in placeholders show.
+func (info PlaceholderInfo) Lines() []string {
+	name := info.Target
+	if name == "" {
+		name = "target"
+	}
+
+	var lines []string
+	if info.State == StateConnecting && info.LastError == nil {
+		lines = append(lines, "Waiting for "+name)
+	} else {
+		lines = append(lines, name+" is offline")
+	}
+
+	if errors.Is(info.LastError, ErrReconnectGaveUp) {
+		lines = append(lines, "Gave up reconnecting")
+	} else if wait := time.Until(info.NextAttempt); !info.NextAttempt.IsZero() && wait > 0 {
+		seconds := int(math.Ceil(wait.Seconds()))
+		lines = append(lines, fmt.Sprintf("Reconnecting in %ds (attempt %d)", seconds, info.Attempt+1))
+	} else if info.Attempt > 0 {
+		lines = append(lines, fmt.Sprintf("Connecting... (attempt %d)", info.Attempt))
+	}
+
+	if info.LastError != nil {
+		lines = append(lines, "Last error: "+info.LastError.Error())
+	}
+	return lines
+}
+
+func (cfg PlaceholderConfig) validate() error {
+	switch cfg.Mode {
+	case "", PlaceholderStatus, PlaceholderLastFrame:
+	case PlaceholderImage:
+		if cfg.Image == nil && cfg.ImagePath == "" && cfg.Renderer == nil {
+			return fmt.Errorf("placeholder image mode needs an image")
+		}
+	default:
+		return fmt.Errorf("unknown placeholder mode %q", cfg.Mode)
+	}
+	return nil
+}
+
+// renderer resolves cfg to a renderer, loading ImagePath if needed.
+func (cfg PlaceholderConfig) renderer() (PlaceholderRenderer, error) {
+	if cfg.Renderer != nil {
+		return cfg.Renderer, nil
+	}
+
+	switch cfg.Mode {
+	case PlaceholderLastFrame:
+		return renderLastFramePlaceholder, nil
+	case PlaceholderImage:
+		img := cfg.Image
+		if img == nil {
+			var err error
+			if img, err = loadImage(cfg.ImagePath); err != nil {
+				return nil, err
+			}
+		}
+		return func(dst *image.RGBA, info PlaceholderInfo) {
+			renderImagePlaceholder(dst, img)
+		}, nil
+	default:
+		return renderStatusPlaceholder, nil
+	}
+}
+
+func loadImage(path string) (image.Image, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	return img, nil
+}
+
+func renderStatusPlaceholder(img *image.RGBA, info PlaceholderInfo) {
+	drawMessageScreen(img, placeholderBackground, fitLines(info.Lines(), img.Rect.Dx()))
+}
+
+func renderLastFramePlaceholder(img *image.RGBA, info PlaceholderInfo) {
+	greyOut(img)
+
+	lines := fitLines(info.Lines(), img.Rect.Dx())
+	height := min(len(lines)*textLineHeight()+16, img.Rect.Dy())
+	top := (img.Rect.Dy() - height) / 2
+	banner := img.SubImage(image.Rect(0, top, img.Rect.Dx(), top+height)).(*image.RGBA)
+	draw.Draw(banner, banner.Bounds(), &image.Uniform{placeholderBackground}, image.Point{}, draw.Src)
+	drawTextLines(banner, lines, top+height/2)
+}
+
+func renderImagePlaceholder(img *image.RGBA, src image.Image) {
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.Black}, image.Point{}, draw.Src)
+
+	size := src.Bounds().Size()
+	offset := image.Pt((img.Rect.Dx()-size.X)/2, (img.Rect.Dy()-size.Y)/2)
+	draw.Draw(img, image.Rectangle{Min: offset, Max: offset.Add(size)}, src, src.Bounds().Min, draw.Over)
+}
+
+// showPlaceholder draws the placeholder and keeps redrawing it until the
+// returned stop function is called. The last frame it starts from is the
+// proxy framebuffer's current content.
+func (m *Multiplexer) showPlaceholder(ctx context.Context) (stop func()) {
+	if m.proxyServer == nil {
+		return func() {}
+	}
+
+	lastFrame := append([]byte(nil), m.proxyServer.GetFrameBuffer()...)
+	m.renderPlaceholder(lastFrame)
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(placeholderRefresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				m.renderPlaceholder(lastFrame)
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+		// leave the final status, e.g. that reconnecting was given up
+		m.renderPlaceholder(lastFrame)
+	}
+}
+
+// renderPlaceholder draws the placeholder over lastFrame, given in the proxy
+// pixel format, into the proxy framebuffer.
+func (m *Multiplexer) renderPlaceholder(lastFrame []byte) {
+	img := frameBufferImage(m.proxyServer.GetFrameBuffer(), m.proxyServer.GetWidth(), m.proxyServer.GetHeight())
+	if img == nil {
+		return
+	}
+
+	copy(img.Pix, lastFrame)
+	convertToStandard(img.Pix, m.pixelFormat)
+	m.placeholder(img, m.placeholderInfo())
+	m.drawSessionBanner(img)
+	convertFromStandard(img.Pix, m.pixelFormat)
+	m.proxyServer.MarkRectAsModified(0, 0, img.Rect.Dx(), img.Rect.Dy())
+}
+
+func (m *Multiplexer) placeholderInfo() PlaceholderInfo {
+	target := m.targetName()
+
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	return PlaceholderInfo{
+		Target:      target,
+		State:       m.state,
+		Attempt:     m.reconnectAttempt,
+		LastError:   m.reconnectErr,
+		NextAttempt: m.nextAttempt,
+	}
+}
+
+// setReconnectStatus records reconnect progress for the placeholder.
+func (m *Multiplexer) setReconnectStatus(attempt int, err error, next time.Time) {
+	m.stateMu.Lock()
+	defer m.stateMu.Unlock()
+	m.reconnectAttempt = attempt
+	m.reconnectErr = err
+	m.nextAttempt = next
+}
@@ -0,0 +1,79 @@
+package vnc
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPlaceholderInfoLines(t *testing.T) {
+	errRefused := errors.New("connection refused")
+	tests := []struct {
+		name string
+		info PlaceholderInfo
+		want []string
+	}{
+		{
+			name: "waiting",
+			info: PlaceholderInfo{Target: "desk.example:5900", State: StateConnecting},
+			want: []string{"Waiting for desk.example:5900"},
+		},
+		{
+			name: "unnamed target",
+			info: PlaceholderInfo{State: StateConnecting},
+			want: []string{"Waiting for target"},
+		},
+		{
+			name: "first connection failed",
+			info: PlaceholderInfo{Target: "desk", State: StateConnecting, LastError: errRefused},
+			want: []string{"desk is offline", "Last error: connection refused"},
+		},
+		{
+			name: "reconnect countdown",
+			info: PlaceholderInfo{Target: "desk", State: StateOffline, Attempt: 2, LastError: errRefused, NextAttempt: time.Now().Add(9500 * time.Millisecond)},
+			want: []string{"desk is offline", "Reconnecting in 10s (attempt 3)", "Last error: connection refused"},
+		},
+		{
+			name: "attempt in progress",
+			info: PlaceholderInfo{Target: "desk", State: StateReconnecting, Attempt: 3},
+			want: []string{"desk is offline", "Connecting... (attempt 3)"},
+		},
+		{
+			name: "countdown passed",
+			info: PlaceholderInfo{Target: "desk", State: StateOffline, Attempt: 1, NextAttempt: time.Now().Add(-time.Second)},
+			want: []string{"desk is offline", "Connecting... (attempt 1)"},
+		},
+		{
+			name: "gave up",
+			info: PlaceholderInfo{Target: "desk", State: StateOffline, Attempt: 5, LastError: fmt.Errorf("%w after 5 attempts", ErrReconnectGaveUp), NextAttempt: time.Now().Add(time.Minute)},
+			want: []string{"desk is offline", "Gave up reconnecting", "Last error: " + fmt.Errorf("%w after 5 attempts", ErrReconnectGaveUp).Error()},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.info.Lines(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Lines() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlaceholderConfigValidate(t *testing.T) {
+	tests := []struct {
+		cfg     PlaceholderConfig
+		wantErr bool
+	}{
+		{cfg: PlaceholderConfig{}},
+		{cfg: PlaceholderConfig{Mode: PlaceholderLastFrame}},
+		{cfg: PlaceholderConfig{Mode: PlaceholderImage, ImagePath: "offline.png"}},
+		{cfg: PlaceholderConfig{Mode: PlaceholderImage}, wantErr: true},
+		{cfg: PlaceholderConfig{Mode: "blank"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := tt.cfg.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("validate(%+v) = %v, want error %v", tt.cfg, err, tt.wantErr)
+		}
+	}
+}
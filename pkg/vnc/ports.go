@@ -1,12 +1,23 @@
 package vnc
 
+import (
+	"context"
+	"net"
+	"time"
+	"unsafe"
+)
+
 type ClientPort interface {
 	SetHost(host string)
 	SetPort(port int)
 	SetPassword(password string)
+	SetPixelFormat(format PixelFormat)
 	SetStandardPixelFormat()
-	Init() bool
-	RunEventLoop(timeoutMs int) error
+	SetAppData(config AppDataConfig)
+	SetKeepAlive(period time.Duration)
+	Connect(ctx context.Context) error
+	ConnectWithConn(ctx context.Context, conn net.Conn) error
+	Run(ctx context.Context) error
 	IsConnected() bool
 	Close()
 
@@ -17,27 +28,43 @@ type ClientPort interface {
 
 	SendPointerEvent(x, y int, buttonMask uint8)
 	SendKeyEvent(key uint32, down bool)
+	SendCutText(text string)
 
 	SetGotFrameBufferUpdateHandler(handler GotFrameBufferUpdateHandler)
+	SetGotCutTextHandler(handler GotCutTextHandler)
 }
 
 type ServerPort interface {
 	SetPort(port int)
+	SetPixelFormat(format PixelFormat)
 	SetStandardPixelFormat()
 	InitServer() error
-	RunEventLoop(timeoutMs int) error
+	AttachConn(conn net.Conn) error
+	Serve(ctx context.Context) error
 	Close()
 
 	// Stop signals the server main loop to stop processing events.
 	Stop()
+	StopListening()
+	HasPendingUpdates() bool
 
 	GetFrameBuffer() []byte
 	GetWidth() int
 	GetHeight() int
+	Resize(width, height int) error
 	MarkRectAsModified(x, y, w, h int)
 
 	SetPointerEventHandler(handler PointerEventHandler)
 	SetKeyEventHandler(handler KeyEventHandler)
+	SetNewClientHandler(handler NewClientHandler)
+	SetClientGoneHandler(handler ClientGoneHandler)
+	SetPasswordCheckHandler(handler PasswordCheckHandler)
+	SetCutTextHandler(handler CutTextHandler)
+	SendCutText(text string)
+	SetSharingPolicy(policy SharingPolicy) error
+	ClientAddress(clientPtr unsafe.Pointer) string
+	CloseClient(clientPtr unsafe.Pointer)
+	Clients() []ClientInfo
 }
 
 type ClientFactory func(bitsPerSample, samplesPerPixel, bytesPerPixel int) (ClientPort, error)
@@ -0,0 +1,575 @@
+package vnc
+
+import (
+	"context"
+	"crypto/rand"
+	"image"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+// fakePorts hands out fake clients and a fake server to a Multiplexer under
+// test in place of libvncclient and libvncserver.
+type fakePorts struct {
+	mu      sync.Mutex
+	width   int
+	height  int
+	refuse  map[string]error // connect errors by target host
+	clients []*fakeClient
+	server  *fakeServer
+}
+
+func newFakePorts(width, height int) *fakePorts {
+	return &fakePorts{width: width, height: height, refuse: make(map[string]error)}
+}
+
+func (p *fakePorts) clientFactory(bitsPerSample, samplesPerPixel, bytesPerPixel int) (ClientPort, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c := &fakeClient{ports: p, drop: make(chan error, 1)}
+	p.clients = append(p.clients, c)
+	return c, nil
+}
+
+func (p *fakePorts) serverFactory(width, height, bitsPerSample, samplesPerPixel, bytesPerPixel int) (ServerPort, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s := &fakeServer{
+		width:     width,
+		height:    height,
+		fb:        make([]byte, width*height*4),
+		addresses: make(map[unsafe.Pointer]string),
+		stopped:   make(chan struct{}),
+	}
+	p.server = s
+	return s, nil
+}
+
+// refuseHost makes connections to host fail with err, or succeed again for
+// a nil err.
+func (p *fakePorts) refuseHost(host string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil {
+		delete(p.refuse, host)
+		return
+	}
+	p.refuse[host] = err
+}
+
+// resize changes the size of the framebuffer clients get from now on.
+func (p *fakePorts) resize(width, height int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.width, p.height = width, height
+}
+
+// client returns the most recently created client.
+func (p *fakePorts) client() *fakeClient {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.clients) == 0 {
+		return nil
+	}
+	return p.clients[len(p.clients)-1]
+}
+
+func (p *fakePorts) proxyServer() *fakeServer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.server
+}
+
+// hosts lists the target hosts clients were created for, in order.
+func (p *fakePorts) hosts() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	hosts := make([]string, 0, len(p.clients))
+	for _, c := range p.clients {
+		hosts = append(hosts, c.hostName())
+	}
+	return hosts
+}
+
+type fakeKey struct {
+	key  uint32
+	down bool
+}
+
+type fakePointer struct {
+	x, y int
+	mask uint8
+}
+
+// fakeClient is a ClientPort standing in for a connection to the target. It
+// records the input sent to the target; Run returns once an error is sent
+// on drop or ctx is cancelled.
+type fakeClient struct {
+	ports *fakePorts
+	drop  chan error
+
+	mu             sync.Mutex
+	host           string
+	port           int
+	password       string
+	keepAlive      time.Duration
+	width          int
+	height         int
+	fb             []byte
+	connected      bool
+	keys           []fakeKey
+	pointers       []fakePointer
+	requests       []image.Rectangle // non-incremental update requests
+	cutText        []string
+	updateHandler  GotFrameBufferUpdateHandler
+	cutTextHandler GotCutTextHandler
+}
+
+func (c *fakeClient) SetHost(host string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.host = host
+}
+
+func (c *fakeClient) SetPort(port int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.port = port
+}
+
+func (c *fakeClient) SetPassword(password string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.password = password
+}
+
+func (c *fakeClient) SetPixelFormat(format PixelFormat) {}
+func (c *fakeClient) SetStandardPixelFormat()           {}
+func (c *fakeClient) SetAppData(config AppDataConfig)   {}
+
+func (c *fakeClient) SetKeepAlive(period time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keepAlive = period
+}
+
+func (c *fakeClient) Connect(ctx context.Context) error {
+	c.ports.mu.Lock()
+	err := c.ports.refuse[c.hostName()]
+	width, height := c.ports.width, c.ports.height
+	c.ports.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.width, c.height = width, height
+	c.fb = make([]byte, width*height*4)
+	c.connected = true
+	return nil
+}
+
+func (c *fakeClient) ConnectWithConn(ctx context.Context, conn net.Conn) error {
+	conn.Close()
+	return c.Connect(ctx)
+}
+
+func (c *fakeClient) Run(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-c.drop:
+		c.mu.Lock()
+		c.connected = false
+		c.mu.Unlock()
+		return err
+	}
+}
+
+func (c *fakeClient) IsConnected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.connected
+}
+
+func (c *fakeClient) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connected = false
+}
+
+func (c *fakeClient) GetFrameBufferWidth() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.width
+}
+
+func (c *fakeClient) GetFrameBufferHeight() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.height
+}
+
+func (c *fakeClient) GetFrameBuffer() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fb
+}
+
+func (c *fakeClient) SendFrameBufferUpdateRequest(x, y, w, h int, incremental bool) {
+	if incremental {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests = append(c.requests, image.Rect(x, y, x+w, y+h))
+}
+
+func (c *fakeClient) SendPointerEvent(x, y int, buttonMask uint8) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pointers = append(c.pointers, fakePointer{x, y, buttonMask})
+}
+
+func (c *fakeClient) SendKeyEvent(key uint32, down bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keys = append(c.keys, fakeKey{key, down})
+}
+
+func (c *fakeClient) SendCutText(text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cutText = append(c.cutText, text)
+}
+
+func (c *fakeClient) SetGotFrameBufferUpdateHandler(handler GotFrameBufferUpdateHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.updateHandler = handler
+}
+
+func (c *fakeClient) SetGotCutTextHandler(handler GotCutTextHandler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cutTextHandler = handler
+}
+
+func (c *fakeClient) hostName() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.host
+}
+
+// endpoint returns the target the client was set up for.
+func (c *fakeClient) endpoint() TargetEndpoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return TargetEndpoint{Host: c.host, Port: c.port, Password: c.password}
+}
+
+// sentKeys returns the key events sent to the target so far.
+func (c *fakeClient) sentKeys() []fakeKey {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]fakeKey(nil), c.keys...)
+}
+
+// sentPointers returns the pointer events sent to the target so far.
+func (c *fakeClient) sentPointers() []fakePointer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]fakePointer(nil), c.pointers...)
+}
+
+// updateRequests returns the rectangles the target was asked to resend.
+func (c *fakeClient) updateRequests() []image.Rectangle {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]image.Rectangle(nil), c.requests...)
+}
+
+// update simulates the target sending r, as the client's event loop would.
+func (c *fakeClient) update(r image.Rectangle) {
+	c.mu.Lock()
+	handler := c.updateHandler
+	c.mu.Unlock()
+	handler(r.Min.X, r.Min.Y, r.Dx(), r.Dy())
+}
+
+// sentCutText returns the clipboard text sent to the target so far.
+func (c *fakeClient) sentCutText() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.cutText...)
+}
+
+// fakeServer is a ServerPort standing in for the proxy server. Viewers are
+// simulated by calling the handlers the Multiplexer registers.
+type fakeServer struct {
+	mu        sync.Mutex
+	width     int
+	height    int
+	fb        []byte
+	sharing   SharingPolicy
+	clients   []ClientInfo
+	addresses map[unsafe.Pointer]string
+	modified  []image.Rectangle
+	stopped   chan struct{}
+	stopOnce  sync.Once
+
+	pointerHandler PointerEventHandler
+	keyHandler     KeyEventHandler
+	newClient      NewClientHandler
+	clientGone     ClientGoneHandler
+	passwordCheck  PasswordCheckHandler
+	cutTextHandler CutTextHandler
+	cutText        []string
+}
+
+func (s *fakeServer) SetPort(port int)                  {}
+func (s *fakeServer) SetPixelFormat(format PixelFormat) {}
+func (s *fakeServer) SetStandardPixelFormat()           {}
+func (s *fakeServer) InitServer() error                 { return nil }
+func (s *fakeServer) Close()                            { s.Stop() }
+func (s *fakeServer) StopListening()                    {}
+func (s *fakeServer) HasPendingUpdates() bool           { return false }
+
+func (s *fakeServer) AttachConn(conn net.Conn) error {
+	conn.Close()
+	return nil
+}
+
+func (s *fakeServer) Serve(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+	case <-s.stopped:
+	}
+	return nil
+}
+
+func (s *fakeServer) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopped)
+	})
+}
+
+func (s *fakeServer) GetFrameBuffer() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.fb
+}
+
+func (s *fakeServer) GetWidth() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.width
+}
+
+func (s *fakeServer) GetHeight() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.height
+}
+
+func (s *fakeServer) Resize(width, height int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.width, s.height = width, height
+	s.fb = make([]byte, width*height*4)
+	return nil
+}
+
+func (s *fakeServer) MarkRectAsModified(x, y, w, h int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.modified = append(s.modified, image.Rect(x, y, x+w, y+h))
+}
+
+func (s *fakeServer) SetPointerEventHandler(handler PointerEventHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pointerHandler = handler
+}
+
+func (s *fakeServer) SetKeyEventHandler(handler KeyEventHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keyHandler = handler
+}
+
+func (s *fakeServer) SetNewClientHandler(handler NewClientHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.newClient = handler
+}
+
+func (s *fakeServer) SetClientGoneHandler(handler ClientGoneHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clientGone = handler
+}
+
+func (s *fakeServer) SetPasswordCheckHandler(handler PasswordCheckHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.passwordCheck = handler
+}
+
+func (s *fakeServer) SetCutTextHandler(handler CutTextHandler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cutTextHandler = handler
+}
+
+func (s *fakeServer) SendCutText(text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cutText = append(s.cutText, text)
+}
+
+func (s *fakeServer) SetSharingPolicy(policy SharingPolicy) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sharing = policy
+	return nil
+}
+
+func (s *fakeServer) ClientAddress(clientPtr unsafe.Pointer) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.addresses[clientPtr]
+}
+
+// CloseClient drops the viewer right away, where libvncserver would do so
+// on its next event loop iteration.
+func (s *fakeServer) CloseClient(clientPtr unsafe.Pointer) {
+	s.mu.Lock()
+	found := false
+	for i, client := range s.clients {
+		if client.Client == clientPtr {
+			s.clients = append(s.clients[:i], s.clients[i+1:]...)
+			found = true
+			break
+		}
+	}
+	gone := s.clientGone
+	s.mu.Unlock()
+
+	if found && gone != nil {
+		gone(clientPtr)
+	}
+}
+
+func (s *fakeServer) Clients() []ClientInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]ClientInfo(nil), s.clients...)
+}
+
+// connect simulates a viewer connecting from address and returns its
+// client pointer.
+func (s *fakeServer) connect(address string) unsafe.Pointer {
+	clientPtr := unsafe.Pointer(new(byte))
+	s.mu.Lock()
+	s.clients = append(s.clients, ClientInfo{Client: clientPtr, Address: address})
+	s.addresses[clientPtr] = address
+	handler := s.newClient
+	s.mu.Unlock()
+
+	handler(clientPtr)
+	return clientPtr
+}
+
+// authenticate simulates the viewer answering the VNC authentication
+// challenge with password.
+func (s *fakeServer) authenticate(clientPtr unsafe.Pointer, password string) bool {
+	challenge := make([]byte, 16)
+	rand.Read(challenge)
+	response, err := vncAuthResponse(challenge, password)
+	if err != nil {
+		return false
+	}
+
+	s.mu.Lock()
+	handler := s.passwordCheck
+	s.mu.Unlock()
+	return handler(clientPtr, challenge, response)
+}
+
+func (s *fakeServer) key(clientPtr unsafe.Pointer, key uint32, down bool) {
+	s.mu.Lock()
+	handler := s.keyHandler
+	s.mu.Unlock()
+	handler(down, key, clientPtr)
+}
+
+func (s *fakeServer) pointer(clientPtr unsafe.Pointer, x, y, buttonMask int) {
+	s.mu.Lock()
+	handler := s.pointerHandler
+	s.mu.Unlock()
+	handler(buttonMask, x, y, clientPtr)
+}
+
+// sendCutText simulates the viewer sending clipboard text.
+func (s *fakeServer) sendCutText(clientPtr unsafe.Pointer, text string) {
+	s.mu.Lock()
+	handler := s.cutTextHandler
+	s.mu.Unlock()
+	handler(text, clientPtr)
+}
+
+func (s *fakeServer) sharingPolicy() SharingPolicy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sharing
+}
+
+// newFakeMultiplexer creates a multiplexer for cfg on fake ports serving a
+// 64x48 target, and closes it when the test ends.
+func newFakeMultiplexer(t *testing.T, cfg MultiplexerConfig) (*Multiplexer, *fakePorts) {
+	t.Helper()
+	ports := newFakePorts(64, 48)
+	if cfg.TargetHost == "" && len(cfg.Endpoints) == 0 && cfg.Targets == nil {
+		cfg.TargetHost = "desk.example"
+	}
+	cfg.Logger = log.New(io.Discard, "", 0)
+	cfg.ClientFactory = ports.clientFactory
+	cfg.ServerFactory = ports.serverFactory
+
+	m, err := NewMultiplexerFromConfig(cfg)
+	if err != nil {
+		t.Fatalf("NewMultiplexerFromConfig: %v", err)
+	}
+	t.Cleanup(m.Close)
+	return m, ports
+}
+
+// waitFor polls cond until it holds or a second has passed.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// runFakeMultiplexer is newFakeMultiplexer that also runs the multiplexer
+// until the test ends, returning once it proxies the target.
+func runFakeMultiplexer(t *testing.T, cfg MultiplexerConfig) (*Multiplexer, *fakePorts, *fakeServer) {
+	t.Helper()
+	m, ports := newFakeMultiplexer(t, cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go m.Run(ctx)
+
+	waitFor(t, "the target", func() bool { return m.State() == StateOnline })
+	return m, ports, ports.proxyServer()
+}
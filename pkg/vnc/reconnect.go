@@ -0,0 +1,102 @@
+package vnc
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ReconnectPolicy decides how long the Multiplexer waits after a failed
+// reconnect attempt. NextDelay is called with the number of attempts made so
+// far (starting at 1) and the error of the last one; returning false gives up.
+type ReconnectPolicy interface {
+	NextDelay(attempt int, err error) (time.Duration, bool)
+}
+
+// BackoffPolicy is a ReconnectPolicy with exponential backoff. The delay
+// after attempt n is InitialInterval*Multiplier^(n-1), spread by up to
+// ±Jitter of itself so multiplexers that lost the same target do not retry
+// in lockstep, and capped at MaxInterval.
+type BackoffPolicy struct {
+	InitialInterval Duration `json:"initialInterval,omitempty" yaml:"initialInterval,omitempty"`
+	MaxInterval     Duration `json:"maxInterval,omitempty" yaml:"maxInterval,omitempty"`
+	// Multiplier of 1 gives a fixed interval; values below 1 are treated as 1.
+	Multiplier float64 `json:"multiplier,omitempty" yaml:"multiplier,omitempty"`
+	// Jitter is a fraction between 0 and 1.
+	Jitter float64 `json:"jitter,omitempty" yaml:"jitter,omitempty"`
+	// MaxAttempts gives up after that many failed attempts; 0 retries forever.
+	MaxAttempts int `json:"maxAttempts,omitempty" yaml:"maxAttempts,omitempty"`
+}
+
+// DefaultReconnectPolicy starts at one second and doubles up to a minute,
+// with 20% jitter, forever.
+var DefaultReconnectPolicy = BackoffPolicy{
+	InitialInterval: Duration(time.Second),
+	MaxInterval:     Duration(time.Minute),
+	Multiplier:      2,
+	Jitter:          0.2,
+}
+
+// FixedReconnectPolicy retries every interval forever.
+func FixedReconnectPolicy(interval time.Duration) BackoffPolicy {
+	return BackoffPolicy{InitialInterval: Duration(interval), Multiplier: 1}
+}
+
+func (p BackoffPolicy) NextDelay(attempt int, err error) (time.Duration, bool) {
+	if p.MaxAttempts > 0 && attempt >= p.MaxAttempts {
+		return 0, false
+	}
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	// without MaxInterval the backoff eventually exceeds what a Duration
+	// holds, so cap it there
+	limit := float64(math.MaxInt64)
+	if p.MaxInterval > 0 {
+		limit = float64(p.MaxInterval)
+	}
+
+	multiplier := math.Max(p.Multiplier, 1)
+	delay := float64(p.InitialInterval) * math.Pow(multiplier, float64(attempt-1))
+	delay = math.Min(delay, limit)
+	if p.Jitter > 0 {
+		delay = math.Min(delay+delay*p.Jitter*(2*rand.Float64()-1), limit)
+	}
+	if delay < 0 || math.IsNaN(delay) {
+		return 0, true
+	}
+	if delay >= math.MaxInt64 {
+		return time.Duration(math.MaxInt64), true
+	}
+	return time.Duration(delay), true
+}
+
+// withDefaults fills in what a partial reconnect block leaves out: the
+// initial interval and, without a multiplier, the doubling and its cap.
+func (p BackoffPolicy) withDefaults() BackoffPolicy {
+	if p.InitialInterval == 0 {
+		p.InitialInterval = DefaultReconnectPolicy.InitialInterval
+	}
+	if p.Multiplier == 0 {
+		p.Multiplier = DefaultReconnectPolicy.Multiplier
+		if p.MaxInterval == 0 {
+			p.MaxInterval = DefaultReconnectPolicy.MaxInterval
+		}
+	}
+	return p
+}
+
+func (p BackoffPolicy) validate() error {
+	if p.InitialInterval < 0 || p.MaxInterval < 0 {
+		return fmt.Errorf("reconnect intervals cannot be negative")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("reconnect jitter must be between 0 and 1")
+	}
+	if p.MaxAttempts < 0 {
+		return fmt.Errorf("reconnect max attempts cannot be negative")
+	}
+	return nil
+}
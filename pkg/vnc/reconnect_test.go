@@ -0,0 +1,125 @@
+package vnc
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBackoffPolicyNextDelay(t *testing.T) {
+	errFailed := errors.New("connection refused")
+	tests := []struct {
+		name    string
+		policy  BackoffPolicy
+		attempt int
+		want    time.Duration
+		giveUp  bool
+	}{
+		{name: "first attempt", policy: BackoffPolicy{InitialInterval: Duration(time.Second), Multiplier: 2}, attempt: 1, want: time.Second},
+		{name: "doubling", policy: BackoffPolicy{InitialInterval: Duration(time.Second), Multiplier: 2}, attempt: 4, want: 8 * time.Second},
+		{name: "capped", policy: BackoffPolicy{InitialInterval: Duration(time.Second), MaxInterval: Duration(5 * time.Second), Multiplier: 2}, attempt: 4, want: 5 * time.Second},
+		{name: "multiplier below one", policy: BackoffPolicy{InitialInterval: Duration(time.Second), Multiplier: 0.5}, attempt: 3, want: time.Second},
+		{name: "fixed", policy: FixedReconnectPolicy(3 * time.Second), attempt: 10, want: 3 * time.Second},
+		{name: "attempt zero", policy: BackoffPolicy{InitialInterval: Duration(time.Second), Multiplier: 2}, attempt: 0, want: time.Second},
+		{name: "within max attempts", policy: BackoffPolicy{InitialInterval: Duration(time.Second), MaxAttempts: 3}, attempt: 2, want: time.Second},
+		{name: "max attempts", policy: BackoffPolicy{InitialInterval: Duration(time.Second), MaxAttempts: 3}, attempt: 3, giveUp: true},
+		{name: "uncapped overflow", policy: BackoffPolicy{InitialInterval: Duration(time.Second), Multiplier: 2}, attempt: 200, want: time.Duration(math.MaxInt64)},
+		{name: "uncapped infinity", policy: BackoffPolicy{InitialInterval: Duration(time.Second), Multiplier: 2}, attempt: 2000, want: time.Duration(math.MaxInt64)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delay, ok := tt.policy.NextDelay(tt.attempt, errFailed)
+			if ok == tt.giveUp {
+				t.Fatalf("NextDelay(%d) retry = %v, want %v", tt.attempt, ok, !tt.giveUp)
+			}
+			if ok && delay != tt.want {
+				t.Errorf("NextDelay(%d) = %s, want %s", tt.attempt, delay, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoffPolicyJitter(t *testing.T) {
+	policy := BackoffPolicy{InitialInterval: Duration(10 * time.Second), Multiplier: 1, Jitter: 0.2}
+	varied := false
+	first, _ := policy.NextDelay(1, nil)
+	for i := 0; i < 200; i++ {
+		delay, ok := policy.NextDelay(1, nil)
+		if !ok || delay < 8*time.Second || delay > 12*time.Second {
+			t.Fatalf("NextDelay = %s, %v; want 8s to 12s", delay, ok)
+		}
+		varied = varied || delay != first
+	}
+	if !varied {
+		t.Error("jitter never changed the delay")
+	}
+}
+
+func TestBackoffPolicyJitterKeepsMaxInterval(t *testing.T) {
+	policy := BackoffPolicy{InitialInterval: Duration(time.Second), MaxInterval: Duration(10 * time.Second), Multiplier: 2, Jitter: 0.5}
+	for i := 0; i < 200; i++ {
+		delay, _ := policy.NextDelay(10, nil)
+		if delay < 5*time.Second || delay > 10*time.Second {
+			t.Fatalf("NextDelay = %s, want 5s to 10s", delay)
+		}
+	}
+}
+
+func TestBackoffPolicyJitterUncapped(t *testing.T) {
+	policy := BackoffPolicy{InitialInterval: Duration(time.Second), Multiplier: 2, Jitter: 0.5}
+	for i := 0; i < 200; i++ {
+		delay, _ := policy.NextDelay(2000, nil)
+		if delay < time.Duration(math.MaxInt64/2) {
+			t.Fatalf("NextDelay(2000) = %s, want at least half of the largest delay", delay)
+		}
+	}
+}
+
+func TestBackoffPolicyWithDefaults(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy BackoffPolicy
+		want   BackoffPolicy
+	}{
+		{
+			name:   "max attempts only",
+			policy: BackoffPolicy{MaxAttempts: 4},
+			want:   BackoffPolicy{InitialInterval: Duration(time.Second), MaxInterval: Duration(time.Minute), Multiplier: 2, MaxAttempts: 4},
+		},
+		{
+			name:   "fixed interval",
+			policy: FixedReconnectPolicy(5 * time.Minute),
+			want:   FixedReconnectPolicy(5 * time.Minute),
+		},
+		{
+			name:   "multiplier without interval",
+			policy: BackoffPolicy{Multiplier: 3},
+			want:   BackoffPolicy{InitialInterval: Duration(time.Second), Multiplier: 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.withDefaults(); got != tt.want {
+				t.Errorf("withDefaults() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoffPolicyValidate(t *testing.T) {
+	tests := []struct {
+		policy  BackoffPolicy
+		wantErr bool
+	}{
+		{policy: DefaultReconnectPolicy},
+		{policy: BackoffPolicy{InitialInterval: -1}, wantErr: true},
+		{policy: BackoffPolicy{Jitter: 1.5}, wantErr: true},
+		{policy: BackoffPolicy{MaxAttempts: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := tt.policy.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("validate(%+v) = %v, want error %v", tt.policy, err, tt.wantErr)
+		}
+	}
+}
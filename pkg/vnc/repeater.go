@@ -0,0 +1,146 @@
+package vnc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultRepeaterViewerPort is the UltraVNC repeater port viewers connect to.
+	DefaultRepeaterViewerPort = 5901
+	// DefaultRepeaterServerPort is the UltraVNC repeater port servers register on.
+	DefaultRepeaterServerPort = 5500
+)
+
+// RepeaterConfig describes a connection through an UltraVNC repeater.
+//
+// In mode I the viewer names the server it wants to reach (Target, as
+// "host:port"); the repeater connects there on its behalf. In mode II viewer
+// and server both connect to the repeater and are paired by a shared ID.
+type RepeaterConfig struct {
+	// Address of the repeater. A bare host uses DefaultRepeaterViewerPort for
+	// clients and DefaultRepeaterServerPort for servers.
+	Address string
+
+	// Target selects mode I (clients only).
+	Target string
+	// ID selects mode II; the "ID:" prefix is optional.
+	ID string
+
+	// Retries is the number of extra attempts made when the repeater cannot
+	// be reached or rejects the handshake.
+	Retries int
+	// RetryInterval is the pause between attempts (default 5s).
+	RetryInterval time.Duration
+
+	// Logger receives connection and retry messages (default log.Default()).
+	Logger *log.Logger
+}
+
+func (cfg RepeaterConfig) preamble(server bool) (string, error) {
+	id := strings.TrimPrefix(cfg.ID, "ID:")
+	switch {
+	case id != "" && cfg.Target != "":
+		return "", fmt.Errorf("repeater ID and target are mutually exclusive")
+	case id != "":
+		return "ID:" + id, nil
+	case server:
+		return "", fmt.Errorf("servers can only register with a repeater by ID (mode II)")
+	case cfg.Target != "":
+		host, port, err := splitHostPortDefault(cfg.Target, 5900)
+		if err != nil {
+			return "", err
+		}
+		return net.JoinHostPort(host, strconv.Itoa(port)), nil
+	default:
+		return "", fmt.Errorf("repeater ID or target is required")
+	}
+}
+
+// dialRepeater connects to the repeater and performs its handshake, retrying
+// as configured. Viewers first receive the repeater's "RFB 000.000" banner,
+// servers send their ID straight away.
+func dialRepeater(ctx context.Context, cfg RepeaterConfig, server bool) (net.Conn, error) {
+	preamble, err := cfg.preamble(server)
+	if err != nil {
+		return nil, err
+	}
+
+	defaultPort := DefaultRepeaterViewerPort
+	if server {
+		defaultPort = DefaultRepeaterServerPort
+	}
+	host, port, err := splitHostPortDefault(cfg.Address, defaultPort)
+	if err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+
+	interval := cfg.RetryInterval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	for attempt := 0; ; attempt++ {
+		conn, err := repeaterHandshake(ctx, addr, preamble, server)
+		if err == nil {
+			logger.Printf("Connected to repeater %s as %q.", addr, preamble)
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if attempt >= cfg.Retries {
+			return nil, fmt.Errorf("repeater %s: %w", addr, err)
+		}
+		logger.Printf("Repeater %s attempt %d failed: %v", addr, attempt+1, err)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+	}
+}
+
+func repeaterHandshake(ctx context.Context, addr, preamble string, server bool) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	if !server {
+		conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		banner := make([]byte, 12)
+		if _, err := io.ReadFull(conn, banner); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Time{})
+		if !strings.HasPrefix(string(banner), "RFB ") {
+			conn.Close()
+			return nil, fmt.Errorf("unexpected repeater banner %q", banner)
+		}
+	}
+
+	if err := writePreamble(conn, preamble); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
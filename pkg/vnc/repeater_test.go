@@ -0,0 +1,134 @@
+package vnc
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRepeaterPreamble(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     RepeaterConfig
+		server  bool
+		want    string
+		wantErr bool
+	}{
+		{name: "mode II viewer", cfg: RepeaterConfig{ID: "1234"}, want: "ID:1234"},
+		{name: "mode II prefixed ID", cfg: RepeaterConfig{ID: "ID:1234"}, want: "ID:1234"},
+		{name: "mode II server", cfg: RepeaterConfig{ID: "1234"}, server: true, want: "ID:1234"},
+		{name: "mode I", cfg: RepeaterConfig{Target: "desk.example:5901"}, want: "desk.example:5901"},
+		{name: "mode I default port", cfg: RepeaterConfig{Target: "desk.example"}, want: "desk.example:5900"},
+		{name: "mode I IPv6", cfg: RepeaterConfig{Target: "::1"}, want: "[::1]:5900"},
+		{name: "mode I server", cfg: RepeaterConfig{Target: "desk.example"}, server: true, wantErr: true},
+		{name: "both", cfg: RepeaterConfig{ID: "1234", Target: "desk.example"}, wantErr: true},
+		{name: "neither", cfg: RepeaterConfig{}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := tt.cfg.preamble(tt.server)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: preamble = %q, want error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: preamble = %q, %v; want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+// fakeRepeater accepts one connection, greets it with the repeater banner
+// if banner is set and returns the preamble it receives.
+func fakeRepeater(t *testing.T, banner bool) (addr string, preamble <-chan string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if banner {
+			io.WriteString(conn, "RFB 000.000\n")
+		}
+		buf := make([]byte, idPreambleSize)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			received <- "error: " + err.Error()
+			return
+		}
+		received <- string(bytes.TrimRight(buf, "\x00"))
+	}()
+	return l.Addr().String(), received
+}
+
+func TestDialRepeater(t *testing.T) {
+	tests := []struct {
+		name   string
+		server bool
+	}{
+		{name: "viewer", server: false},
+		{name: "server", server: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// only viewers are greeted with a banner
+			addr, preamble := fakeRepeater(t, !tt.server)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := dialRepeater(ctx, RepeaterConfig{Address: addr, ID: "42"}, tt.server)
+			if err != nil {
+				t.Fatalf("dialRepeater: %v", err)
+			}
+			defer conn.Close()
+
+			if got := <-preamble; got != "ID:42" {
+				t.Errorf("repeater received %q, want ID:42", got)
+			}
+		})
+	}
+}
+
+func TestDialRepeaterRetries(t *testing.T) {
+	// a port nothing listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	var logs bytes.Buffer
+	cfg := RepeaterConfig{
+		Address:       "127.0.0.1:" + strconv.Itoa(port),
+		ID:            "42",
+		Retries:       2,
+		RetryInterval: 20 * time.Millisecond,
+		Logger:        log.New(&logs, "", 0),
+	}
+	if _, err := dialRepeater(ctx, cfg, true); err == nil {
+		t.Fatal("dialRepeater succeeded without a repeater")
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("gave up after %s, before retrying twice", elapsed)
+	}
+	if got := strings.Count(logs.String(), "failed"); got != 2 {
+		t.Errorf("logged %d failed attempts, want 2: %q", got, logs.String())
+	}
+}
@@ -0,0 +1,120 @@
+package vnc
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+var (
+	maintenanceBackground = color.RGBA{R: 0x20, G: 0x30, B: 0x50, A: 0xff}
+	staleBackground       = color.RGBA{R: 0x90, G: 0x60, B: 0x00, A: 0xff}
+	screenTextColor       = color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+)
+
+// frameBufferImage wraps a 32bpp framebuffer in PixelFormatStandard layout
+// (R, G, B, padding in memory) as an image without copying.
+func frameBufferImage(fb []byte, width, height int) *image.RGBA {
+	if len(fb) < width*height*4 {
+		return nil
+	}
+	return &image.RGBA{
+		Pix:    fb[:width*height*4],
+		Stride: width * 4,
+		Rect:   image.Rect(0, 0, width, height),
+	}
+}
+
+// drawMessageScreen fills img with bg and centres lines of text on it using
+// the built-in 7x13 bitmap font.
+func drawMessageScreen(img *image.RGBA, bg color.Color, lines []string) {
+	draw.Draw(img, img.Bounds(), &image.Uniform{bg}, image.Point{}, draw.Src)
+	drawTextLines(img, lines, img.Bounds().Dy()/2)
+}
+
+// drawTextLines draws lines horizontally centred, the block vertically
+// centred on centerY.
+func drawTextLines(img *image.RGBA, lines []string, centerY int) {
+	face := basicfont.Face7x13
+	lineHeight := textLineHeight()
+	top := centerY - len(lines)*lineHeight/2
+
+	drawer := font.Drawer{Dst: img, Src: image.NewUniform(screenTextColor), Face: face}
+	for i, line := range lines {
+		width := drawer.MeasureString(line).Ceil()
+		x := img.Bounds().Min.X + (img.Bounds().Dx()-width)/2
+		y := top + i*lineHeight + face.Metrics().Ascent.Ceil()
+		drawer.Dot = fixed.P(x, y)
+		drawer.DrawString(line)
+	}
+}
+
+func textLineHeight() int {
+	return basicfont.Face7x13.Metrics().Height.Ceil() + 4
+}
+
+// fitLines shortens lines that would not fit in width pixels.
+func fitLines(lines []string, width int) []string {
+	maxChars := width/basicfont.Face7x13.Advance - 2
+	fitted := make([]string, len(lines))
+	for i, line := range lines {
+		if runes := []rune(line); maxChars > 3 && len(runes) > maxChars {
+			line = string(runes[:maxChars-3]) + "..."
+		}
+		fitted[i] = line
+	}
+	return fitted
+}
+
+// greyOut turns img into a dimmed greyscale version of itself.
+func greyOut(img *image.RGBA) {
+	for i := 0; i+4 <= len(img.Pix); i += 4 {
+		r, g, b := int(img.Pix[i]), int(img.Pix[i+1]), int(img.Pix[i+2])
+		grey := byte((r*299 + g*587 + b*114) / 2000)
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2] = grey, grey, grey
+	}
+}
+
+// colourOffsets returns the byte positions of red, green and blue within a
+// 32bpp pixel of format.
+func colourOffsets(format PixelFormat) (r, g, b int) {
+	offset := func(shift int) int {
+		if format.BigEndian {
+			return 3 - shift/8
+		}
+		return shift / 8
+	}
+	return offset(format.RedShift), offset(format.GreenShift), offset(format.BlueShift)
+}
+
+// convertFromStandard rewrites pixels drawn in PixelFormatStandard layout
+// into format, in place.
+func convertFromStandard(pix []byte, format PixelFormat) {
+	r, g, b := colourOffsets(format)
+	if r == 0 && g == 1 && b == 2 {
+		return
+	}
+	var px [4]byte
+	for i := 0; i+4 <= len(pix); i += 4 {
+		px = [4]byte{}
+		px[r], px[g], px[b] = pix[i], pix[i+1], pix[i+2]
+		copy(pix[i:i+4], px[:])
+	}
+}
+
+// convertToStandard rewrites pixels in format into PixelFormatStandard
+// layout, in place.
+func convertToStandard(pix []byte, format PixelFormat) {
+	r, g, b := colourOffsets(format)
+	if r == 0 && g == 1 && b == 2 {
+		return
+	}
+	for i := 0; i+4 <= len(pix); i += 4 {
+		px := [4]byte{pix[i+r], pix[i+g], pix[i+b], 0}
+		copy(pix[i:i+4], px[:])
+	}
+}
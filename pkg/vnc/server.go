@@ -5,10 +5,14 @@ package vnc
 #include <rfb/rfb.h>
 #include <stdlib.h>
 #include <string.h>
+#include <unistd.h>
 
 extern void goKeyEventCallback(rfbBool down, rfbKeySym key, rfbClientPtr cl);
 extern void goPointerEventCallback(int buttonMask, int x, int y, rfbClientPtr cl);
 extern enum rfbNewClientAction goNewClientCallback(rfbClientPtr cl);
+extern void goClientGoneCallback(rfbClientPtr cl);
+extern rfbBool goPasswordCheckCallback(rfbClientPtr cl, char* response, int len);
+extern void goSetXCutTextCallback(char* str, int len, rfbClientPtr cl);
 static inline void setKeyEventCallback(rfbScreenInfoPtr screen) {
     screen->kbdAddEvent = goKeyEventCallback;
 }
@@ -21,6 +25,14 @@ static inline void setNewClientCallback(rfbScreenInfoPtr screen) {
     screen->newClientHook = goNewClientCallback;
 }
 
+static inline void setXCutTextCallback(rfbScreenInfoPtr screen) {
+    screen->setXCutText = goSetXCutTextCallback;
+}
+
+static inline void setClientGoneCallback(rfbClientPtr cl) {
+    cl->clientGoneHook = goClientGoneCallback;
+}
+
 static inline void setServerPassword(rfbScreenInfoPtr screen, char* password) {
     char** passwords = malloc(2 * sizeof(char*));
     passwords[0] = strdup(password);
@@ -29,16 +41,94 @@ static inline void setServerPassword(rfbScreenInfoPtr screen, char* password) {
     screen->passwordCheck = rfbCheckPasswordByList;
 }
 
+// setPasswordCheckCallback enables VNC authentication with responses
+// checked in Go; authPasswdData only has to be non-NULL for that.
+static inline void setPasswordCheckCallback(rfbScreenInfoPtr screen) {
+    screen->authPasswdData = screen;
+    screen->passwordCheck = (rfbPasswordCheckProcPtr)goPasswordCheckCallback;
+}
+
+static inline void closeClient(rfbScreenInfoPtr screen, rfbClientPtr target) {
+    rfbClientPtr cl;
+    for (cl = screen->clientHead; cl != NULL; cl = cl->next) {
+        if (cl == target) {
+            rfbCloseClient(cl);
+            return;
+        }
+    }
+}
+
 static inline void markRectAsModified(rfbScreenInfoPtr screen, int x, int y, int w, int h) {
     rfbMarkRectAsModified(screen, x, y, x + w, y + h);
 }
+
+static inline void stopListening(rfbScreenInfoPtr screen) {
+    if (screen->listenSock != RFB_INVALID_SOCKET) {
+        FD_CLR(screen->listenSock, &screen->allFds);
+        close(screen->listenSock);
+        screen->listenSock = RFB_INVALID_SOCKET;
+    }
+    if (screen->listen6Sock != RFB_INVALID_SOCKET) {
+        FD_CLR(screen->listen6Sock, &screen->allFds);
+        close(screen->listen6Sock);
+        screen->listen6Sock = RFB_INVALID_SOCKET;
+    }
+}
+
+// newFramebufferKeepingFormat swaps in a new framebuffer like
+// rfbNewFramebuffer, which resets serverFormat to the default for
+// bitsPerSample, and then puts the previous pixel format back, updating the
+// viewers' translation to it.
+static inline void newFramebufferKeepingFormat(rfbScreenInfoPtr screen, char* frameBuffer, int width, int height, int bitsPerSample, int samplesPerPixel, int bytesPerPixel) {
+    rfbPixelFormat format = screen->serverFormat;
+    rfbNewFramebuffer(screen, frameBuffer, width, height, bitsPerSample, samplesPerPixel, bytesPerPixel);
+    if (memcmp(&format, &screen->serverFormat, sizeof(format)) == 0) {
+        return;
+    }
+    screen->serverFormat = format;
+
+    rfbClientPtr cl;
+    for (cl = screen->clientHead; cl != NULL; cl = cl->next) {
+        screen->setTranslateFunction(cl);
+    }
+}
+
+// hasPendingUpdates only counts changes a viewer has asked for: one that
+// stopped sending update requests, e.g. because it is minimised, would
+// otherwise keep its modified region forever.
+static inline rfbBool hasPendingUpdates(rfbScreenInfoPtr screen) {
+    rfbClientPtr cl;
+    for (cl = screen->clientHead; cl != NULL; cl = cl->next) {
+        if (cl->state != RFB_NORMAL || cl->sock == RFB_INVALID_SOCKET || sraRgnEmpty(cl->modifiedRegion)) {
+            continue;
+        }
+        sraRegionPtr pending = sraRgnCreateRgn(cl->modifiedRegion);
+        sraRgnAnd(pending, cl->requestedRegion);
+        rfbBool empty = sraRgnEmpty(pending);
+        sraRgnDestroy(pending);
+        if (!empty) {
+            return TRUE;
+        }
+    }
+    return FALSE;
+}
 */
 import "C"
 import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 	"unsafe"
 )
 
+// servePollIntervalMs bounds how long Serve waits for events before checking
+// its context again.
+const servePollIntervalMs = 10
+
 var (
 	serverHandlers = make(map[*C.rfbScreenInfo]*Server)
 	serverMutex    sync.RWMutex
@@ -65,6 +155,9 @@ func goKeyEventCallback(down C.rfbBool, key C.rfbKeySym, cl C.rfbClientPtr) {
 	}
 	serverMutex.RUnlock()
 
+	if server != nil {
+		server.touchSession(cl)
+	}
 	if server != nil && server.keyEventHandler != nil {
 		server.keyEventHandler(down != 0, uint32(key), unsafe.Pointer(cl))
 	}
@@ -91,6 +184,9 @@ func goPointerEventCallback(buttonMask C.int, x C.int, y C.int, cl C.rfbClientPt
 	}
 	serverMutex.RUnlock()
 
+	if server != nil {
+		server.touchSession(cl)
+	}
 	if server != nil && server.pointerEventHandler != nil {
 		server.pointerEventHandler(int(buttonMask), int(x), int(y), unsafe.Pointer(cl))
 	}
@@ -117,6 +213,10 @@ func goNewClientCallback(cl C.rfbClientPtr) C.enum_rfbNewClientAction {
 	}
 	serverMutex.RUnlock()
 
+	C.setClientGoneCallback(cl)
+	if server != nil {
+		server.trackSession(cl)
+	}
 	if server != nil && server.newClientHandler != nil {
 		server.newClientHandler(unsafe.Pointer(cl))
 	}
@@ -124,13 +224,79 @@ func goNewClientCallback(cl C.rfbClientPtr) C.enum_rfbNewClientAction {
 	return C.RFB_CLIENT_ACCEPT
 }
 
+//export goClientGoneCallback
+func goClientGoneCallback(cl C.rfbClientPtr) {
+	serverMutex.RLock()
+	server := serverHandlers[cl.screen]
+	serverMutex.RUnlock()
+
+	if server != nil {
+		server.forgetSession(cl)
+	}
+	if server != nil && server.clientGoneHandler != nil {
+		server.clientGoneHandler(unsafe.Pointer(cl))
+	}
+}
+
+//export goPasswordCheckCallback
+func goPasswordCheckCallback(cl C.rfbClientPtr, response *C.char, length C.int) C.rfbBool {
+	serverMutex.RLock()
+	server := serverHandlers[cl.screen]
+	serverMutex.RUnlock()
+
+	if server == nil || server.passwordCheckHandler == nil {
+		return C.FALSE
+	}
+	challenge := C.GoBytes(unsafe.Pointer(&cl.authChallenge[0]), C.CHALLENGESIZE)
+	if server.passwordCheckHandler(unsafe.Pointer(cl), challenge, C.GoBytes(unsafe.Pointer(response), length)) {
+		return C.TRUE
+	}
+	return C.FALSE
+}
+
+//export goSetXCutTextCallback
+func goSetXCutTextCallback(str *C.char, length C.int, cl C.rfbClientPtr) {
+	serverMutex.RLock()
+	server := serverHandlers[cl.screen]
+	serverMutex.RUnlock()
+
+	if server != nil && server.cutTextHandler != nil {
+		server.cutTextHandler(latin1ToString(C.GoBytes(unsafe.Pointer(str), length)), unsafe.Pointer(cl))
+	}
+}
+
 type Server struct {
-	rfbScreen           *C.rfbScreenInfo
-	frameBuffer         []byte
-	keyEventHandler     KeyEventHandler
-	pointerEventHandler PointerEventHandler
-	newClientHandler    NewClientHandler
-	running             bool
+	rfbScreen            *C.rfbScreenInfo
+	frameBuffer          []byte
+	keyEventHandler      KeyEventHandler
+	pointerEventHandler  PointerEventHandler
+	newClientHandler     NewClientHandler
+	clientGoneHandler    ClientGoneHandler
+	passwordCheckHandler PasswordCheckHandler
+	cutTextHandler       CutTextHandler
+	running              bool
+	mdns                 *MDNSAdvertiser
+	desktopName          *C.char // set by SetDesktopName, freed on change
+
+	bitsPerSample   int
+	samplesPerPixel int
+	bytesPerPixel   int
+
+	// session limits, see SetSessionLimits
+	sessionsMu            sync.Mutex
+	sessionLimits         SessionLimits
+	sessionWarningHandler SessionWarningHandler
+	sessions              map[C.rfbClientPtr]*sessionClock
+	lastSessionCheck      time.Time
+	// warnings shown in the default banner, and the framebuffer rows the
+	// banner covers, which only the serving goroutine touches
+	sessionNotices    map[C.rfbClientPtr]sessionNotice
+	sessionBannerRows []byte
+
+	// work queued for the goroutine running Serve, see do
+	tasksMu sync.Mutex
+	tasks   []func()
+	serving bool
 }
 
 func NewServer(width, height, bitsPerSample, samplesPerPixel, bytesPerPixel int) *Server {
@@ -144,15 +310,23 @@ func NewServer(width, height, bitsPerSample, samplesPerPixel, bytesPerPixel int)
 	screen.frameBuffer = (*C.char)(unsafe.Pointer(&frameBuffer[0]))
 
 	server := &Server{
-		rfbScreen:   screen,
-		frameBuffer: frameBuffer,
-		running:     false,
+		rfbScreen:       screen,
+		frameBuffer:     frameBuffer,
+		running:         false,
+		bitsPerSample:   bitsPerSample,
+		samplesPerPixel: samplesPerPixel,
+		bytesPerPixel:   bytesPerPixel,
+		sessions:        make(map[C.rfbClientPtr]*sessionClock),
+		sessionNotices:  make(map[C.rfbClientPtr]sessionNotice),
 	}
 
 	serverMutex.Lock()
 	serverHandlers[screen] = server
 	serverMutex.Unlock()
 
+	// always hooked so client gone callbacks get installed
+	C.setNewClientCallback(screen)
+
 	return server
 }
 
@@ -181,14 +355,81 @@ func (s *Server) SetStandardPixelFormat() {
 	s.SetPixelFormat(PixelFormatStandard)
 }
 
+// SetPort sets the IPv4 and IPv6 listening port. A port of 0 disables
+// listening; viewers can then only be added with AttachConn.
 func (s *Server) SetPort(port int) {
 	s.rfbScreen.port = C.int(port)
+	s.rfbScreen.ipv6port = C.int(port)
 }
 
 func (s *Server) SetPassword(password string) {
 	C.setServerPassword(s.rfbScreen, C.CString(password))
 }
 
+// SetSharingPolicy decides whether new viewers share the desktop or
+// disconnect, or are refused by, those already connected. It must not be
+// called from event handlers.
+func (s *Server) SetSharingPolicy(policy SharingPolicy) error {
+	if err := policy.validate(); err != nil {
+		return err
+	}
+	s.do(func() {
+		s.rfbScreen.alwaysShared = rfbBool(policy.Mode == SharingAlways)
+		s.rfbScreen.neverShared = rfbBool(policy.Mode == SharingNever)
+		s.rfbScreen.dontDisconnect = rfbBool(policy.DontDisconnect)
+	})
+	return nil
+}
+
+func rfbBool(b bool) C.rfbBool {
+	if b {
+		return C.TRUE
+	}
+	return C.FALSE
+}
+
+// SetDesktopName sets the name viewers see. It must not be called from
+// event handlers.
+func (s *Server) SetDesktopName(name string) {
+	cName := C.CString(name)
+	previous := s.desktopName
+	s.do(func() {
+		s.rfbScreen.desktopName = cName
+	})
+	s.desktopName = cName
+	if previous != nil {
+		C.free(unsafe.Pointer(previous))
+	}
+}
+
+// AdvertiseMDNS announces the server as an _rfb._tcp service under instance
+// (default: the desktop name) until the server is closed. Call it after
+// InitServer so the port and password settings are final.
+func (s *Server) AdvertiseMDNS(instance string, opts MDNSOptions) error {
+	if instance == "" && s.rfbScreen.desktopName != nil {
+		instance = C.GoString(s.rfbScreen.desktopName)
+	}
+
+	service := MDNSService{
+		Instance:     instance,
+		Port:         int(s.rfbScreen.port),
+		Width:        s.GetWidth(),
+		Height:       s.GetHeight(),
+		AuthRequired: s.rfbScreen.authPasswdData != nil,
+	}
+
+	if s.mdns != nil {
+		s.mdns.Update(service)
+		return nil
+	}
+	advertiser, err := AdvertiseMDNS(service, opts)
+	if err != nil {
+		return err
+	}
+	s.mdns = advertiser
+	return nil
+}
+
 func (s *Server) SetKeyEventHandler(handler KeyEventHandler) {
 	s.keyEventHandler = handler
 	C.setKeyEventCallback(s.rfbScreen)
@@ -201,7 +442,64 @@ func (s *Server) SetPointerEventHandler(handler PointerEventHandler) {
 
 func (s *Server) SetNewClientHandler(handler NewClientHandler) {
 	s.newClientHandler = handler
-	C.setNewClientCallback(s.rfbScreen)
+}
+
+// SetClientGoneHandler sets a handler called when a viewer disconnects,
+// including viewers still connected when the server is closed.
+func (s *Server) SetClientGoneHandler(handler ClientGoneHandler) {
+	s.clientGoneHandler = handler
+}
+
+// SetPasswordCheckHandler enables VNC authentication and lets handler
+// decide whether a viewer's response to the challenge is valid, e.g. to
+// accept several passwords. It replaces SetPassword.
+func (s *Server) SetPasswordCheckHandler(handler PasswordCheckHandler) {
+	s.passwordCheckHandler = handler
+	C.setPasswordCheckCallback(s.rfbScreen)
+}
+
+// SetCutTextHandler sets a handler called with clipboard text a viewer
+// sends.
+func (s *Server) SetCutTextHandler(handler CutTextHandler) {
+	s.cutTextHandler = handler
+	C.setXCutTextCallback(s.rfbScreen)
+}
+
+// SendCutText sends clipboard text to all viewers. RFB clipboard text is
+// Latin-1, so characters outside it are sent as '?'. It must not be called
+// from event handlers.
+func (s *Server) SendCutText(text string) {
+	if text == "" {
+		return
+	}
+	latin1 := stringToLatin1(text)
+	cText := (*C.char)(C.CBytes(latin1))
+	defer C.free(unsafe.Pointer(cText))
+	s.do(func() {
+		if s.rfbScreen != nil {
+			C.rfbSendServerCutText(s.rfbScreen, cText, C.int(len(latin1)))
+		}
+	})
+}
+
+// ClientAddress returns the address of a viewer as seen by libvncserver.
+// It must be called from an event handler for that viewer.
+func (s *Server) ClientAddress(clientPtr unsafe.Pointer) string {
+	cl := C.rfbClientPtr(clientPtr)
+	if cl == nil || cl.host == nil {
+		return ""
+	}
+	return C.GoString(cl.host)
+}
+
+// CloseClient disconnects a viewer if it is still connected. It must not
+// be called from event handlers; run it on another goroutine from there.
+func (s *Server) CloseClient(clientPtr unsafe.Pointer) {
+	s.do(func() {
+		if s.rfbScreen != nil {
+			C.closeClient(s.rfbScreen, C.rfbClientPtr(clientPtr))
+		}
+	})
 }
 
 func (s *Server) GetFrameBuffer() []byte {
@@ -220,14 +518,255 @@ func (s *Server) MarkRectAsModified(x, y, w, h int) {
 	C.markRectAsModified(s.rfbScreen, C.int(x), C.int(y), C.int(w), C.int(h))
 }
 
+// Resize replaces the framebuffer with a blank one of the given size. The
+// pixel format set with SetPixelFormat is kept. Connected viewers that
+// support the NewFBSize pseudo-encoding are told about the new size.
+func (s *Server) Resize(width, height int) error {
+	if width <= 0 || height <= 0 {
+		return fmt.Errorf("invalid framebuffer size %dx%d", width, height)
+	}
+	s.do(func() {
+		frameBuffer := make([]byte, width*height*s.bytesPerPixel)
+		C.newFramebufferKeepingFormat(s.rfbScreen, (*C.char)(unsafe.Pointer(&frameBuffer[0])), C.int(width), C.int(height), C.int(s.bitsPerSample), C.int(s.samplesPerPixel), C.int(s.bytesPerPixel))
+		s.frameBuffer = frameBuffer
+		s.sessionBannerRows = nil
+	})
+	return nil
+}
+
 func (s *Server) InitServer() error {
 	C.rfbInitServer(s.rfbScreen)
 	s.running = true
 	return nil
 }
 
+// ConnectToViewer makes a reverse connection to a viewer listening on addr
+// (see Client.Listen). A bare host uses DefaultListenPort. The server must
+// have been initialized with InitServer.
+func (s *Server) ConnectToViewer(addr string) error {
+	host, port, err := splitHostPortDefault(addr, DefaultListenPort)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrReverseConnection, err)
+	}
+
+	cHost := C.CString(host)
+	defer C.free(unsafe.Pointer(cHost))
+
+	if C.rfbReverseConnection(s.rfbScreen, cHost, C.int(port)) == nil {
+		return fmt.Errorf("%w to %s", ErrReverseConnection, addr)
+	}
+	return nil
+}
+
+// ConnectToViewerWithID makes a reverse connection to addr that first
+// identifies this server with a repeater style "ID:xxxx" preamble, as expected
+// by a Multiplexer's TargetListener. Unlike ConnectToViewer, the viewer still
+// has to pass the server's password authentication.
+func (s *Server) ConnectToViewerWithID(addr, id string) error {
+	host, port, err := splitHostPortDefault(addr, DefaultListenPort)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrReverseConnection, err)
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrReverseConnection, err)
+	}
+	if id != "" {
+		if err := writePreamble(conn, "ID:"+id); err != nil {
+			conn.Close()
+			return fmt.Errorf("%w: %v", ErrReverseConnection, err)
+		}
+	}
+
+	return s.AttachConn(conn)
+}
+
+// ConnectToRepeater registers the server with an UltraVNC repeater in mode II
+// (cfg.ID) so a viewer using the same ID can be paired with it. Viewers still
+// have to pass the server's password authentication.
+func (s *Server) ConnectToRepeater(ctx context.Context, cfg RepeaterConfig) error {
+	conn, err := dialRepeater(ctx, cfg, true)
+	if err != nil {
+		return err
+	}
+	return s.AttachConn(conn)
+}
+
+// AttachConn hands conn over to libvncserver as a new viewer connection. Any
+// data already waiting on conn, such as a WebSocket upgrade request, is left
+// for libvncserver to read. conn itself is closed.
+func (s *Server) AttachConn(conn net.Conn) error {
+	fd, err := dupConnFD(conn)
+	conn.Close()
+	if err != nil {
+		return err
+	}
+
+	if C.rfbNewClient(s.rfbScreen, C.SOCKET(fd)) == nil {
+		return fmt.Errorf("failed to create RFB client")
+	}
+	return nil
+}
+
 func (s *Server) ProcessEvents(timeoutMs int) {
 	C.rfbProcessEvents(s.rfbScreen, C.long(timeoutMs*1000))
+	s.checkSessions()
+}
+
+// SetSessionLimits disconnects viewers that stay idle or connected for too
+// long. Viewers that sent no key or pointer event yet count as idle since
+// they connected. Unless a SessionWarningHandler is set, viewers about to be
+// disconnected are warned by a banner across the bottom of the framebuffer;
+// the rows under it are put back once no warning is pending, so anything
+// drawn there meanwhile is lost. The banner needs a 32bpp true-colour pixel
+// format.
+func (s *Server) SetSessionLimits(limits SessionLimits) error {
+	if err := limits.validate(); err != nil {
+		return err
+	}
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	s.sessionLimits = limits
+	return nil
+}
+
+// SetSessionWarningHandler sets a handler called on the serving goroutine
+// when a viewer is about to be disconnected by a session limit, e.g. to
+// show a warning in the framebuffer. It replaces the default banner.
+func (s *Server) SetSessionWarningHandler(handler SessionWarningHandler) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	s.sessionWarningHandler = handler
+}
+
+func (s *Server) trackSession(cl C.rfbClientPtr) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	s.sessions[cl] = &sessionClock{joined: time.Now()}
+}
+
+func (s *Server) touchSession(cl C.rfbClientPtr) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	if session := s.sessions[cl]; session != nil {
+		session.lastInput = time.Now()
+	}
+}
+
+func (s *Server) forgetSession(cl C.rfbClientPtr) {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+	delete(s.sessions, cl)
+	delete(s.sessionNotices, cl)
+}
+
+// checkSessions warns and disconnects viewers according to the session
+// limits. It runs on the serving goroutine, at most once per
+// sessionCheckInterval.
+func (s *Server) checkSessions() {
+	now := time.Now()
+	s.sessionsMu.Lock()
+	if (!s.sessionLimits.enabled() && len(s.sessionNotices) == 0) || now.Sub(s.lastSessionCheck) < sessionCheckInterval {
+		s.sessionsMu.Unlock()
+		return
+	}
+	s.lastSessionCheck = now
+	if !s.sessionLimits.enabled() {
+		clear(s.sessionNotices)
+	}
+
+	type warning struct {
+		cl      C.rfbClientPtr
+		warning SessionWarning
+	}
+	var expired []C.rfbClientPtr
+	var warnings []warning
+	for cl, session := range s.sessions {
+		over, reason, w := session.check(s.sessionLimits, now)
+		switch {
+		case over:
+			expired = append(expired, cl)
+			delete(s.sessions, cl)
+			delete(s.sessionNotices, cl)
+		case w != nil && w.Reason == "":
+			delete(s.sessionNotices, cl)
+			warnings = append(warnings, warning{cl, *w})
+		case w != nil:
+			s.sessionNotices[cl] = sessionNotice{reason: reason, deadline: now.Add(w.Remaining)}
+			warnings = append(warnings, warning{cl, *w})
+		}
+	}
+	handler := s.sessionWarningHandler
+	var lines []string
+	if handler == nil {
+		for cl, notice := range s.sessionNotices {
+			lines = append(lines, notice.line(s.ClientAddress(unsafe.Pointer(cl)), now))
+		}
+		sort.Strings(lines)
+	}
+	s.sessionsMu.Unlock()
+
+	if handler != nil {
+		for _, w := range warnings {
+			handler(unsafe.Pointer(w.cl), w.warning)
+		}
+	}
+	s.drawSessionBanner(lines)
+	for _, cl := range expired {
+		C.rfbCloseClient(cl)
+	}
+}
+
+// drawSessionBanner shows lines on a banner across the bottom of the
+// framebuffer, first putting back the rows a previous banner covered. It
+// runs on the serving goroutine.
+func (s *Server) drawSessionBanner(lines []string) {
+	format, ok := s.bannerPixelFormat()
+	img := frameBufferImage(s.frameBuffer, s.GetWidth(), s.GetHeight())
+	if !ok || img == nil {
+		return
+	}
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+
+	previous := len(s.sessionBannerRows) / img.Stride
+	copy(img.Pix[(height-previous)*img.Stride:], s.sessionBannerRows)
+	s.sessionBannerRows = nil
+
+	covered := 0
+	if len(lines) > 0 {
+		covered = min(len(lines)*textLineHeight()+8, height)
+		top := (height - covered) * img.Stride
+		s.sessionBannerRows = append([]byte(nil), img.Pix[top:]...)
+		drawWarningBanner(img, lines)
+		convertFromStandard(img.Pix[top:], format)
+	}
+	if rows := max(previous, covered); rows > 0 {
+		s.MarkRectAsModified(0, height-rows, width, rows)
+	}
+}
+
+// bannerPixelFormat returns the server's pixel format and whether the
+// drawing helpers can handle it: 32bpp true colour with byte-aligned 8-bit
+// channels.
+func (s *Server) bannerPixelFormat() (PixelFormat, bool) {
+	f := s.rfbScreen.serverFormat
+	format := PixelFormat{
+		BitsPerPixel: int(f.bitsPerPixel),
+		Depth:        int(f.depth),
+		BigEndian:    f.bigEndian != 0,
+		TrueColour:   f.trueColour != 0,
+		RedMax:       int(f.redMax),
+		GreenMax:     int(f.greenMax),
+		BlueMax:      int(f.blueMax),
+		RedShift:     int(f.redShift),
+		GreenShift:   int(f.greenShift),
+		BlueShift:    int(f.blueShift),
+	}
+	ok := format.BitsPerPixel == 32 && format.TrueColour &&
+		format.RedMax == 255 && format.GreenMax == 255 && format.BlueMax == 255 &&
+		format.RedShift%8 == 0 && format.GreenShift%8 == 0 && format.BlueShift%8 == 0
+	return format, ok
 }
 
 func (s *Server) RunEventLoop(timeoutMs int) error {
@@ -237,10 +776,105 @@ func (s *Server) RunEventLoop(timeoutMs int) error {
 	return nil
 }
 
+// Serve processes events until the server is stopped or ctx is cancelled, in
+// which case ctx.Err() is returned. The server must have been initialized
+// with InitServer.
+func (s *Server) Serve(ctx context.Context) error {
+	s.tasksMu.Lock()
+	s.serving = true
+	s.tasksMu.Unlock()
+	defer func() {
+		s.tasksMu.Lock()
+		s.serving = false
+		s.tasksMu.Unlock()
+		s.runTasks()
+	}()
+
+	for s.running {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		s.runTasks()
+		s.ProcessEvents(servePollIntervalMs)
+	}
+	return nil
+}
+
+// do runs fn on the goroutine serving events, so it does not race with
+// libvncserver, and waits for it to finish. When the server is not being
+// served fn runs directly. It must not be called from event handlers, which
+// already run on the serving goroutine.
+func (s *Server) do(fn func()) {
+	s.tasksMu.Lock()
+	if !s.serving {
+		s.tasksMu.Unlock()
+		fn()
+		return
+	}
+	done := make(chan struct{})
+	s.tasks = append(s.tasks, func() {
+		fn()
+		close(done)
+	})
+	s.tasksMu.Unlock()
+	<-done
+}
+
+func (s *Server) runTasks() {
+	s.tasksMu.Lock()
+	tasks := s.tasks
+	s.tasks = nil
+	s.tasksMu.Unlock()
+
+	for _, task := range tasks {
+		task()
+	}
+}
+
+// StopListening closes the listening sockets so no new viewers can connect,
+// leaving connected viewers untouched.
+func (s *Server) StopListening() {
+	s.do(func() {
+		C.stopListening(s.rfbScreen)
+	})
+}
+
+// HasPendingUpdates reports whether any connected viewer still has
+// framebuffer changes it asked for but has not received yet.
+func (s *Server) HasPendingUpdates() bool {
+	pending := false
+	s.do(func() {
+		pending = C.hasPendingUpdates(s.rfbScreen) != 0
+	})
+	return pending
+}
+
 func (s *Server) IsActive() bool {
 	return C.rfbIsActive(s.rfbScreen) != 0
 }
 
+// Clients lists the connected viewers. It must not be called from event
+// handlers.
+func (s *Server) Clients() []ClientInfo {
+	var clients []ClientInfo
+	s.do(func() {
+		if s.rfbScreen == nil {
+			return
+		}
+		for cl := s.rfbScreen.clientHead; cl != nil; cl = cl.next {
+			info := ClientInfo{
+				Client:    unsafe.Pointer(cl),
+				BytesSent: int64(C.rfbStatGetSentBytes(cl)),
+			}
+			if cl.host != nil {
+				info.Address = C.GoString(cl.host)
+			}
+			clients = append(clients, info)
+		}
+	})
+	return clients
+}
+
 func (s *Server) GetClientCount() int {
 	count := 0
 	client := s.rfbScreen.clientHead
@@ -258,12 +892,21 @@ func (s *Server) Stop() {
 func (s *Server) Close() {
 	s.Stop()
 
-	serverMutex.Lock()
-	delete(serverHandlers, s.rfbScreen)
-	serverMutex.Unlock()
+	if s.mdns != nil {
+		s.mdns.Close()
+		s.mdns = nil
+	}
 
 	if s.rfbScreen != nil {
 		C.rfbScreenCleanup(s.rfbScreen)
+
+		serverMutex.Lock()
+		delete(serverHandlers, s.rfbScreen)
+		serverMutex.Unlock()
 		s.rfbScreen = nil
 	}
+	if s.desktopName != nil {
+		C.free(unsafe.Pointer(s.desktopName))
+		s.desktopName = nil
+	}
 }
@@ -0,0 +1,137 @@
+package vnc
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"time"
+)
+
+// DefaultSessionWarning is how long before a session limit disconnects a
+// viewer it is warned.
+const DefaultSessionWarning = time.Minute
+
+// sessionCheckInterval is how often session limits are checked.
+const sessionCheckInterval = time.Second
+
+// SessionLimits bounds how long viewers stay connected.
+type SessionLimits struct {
+	// IdleTimeout disconnects viewers that sent no input for that long.
+	IdleTimeout Duration `json:"idleTimeout,omitempty" yaml:"idleTimeout,omitempty"`
+	// MaxSession disconnects viewers connected for that long.
+	MaxSession Duration `json:"maxSession,omitempty" yaml:"maxSession,omitempty"`
+	// Warning is how long before disconnecting viewers are warned (default
+	// DefaultSessionWarning).
+	Warning Duration `json:"warning,omitempty" yaml:"warning,omitempty"`
+}
+
+// SessionWarning tells a viewer its session is about to end.
+type SessionWarning struct {
+	// Reason is "idle" or "maxSession". It is empty when an idle warning is
+	// withdrawn because the viewer became active again.
+	Reason    string
+	Remaining time.Duration
+}
+
+func (l SessionLimits) validate() error {
+	if l.IdleTimeout < 0 || l.MaxSession < 0 || l.Warning < 0 {
+		return fmt.Errorf("session limits cannot be negative")
+	}
+	return nil
+}
+
+func (l SessionLimits) enabled() bool {
+	return l.IdleTimeout > 0 || l.MaxSession > 0
+}
+
+func (l SessionLimits) warning() time.Duration {
+	if l.Warning <= 0 {
+		return DefaultSessionWarning
+	}
+	return time.Duration(l.Warning)
+}
+
+// deadline returns when a session that started at joined and last saw input
+// at lastInput ends, and why. It returns a zero time without limits.
+func (l SessionLimits) deadline(joined, lastInput time.Time) (time.Time, string) {
+	var deadline time.Time
+	var reason string
+	if l.IdleTimeout > 0 {
+		if lastInput.Before(joined) {
+			lastInput = joined
+		}
+		deadline, reason = lastInput.Add(time.Duration(l.IdleTimeout)), "idle"
+	}
+	if l.MaxSession > 0 {
+		if end := joined.Add(time.Duration(l.MaxSession)); deadline.IsZero() || end.Before(deadline) {
+			deadline, reason = end, "maxSession"
+		}
+	}
+	return deadline, reason
+}
+
+// sessionClock tracks one viewer against session limits.
+type sessionClock struct {
+	joined    time.Time
+	lastInput time.Time
+	warned    string // reason of the warning given, if any
+}
+
+// check returns what to do about the session at now: expired reports that
+// it is over, warning, if set, is a warning to pass on.
+func (c *sessionClock) check(limits SessionLimits, now time.Time) (expired bool, reason string, warning *SessionWarning) {
+	deadline, reason := limits.deadline(c.joined, c.lastInput)
+	if deadline.IsZero() {
+		return false, "", nil
+	}
+	remaining := deadline.Sub(now)
+	if remaining <= 0 {
+		return true, reason, nil
+	}
+
+	if remaining <= limits.warning() {
+		if c.warned != reason {
+			c.warned = reason
+			return false, reason, &SessionWarning{Reason: reason, Remaining: remaining}
+		}
+	} else if c.warned != "" {
+		c.warned = ""
+		return false, reason, &SessionWarning{}
+	}
+	return false, reason, nil
+}
+
+var sessionWarningBackground = color.RGBA{R: 0x80, G: 0x20, B: 0x20, A: 0xff}
+
+// sessionNotice is a pending disconnection shown in the warning banner.
+type sessionNotice struct {
+	reason   string
+	deadline time.Time
+}
+
+// line describes the notice for the viewer called who.
+func (n sessionNotice) line(who string, now time.Time) string {
+	seconds := int(math.Ceil(n.deadline.Sub(now).Seconds()))
+	return fmt.Sprintf("%s will be disconnected in %ds (%s)", who, max(seconds, 0), sessionEndReason(n.reason))
+}
+
+// drawWarningBanner draws lines on a banner across the bottom of img, in
+// PixelFormatStandard layout, and returns its height.
+func drawWarningBanner(img *image.RGBA, lines []string) int {
+	if len(lines) == 0 {
+		return 0
+	}
+	lines = fitLines(lines, img.Rect.Dx())
+	height := min(len(lines)*textLineHeight()+8, img.Rect.Dy())
+	banner := img.SubImage(image.Rect(0, img.Rect.Dy()-height, img.Rect.Dx(), img.Rect.Dy())).(*image.RGBA)
+	drawMessageScreen(banner, sessionWarningBackground, lines)
+	return height
+}
+
+func sessionEndReason(reason string) string {
+	if reason == "idle" {
+		return "idle timeout"
+	}
+	return "session limit"
+}
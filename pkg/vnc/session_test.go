@@ -0,0 +1,126 @@
+package vnc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionLimitsDeadline(t *testing.T) {
+	joined := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name      string
+		limits    SessionLimits
+		lastInput time.Time
+		want      time.Time
+		reason    string
+	}{
+		{name: "no limits", limits: SessionLimits{}},
+		{name: "idle since join", limits: SessionLimits{IdleTimeout: Duration(10 * time.Minute)}, want: joined.Add(10 * time.Minute), reason: "idle"},
+		{name: "idle since input", limits: SessionLimits{IdleTimeout: Duration(10 * time.Minute)}, lastInput: joined.Add(time.Hour), want: joined.Add(70 * time.Minute), reason: "idle"},
+		{name: "max session", limits: SessionLimits{MaxSession: Duration(time.Hour)}, lastInput: joined.Add(2 * time.Hour), want: joined.Add(time.Hour), reason: "maxSession"},
+		{name: "idle first", limits: SessionLimits{IdleTimeout: Duration(10 * time.Minute), MaxSession: Duration(time.Hour)}, lastInput: joined.Add(5 * time.Minute), want: joined.Add(15 * time.Minute), reason: "idle"},
+		{name: "max session first", limits: SessionLimits{IdleTimeout: Duration(10 * time.Minute), MaxSession: Duration(time.Hour)}, lastInput: joined.Add(55 * time.Minute), want: joined.Add(time.Hour), reason: "maxSession"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, reason := tt.limits.deadline(joined, tt.lastInput)
+			if !got.Equal(tt.want) || reason != tt.reason {
+				t.Errorf("deadline = %v, %q; want %v, %q", got, reason, tt.want, tt.reason)
+			}
+		})
+	}
+}
+
+func TestSessionClockCheck(t *testing.T) {
+	joined := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	limits := SessionLimits{IdleTimeout: Duration(10 * time.Minute), MaxSession: Duration(time.Hour), Warning: Duration(time.Minute)}
+
+	// steps run in order against one clock
+	steps := []struct {
+		name      string
+		at        time.Duration // since joined
+		lastInput time.Duration // moves the last input, if set
+		expired   bool
+		warning   *SessionWarning
+	}{
+		{name: "fresh", at: time.Minute},
+		{name: "idle warning", at: 9*time.Minute + 30*time.Second, warning: &SessionWarning{Reason: "idle", Remaining: 30 * time.Second}},
+		{name: "warned once", at: 9*time.Minute + 40*time.Second},
+		{name: "active again", at: 9*time.Minute + 50*time.Second, lastInput: 9*time.Minute + 45*time.Second, warning: &SessionWarning{}},
+		{name: "quiet after withdrawal", at: 10 * time.Minute, lastInput: 9*time.Minute + 45*time.Second},
+		{name: "max session warning", at: 59 * time.Minute, lastInput: 58 * time.Minute, warning: &SessionWarning{Reason: "maxSession", Remaining: time.Minute}},
+		{name: "input does not help", at: 59*time.Minute + 30*time.Second, lastInput: 59 * time.Minute},
+		{name: "expired", at: time.Hour, lastInput: 59 * time.Minute, expired: true},
+	}
+
+	clock := &sessionClock{joined: joined}
+	for _, step := range steps {
+		if step.lastInput > 0 {
+			clock.lastInput = joined.Add(step.lastInput)
+		}
+		expired, _, warning := clock.check(limits, joined.Add(step.at))
+		if expired != step.expired {
+			t.Errorf("%s: expired = %v, want %v", step.name, expired, step.expired)
+		}
+		switch {
+		case warning == nil && step.warning == nil:
+		case warning == nil || step.warning == nil || *warning != *step.warning:
+			t.Errorf("%s: warning = %+v, want %+v", step.name, warning, step.warning)
+		}
+	}
+}
+
+func TestSessionNoticeLine(t *testing.T) {
+	now := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		notice sessionNotice
+		want   string
+	}{
+		{notice: sessionNotice{reason: "idle", deadline: now.Add(29500 * time.Millisecond)}, want: "viewer-1 will be disconnected in 30s (idle timeout)"},
+		{notice: sessionNotice{reason: "maxSession", deadline: now.Add(time.Minute)}, want: "viewer-1 will be disconnected in 60s (session limit)"},
+		{notice: sessionNotice{reason: "idle", deadline: now.Add(-time.Second)}, want: "viewer-1 will be disconnected in 0s (idle timeout)"},
+	}
+	for _, tt := range tests {
+		if got := tt.notice.line("viewer-1", now); got != tt.want {
+			t.Errorf("line() = %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestSessionLimitsValidate(t *testing.T) {
+	tests := []struct {
+		limits  SessionLimits
+		wantErr bool
+	}{
+		{limits: SessionLimits{}},
+		{limits: SessionLimits{IdleTimeout: Duration(time.Minute), MaxSession: Duration(time.Hour)}},
+		{limits: SessionLimits{IdleTimeout: -1}, wantErr: true},
+		{limits: SessionLimits{Warning: -1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		if err := tt.limits.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("validate(%+v) = %v, want error %v", tt.limits, err, tt.wantErr)
+		}
+	}
+}
+
+func TestDrawWarningBanner(t *testing.T) {
+	img := frameBufferImage(make([]byte, 200*100*4), 200, 100)
+	if height := drawWarningBanner(img, nil); height != 0 {
+		t.Fatalf("banner without lines is %d rows high", height)
+	}
+
+	height := drawWarningBanner(img, []string{"viewer-1 will be disconnected in 30s (idle timeout)", "viewer-2 will be disconnected in 60s (session limit)"})
+	if want := 2*textLineHeight() + 8; height != want {
+		t.Fatalf("banner is %d rows high, want %d", height, want)
+	}
+	top := 100 - height
+	for i, b := range img.Pix[:top*img.Stride] {
+		if b != 0 {
+			t.Fatalf("byte %d above the banner changed", i)
+		}
+	}
+	if got := img.RGBAAt(0, 99); got != sessionWarningBackground {
+		t.Errorf("banner background %v, want %v", got, sessionWarningBackground)
+	}
+}
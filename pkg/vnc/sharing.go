@@ -0,0 +1,35 @@
+package vnc
+
+import "fmt"
+
+// SharingMode decides whether viewers share the desktop with each other.
+type SharingMode string
+
+const (
+	// SharingViewer honours the shared flag each viewer sends when it
+	// connects.
+	SharingViewer SharingMode = "viewer"
+	// SharingAlways treats every viewer as shared, whatever it asks for.
+	SharingAlways SharingMode = "always"
+	// SharingNever treats every viewer as exclusive.
+	SharingNever SharingMode = "never"
+)
+
+// SharingPolicy decides what happens when a viewer connects while others
+// are connected.
+type SharingPolicy struct {
+	// Mode defaults to SharingViewer.
+	Mode SharingMode `json:"mode,omitempty" yaml:"mode,omitempty"`
+	// DontDisconnect refuses a new exclusive viewer while others are
+	// connected; otherwise it disconnects them.
+	DontDisconnect bool `json:"dontDisconnect,omitempty" yaml:"dontDisconnect,omitempty"`
+}
+
+func (p SharingPolicy) validate() error {
+	switch p.Mode {
+	case "", SharingViewer, SharingAlways, SharingNever:
+		return nil
+	default:
+		return fmt.Errorf("unknown sharing mode %q", p.Mode)
+	}
+}
@@ -0,0 +1,173 @@
+package vnc
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// TargetListener accepts reverse connections from VNC servers that dial home
+// instead of being dialed, e.g. machines behind NAT. A target identifies
+// itself by sending a repeater style "ID:xxxx" preamble before the RFB
+// handshake (see Server.ConnectToViewerWithID); connections without one are
+// routed to the multiplexer registered with the empty ID, which then relies
+// on the pre-shared VNC password to authenticate the target.
+type TargetListener struct {
+	listener net.Listener
+	logger   *log.Logger
+
+	mu     sync.Mutex
+	routes map[string]chan net.Conn
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func ListenForTargets(addr string) (*TargetListener, error) {
+	return ListenForTargetsWithLogger(addr, log.Default())
+}
+
+// ListenForTargetsWithLogger is ListenForTargets logging to logger instead
+// of log.Default().
+func ListenForTargetsWithLogger(addr string, logger *log.Logger) (*TargetListener, error) {
+	if logger == nil {
+		logger = log.Default()
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &TargetListener{
+		listener: listener,
+		logger:   logger,
+		routes:   make(map[string]chan net.Conn),
+		closed:   make(chan struct{}),
+	}
+	go l.acceptLoop()
+
+	l.logger.Printf("Listening for dial-home targets on %s.", listener.Addr())
+	return l, nil
+}
+
+func (l *TargetListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+func (l *TargetListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.listener.Close()
+
+		l.mu.Lock()
+		for id, route := range l.routes {
+			drainRoute(route)
+			delete(l.routes, id)
+		}
+		l.mu.Unlock()
+	})
+	return err
+}
+
+func (l *TargetListener) acceptLoop() {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			select {
+			case <-l.closed:
+				return
+			default:
+			}
+			l.logger.Printf("Target listener accept error: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go l.handleConn(conn)
+	}
+}
+
+func (l *TargetListener) handleConn(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	id, err := readIDPreamble(conn)
+	if err != nil {
+		l.logger.Printf("Dropping target connection from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	route, ok := l.routes[id]
+	if !ok {
+		l.logger.Printf("Dropping target connection from %s: no multiplexer for ID %q", conn.RemoteAddr(), id)
+		conn.Close()
+		return
+	}
+
+	// A target that re-dials replaces a connection nobody picked up yet.
+	drainRoute(route)
+	route <- conn
+	l.logger.Printf("Target %q dialed in from %s.", id, conn.RemoteAddr())
+}
+
+// register reserves id so that targets dialing in with it are queued for
+// waitForTarget.
+func (l *TargetListener) register(id string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	select {
+	case <-l.closed:
+		return ErrTargetListenerClosed
+	default:
+	}
+	if _, exists := l.routes[id]; exists {
+		return fmt.Errorf("target ID %q already registered", id)
+	}
+	l.routes[id] = make(chan net.Conn, 1)
+	return nil
+}
+
+func (l *TargetListener) unregister(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if route, ok := l.routes[id]; ok {
+		drainRoute(route)
+		delete(l.routes, id)
+	}
+}
+
+// waitForTarget blocks until the target registered as id dials in, the
+// listener is closed or ctx is cancelled.
+func (l *TargetListener) waitForTarget(ctx context.Context, id string) (net.Conn, error) {
+	l.mu.Lock()
+	route, ok := l.routes[id]
+	l.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("target ID %q not registered", id)
+	}
+
+	select {
+	case conn := <-route:
+		return conn, nil
+	case <-l.closed:
+		return nil, ErrTargetListenerClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func drainRoute(route chan net.Conn) {
+	select {
+	case stale := <-route:
+		stale.Close()
+	default:
+	}
+}
@@ -0,0 +1,69 @@
+package vnc
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe for loggers shared between goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestTargetListenerRoutesByID(t *testing.T) {
+	var logs syncBuffer
+	l, err := ListenForTargetsWithLogger("127.0.0.1:0", log.New(&logs, "", 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := l.register("desk-1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.register("desk-1"); err == nil {
+		t.Error("registered the same ID twice")
+	}
+
+	for _, preamble := range []string{"ID:unknown", "ID:desk-1"} {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if err := writePreamble(conn, preamble); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := l.waitForTarget(ctx, "desk-1")
+	if err != nil {
+		t.Fatalf("waitForTarget: %v", err)
+	}
+	conn.Close()
+
+	waitFor(t, "both targets to be logged", func() bool {
+		return strings.Contains(logs.String(), `no multiplexer for ID "unknown"`) &&
+			strings.Contains(logs.String(), `Target "desk-1" dialed in`)
+	})
+}
@@ -4,7 +4,53 @@ import "unsafe"
 
 type GotFrameBufferUpdateHandler func(x, y, w, h int)
 type FinishedFrameBufferUpdateHandler func()
+type GotCutTextHandler func(text string)
 
 type KeyEventHandler func(down bool, key uint32, clientPtr unsafe.Pointer)
 type PointerEventHandler func(buttonMask, x, y int, clientPtr unsafe.Pointer)
 type NewClientHandler func(clientPtr unsafe.Pointer)
+type ClientGoneHandler func(clientPtr unsafe.Pointer)
+type CutTextHandler func(text string, clientPtr unsafe.Pointer)
+
+// SessionWarningHandler is called when a viewer is warned that a session
+// limit will disconnect it, and when an idle warning is withdrawn.
+type SessionWarningHandler func(clientPtr unsafe.Pointer, warning SessionWarning)
+
+// PasswordCheckHandler reports whether response is a viewer's valid answer
+// to the VNC authentication challenge.
+type PasswordCheckHandler func(clientPtr unsafe.Pointer, challenge, response []byte) bool
+
+// ClientInfo describes a viewer connected to a Server.
+type ClientInfo struct {
+	Client    unsafe.Pointer
+	Address   string
+	BytesSent int64
+}
+
+type PixelFormat struct {
+	BitsPerPixel int  `json:"bitsPerPixel" yaml:"bitsPerPixel"`
+	Depth        int  `json:"depth" yaml:"depth"`
+	BigEndian    bool `json:"bigEndian" yaml:"bigEndian"`
+	TrueColour   bool `json:"trueColour" yaml:"trueColour"`
+	RedMax       int  `json:"redMax" yaml:"redMax"`
+	GreenMax     int  `json:"greenMax" yaml:"greenMax"`
+	BlueMax      int  `json:"blueMax" yaml:"blueMax"`
+	RedShift     int  `json:"redShift" yaml:"redShift"`
+	GreenShift   int  `json:"greenShift" yaml:"greenShift"`
+	BlueShift    int  `json:"blueShift" yaml:"blueShift"`
+}
+
+type AppDataConfig struct {
+	CompressLevel   int    `json:"compressLevel" yaml:"compressLevel"`
+	QualityLevel    int    `json:"qualityLevel" yaml:"qualityLevel"`
+	Encodings       string `json:"encodings" yaml:"encodings"`
+	UseRemoteCursor bool   `json:"useRemoteCursor" yaml:"useRemoteCursor"`
+}
+
+var (
+	PixelFormatStandard = PixelFormat{
+		BitsPerPixel: 32, Depth: 24, BigEndian: false, TrueColour: true,
+		RedMax: 255, GreenMax: 255, BlueMax: 255,
+		RedShift: 0, GreenShift: 8, BlueShift: 16,
+	}
+)